@@ -0,0 +1,162 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+// BlobCache keeps file contents on disk by digest, so files the builder
+// has seen before, in any session, never need to be transferred again.
+type BlobCache struct {
+	dir string
+	// Channels to close when a blob arrives
+	waiting map[string][]chan struct{}
+	// Blobs that have been asked for but haven't arrived yet
+	requested map[string]bool
+	// Blobs the manager said it doesn't have, until asked for again
+	failed map[string]bool
+	lock   sync.Mutex
+}
+
+func NewBlobCache(dir string) *BlobCache {
+	os.MkdirAll(dir, 0777|os.ModeDir)
+	c := new(BlobCache)
+	c.dir = dir
+	c.waiting = make(map[string][]chan struct{})
+	c.requested = make(map[string]bool)
+	c.failed = make(map[string]bool)
+	return c
+}
+
+func (c *BlobCache) blobPath(hash string) string {
+	return path.Join(c.dir, hash)
+}
+
+// Whether the contents for a hash are on disk
+func (c *BlobCache) Has(hash string) bool {
+	if !rmake.ValidHash(hash) {
+		return false
+	}
+	_, err := os.Stat(c.blobPath(hash))
+	return err == nil
+}
+
+// Returns the hashes that are neither on disk nor already asked for,
+// and marks them as asked for.
+func (c *BlobCache) Missing(hashes []string) []string {
+	var out []string
+	c.lock.Lock()
+	for _, h := range hashes {
+		if c.requested[h] || c.Has(h) {
+			continue
+		}
+		c.requested[h] = true
+		delete(c.failed, h)
+		out = append(out, h)
+	}
+	c.lock.Unlock()
+	return out
+}
+
+// Store a blob and wake up anyone waiting for it
+func (c *BlobCache) Put(b *rmake.Blob) error {
+	err := b.Decompress()
+	if err != nil {
+		return err
+	}
+	err = b.Verify()
+	if err != nil {
+		return err
+	}
+	//Write somewhere else first so nobody sees half a blob
+	tmp, err := ioutil.TempFile(c.dir, "incoming")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b.Contents)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), c.blobPath(b.Hash))
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	delete(c.requested, b.Hash)
+	delete(c.failed, b.Hash)
+	for _, ch := range c.waiting[b.Hash] {
+		close(ch)
+	}
+	delete(c.waiting, b.Hash)
+	c.lock.Unlock()
+	return nil
+}
+
+// Give up on a blob that was asked for, waking anyone waiting for it
+// Used when the manager doesn't have it, waiters find it isn't on disk.
+func (c *BlobCache) Fail(hash string) {
+	c.lock.Lock()
+	delete(c.requested, hash)
+	c.failed[hash] = true
+	for _, ch := range c.waiting[hash] {
+		close(ch)
+	}
+	delete(c.waiting, hash)
+	c.lock.Unlock()
+}
+
+// The blobs that were asked for and haven't arrived yet
+// The answer is lost when the connection to the manager drops, so they
+// are asked for again on the new one.
+func (c *BlobCache) Pending() []string {
+	var out []string
+	c.lock.Lock()
+	for h := range c.requested {
+		out = append(out, h)
+	}
+	c.lock.Unlock()
+	return out
+}
+
+// Returns a channel that is closed once the blob is on disk, or the
+// manager turned out not to have it
+func (c *BlobCache) Wait(hash string) chan struct{} {
+	ch := make(chan struct{})
+	c.lock.Lock()
+	if c.Has(hash) || c.failed[hash] {
+		close(ch)
+	} else {
+		c.waiting[hash] = append(c.waiting[hash], ch)
+	}
+	c.lock.Unlock()
+	return ch
+}
+
+// Load the file a manifest entry describes
+func (c *BlobCache) File(e *rmake.ManifestEntry) (*rmake.File, error) {
+	cnts, err := ioutil.ReadFile(c.blobPath(e.Hash))
+	if err != nil {
+		return nil, err
+	}
+	f := new(rmake.File)
+	f.Path = e.Path
+	f.Mode = e.Mode
+	f.Contents = cnts
+	return f, nil
+}
+
+// Add a file to the cache, returning its manifest entry
+func (c *BlobCache) Add(f *rmake.File) (*rmake.ManifestEntry, error) {
+	e := f.Entry()
+	if c.Has(e.Hash) {
+		return e, nil
+	}
+	return e, c.Put(&rmake.Blob{Hash: e.Hash, Contents: f.Contents})
+}
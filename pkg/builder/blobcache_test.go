@@ -0,0 +1,139 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func expectClosed(t *testing.T, ch chan struct{}, what string) {
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %s", what)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	c := NewBlobCache(t.TempDir())
+	a := rmake.NewBlob([]byte("int a;"))
+	b := rmake.NewBlob([]byte("int b;"))
+
+	if missing := c.Missing([]string{a.Hash, b.Hash}); len(missing) != 2 {
+		t.Fatalf("Expected both blobs to be missing, got %d", len(missing))
+	}
+	//They are on their way, nobody needs to ask again
+	if missing := c.Missing([]string{a.Hash, b.Hash}); len(missing) != 0 {
+		t.Fatalf("Expected blobs already asked for not to be missing, got %d", len(missing))
+	}
+	if pending := c.Pending(); len(pending) != 2 {
+		t.Fatalf("Expected 2 blobs to be pending, got %d", len(pending))
+	}
+
+	wait := c.Wait(a.Hash)
+	select {
+	case <-wait:
+		t.Fatal("Expected to wait for a blob that isn't here")
+	default:
+	}
+	if err := c.Put(&rmake.Blob{Hash: a.Hash, Contents: []byte("int c;")}); err == nil {
+		t.Fatal("Expected contents that don't match their hash to be rejected")
+	}
+	if err := c.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, wait, "putting the blob to wake up the wait")
+	if !c.Has(a.Hash) {
+		t.Fatal("Expected the blob to be on disk")
+	}
+	expectClosed(t, c.Wait(a.Hash), "waiting for a blob on disk to return right away")
+	f, err := c.File(&rmake.ManifestEntry{Path: "a.c", Hash: a.Hash})
+	if err != nil || f.Path != "a.c" || string(f.Contents) != "int a;" {
+		t.Fatalf("Expected to load a.c from the cache, got %v", err)
+	}
+
+	//A blob the manager doesn't have wakes up its waiters, and can be
+	//asked for again later
+	wait = c.Wait(b.Hash)
+	c.Fail(b.Hash)
+	expectClosed(t, wait, "failing the blob to wake up the wait")
+	expectClosed(t, c.Wait(b.Hash), "waiting for a failed blob to return right away")
+	if c.Has(b.Hash) {
+		t.Fatal("Expected a failed blob not to be on disk")
+	}
+	if len(c.Pending()) != 0 {
+		t.Fatal("Expected nothing to be pending")
+	}
+	if missing := c.Missing([]string{a.Hash, b.Hash}); !reflect.DeepEqual(missing, []string{b.Hash}) {
+		t.Fatalf("Expected only the failed blob to be missing, got %v", missing)
+	}
+}
+
+//A builder just connected enough to take requests
+func testBuilder(t *testing.T) *Builder {
+	b := new(Builder)
+	b.Blobs = NewBlobCache(t.TempDir())
+	b.incoming = make(chan interface{})
+	b.outgoing = make(chan interface{}, 10)
+	b.stopped = make(chan struct{})
+	b.builds = newBuildTracker()
+	b.RequestQueue = NewRequestQueue(0)
+	go b.HandleMessages()
+	return b
+}
+
+func expectSent(t *testing.T, b *Builder) interface{} {
+	select {
+	case mes := <-b.outgoing:
+		return mes
+	case <-time.After(time.Second):
+		t.Fatal("Expected a message for the manager")
+	}
+	return nil
+}
+
+func TestBuilderRequestInputs(t *testing.T) {
+	b := testBuilder(t)
+	src := rmake.NewBlob([]byte("int main;"))
+	req := &rmake.BuilderRequest{
+		BuildJob: &rmake.Job{Command: "cc", Args: []string{"-c", "main.c"}, Output: "main.o"},
+		Session:  "s",
+		Build:    1,
+		Input:    []*rmake.ManifestEntry{{Path: "main.c", Hash: src.Hash}},
+	}
+
+	b.incoming <- req
+	br, ok := expectSent(t, b).(*rmake.BlobRequest)
+	if !ok || !reflect.DeepEqual(br.Hashes, []string{src.Hash}) {
+		t.Fatalf("Expected the builder to ask for main.c, got %v", br)
+	}
+	if b.RequestQueue.Len() != 0 {
+		t.Fatal("Expected the request to wait for its inputs")
+	}
+	b.incoming <- &rmake.BlobData{Blobs: []*rmake.Blob{src}}
+	queued, _ := b.RequestQueue.Pop()
+	if queued != req {
+		t.Fatal("Expected the request to be queued once its inputs arrived")
+	}
+
+	//The manager lost the contents, so the job fails
+	gone := rmake.NewBlob([]byte("int f;"))
+	req = &rmake.BuilderRequest{
+		BuildJob: &rmake.Job{Command: "cc", Args: []string{"-c", "f.c"}, Output: "f.o"},
+		Session:  "s",
+		Build:    1,
+		Input:    []*rmake.ManifestEntry{{Path: "f.c", Hash: gone.Hash}},
+	}
+	b.incoming <- req
+	expectSent(t, b)
+	b.incoming <- &rmake.BlobData{Missing: []string{gone.Hash}}
+	jf, ok := expectSent(t, b).(*rmake.JobFinishedMessage)
+	if !ok || jf.Success || jf.Output != "f.o" || jf.Error == "" {
+		t.Fatalf("Expected the job for f.o to fail, got %v", jf)
+	}
+	if b.RequestQueue.Len() != 0 {
+		t.Fatal("Expected the failed request not to be queued")
+	}
+}
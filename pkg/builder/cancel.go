@@ -0,0 +1,118 @@
+package builder
+
+import (
+	"os/exec"
+	"sync"
+
+	slog "github.com/cihub/seelog"
+)
+
+//Identifies a single build of a session
+type buildKey struct {
+	session string
+	build   int
+}
+
+//Keeps track of cancelled builds and the commands running for each
+type buildTracker struct {
+	//Closed once a build is cancelled
+	cancelled map[buildKey]chan struct{}
+	running   map[buildKey]map[*exec.Cmd]bool
+	lock      sync.Mutex
+}
+
+func newBuildTracker() *buildTracker {
+	t := new(buildTracker)
+	t.cancelled = make(map[buildKey]chan struct{})
+	t.running = make(map[buildKey]map[*exec.Cmd]bool)
+	return t
+}
+
+//A channel that is closed when the build is cancelled
+func (t *buildTracker) Done(session string, build int) chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.doneUnsafe(buildKey{session, build})
+}
+
+func (t *buildTracker) doneUnsafe(key buildKey) chan struct{} {
+	ch, ok := t.cancelled[key]
+	if !ok {
+		ch = make(chan struct{})
+		t.cancelled[key] = ch
+	}
+	return ch
+}
+
+func (t *buildTracker) IsCancelled(session string, build int) bool {
+	select {
+	case <-t.Done(session, build):
+		return true
+	default:
+		return false
+	}
+}
+
+//Start a command for a build, unless the build was cancelled
+//Commands that were started have to be passed to Finished.
+func (t *buildTracker) Start(session string, build int, cmd *exec.Cmd) (bool, error) {
+	key := buildKey{session, build}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.doneUnsafe(key):
+		return false, nil
+	default:
+	}
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return false, err
+	}
+	if t.running[key] == nil {
+		t.running[key] = make(map[*exec.Cmd]bool)
+	}
+	t.running[key][cmd] = true
+	return true, nil
+}
+
+func (t *buildTracker) Finished(session string, build int, cmd *exec.Cmd) {
+	key := buildKey{session, build}
+	t.lock.Lock()
+	delete(t.running[key], cmd)
+	if len(t.running[key]) == 0 {
+		delete(t.running, key)
+	}
+	t.lock.Unlock()
+}
+
+//Cancel a build, killing the commands running for it
+func (t *buildTracker) Cancel(session string, build int) {
+	key := buildKey{session, build}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ch := t.doneUnsafe(key)
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+	for cmd := range t.running[key] {
+		slog.Infof("Killing '%s' of build %d of session '%s'", cmd.Path, build, session)
+		err := killProcessGroup(cmd)
+		if err != nil {
+			slog.Error(err)
+		}
+	}
+}
+
+//Forget everything about the builds of a session
+func (t *buildTracker) Release(session string) {
+	t.lock.Lock()
+	for key := range t.cancelled {
+		if key.session == session {
+			delete(t.cancelled, key)
+		}
+	}
+	t.lock.Unlock()
+}
@@ -0,0 +1,32 @@
+package builder
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCancelBuild(t *testing.T) {
+	tr := newBuildTracker()
+	cmd := exec.Command("sh", "-c", "sleep 10; echo done")
+	started, err := tr.Start("s", 1, cmd)
+	if !started || err != nil {
+		t.Fatalf("Expected the command to start, got %v", err)
+	}
+
+	start := time.Now()
+	tr.Cancel("s", 1)
+	cmd.Wait()
+	tr.Finished("s", 1, cmd)
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Expected cancelling the build to kill its command")
+	}
+	if !tr.IsCancelled("s", 1) || tr.IsCancelled("s", 2) {
+		t.Fatal("Expected only build 1 to be cancelled")
+	}
+
+	started, err = tr.Start("s", 1, exec.Command("true"))
+	if started || err != nil {
+		t.Fatal("Expected commands of a cancelled build not to start")
+	}
+}
@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"os"
+	"sort"
+)
+
+//Variables passed through from the builder's own environment
+//Everything else is dropped so jobs see the same environment on
+//every builder, whoever started it.
+var passEnv = []string{"PATH", "HOME", "TMPDIR"}
+
+//The environment every job starts from
+func BaseEnv() []string {
+	env := []string{"LANG=C", "LC_ALL=C"}
+	for _, k := range passEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+//Add a build's variables to a base environment, overriding any
+//variable of the same name
+func JobEnv(base []string, vars map[string]string) []string {
+	var env []string
+	for _, kv := range base {
+		k := kv
+		for i := 0; i < len(kv); i++ {
+			if kv[i] == '=' {
+				k = kv[:i]
+				break
+			}
+		}
+		if _, ok := vars[k]; !ok {
+			env = append(env, kv)
+		}
+	}
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+vars[k])
+	}
+	return env
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package builder
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//Run a command in a process group of its own, so that killing it
+//takes the processes it started with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,159 @@
+package builder
+
+import (
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestReconnect(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	b := testBuilder(t)
+	b.ManagerAddr = list.Addr().String()
+	old, theirs := net.Pipe()
+	go io.Copy(ioutil.Discard, theirs)
+	b.manager = old
+	b.enc = gob.NewEncoder(old)
+	b.dec = gob.NewDecoder(old)
+	go b.ManagerSender()
+
+	//Messages keep coming while the builder reconnects
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case b.outgoing <- &rmake.Ping{}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	first := make(chan interface{}, 1)
+	go func() {
+		con, err := list.Accept()
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		dec := gob.NewDecoder(con)
+		var mes interface{}
+		if dec.Decode(&mes) != nil {
+			return
+		}
+		first <- mes
+		ack := rmake.NewManagerAcknowledgeSuccess(7)
+		ack.HeartbeatInterval = time.Second
+		mes = ack
+		gob.NewEncoder(con).Encode(&mes)
+		//Keep reading until the test is over
+		for dec.Decode(&mes) == nil {
+		}
+	}()
+
+	if err := b.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case mes := <-first:
+		if _, ok := mes.(*rmake.BuilderAnnouncement); !ok {
+			t.Fatalf("Expected the announcement to come first, got %s", reflect.TypeOf(mes))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the builder to announce itself")
+	}
+	b.connLock.Lock()
+	freq, uuid := b.UpdateFrequency, b.UUID
+	b.connLock.Unlock()
+	if uuid != 7 || freq != time.Second {
+		t.Fatalf("Expected the handshake to set the UUID and heartbeat, got %d and %s", uuid, freq)
+	}
+	if _, err := old.Write([]byte{0}); err == nil {
+		t.Fatal("Expected the old connection to be closed")
+	}
+}
+
+func TestStop(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	defer func(d time.Duration) { reconnectDelay = d }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	announced := make(chan bool, 10)
+	go func() {
+		for {
+			con, err := list.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer con.Close()
+				dec := gob.NewDecoder(con)
+				var mes interface{}
+				if dec.Decode(&mes) != nil {
+					return
+				}
+				announced <- true
+				mes = rmake.NewManagerAcknowledgeSuccess(1)
+				gob.NewEncoder(con).Encode(&mes)
+				for dec.Decode(&mes) == nil {
+				}
+			}()
+		}
+	}()
+
+	b := NewBuilder("127.0.0.1:0", list.Addr().String(), 2)
+	if b == nil {
+		t.Fatal("Expected the builder to connect")
+	}
+	b.UpdateFrequency = time.Millisecond
+	if err := b.DoHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	<-announced
+	ran := make(chan bool)
+	go func() {
+		b.Run()
+		ran <- true
+	}()
+	//Let it send some status updates
+	time.Sleep(20 * time.Millisecond)
+	b.Stop()
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the builder to stop")
+	}
+
+	//A stopped builder doesn't come back
+	select {
+	case <-announced:
+		t.Fatal("Expected the stopped builder not to reconnect")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if b.WaitForFile("s", 1, "a.o") == nil {
+		t.Fatal("Expected waiting for a file to give a channel")
+	}
+}
@@ -1,80 +1,252 @@
 package builder
 
 import (
+	"container/heap"
+	"errors"
 	"sync"
 
 	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
+var (
+	ErrQueueClosed = errors.New("The request queue is closed")
+	ErrPushAborted = errors.New("Gave up waiting for room in the request queue")
+)
+
 // The RequestQueue
+// Requests come out highest priority first, and in the order they were
+// pushed when their priorities are equal. A queue with a capacity makes
+// Push wait for room once it is full.
 type RequestQueue struct {
 	// The backing datastructure
-	queue chan *rmake.BuilderRequest
+	queue requestHeap
+	// The number of requests pushed so far, to keep equal ones in order
+	pushed int
+	// How many requests the queue holds, zero for no limit
+	capacity int
+	// Pushes waiting for room
+	blocked int
+	// Whether OnFull was last told the queue is full
+	told bool
 	// The mutex for locking
-	rwmutex sync.RWMutex
+	mutex sync.Mutex
+	// Signalled when a request is pushed or the queue is closed
+	ready *sync.Cond
+	// Closed, and replaced, whenever room is made
+	room chan struct{}
 	open bool
+
+	// Called whenever the queue fills up or has room again, outside
+	// of the queue's lock
+	OnFull func(full bool)
 }
 
-func NewRequestQueue() *RequestQueue {
+// Make a queue holding up to capacity requests, zero for no limit
+func NewRequestQueue(capacity int) *RequestQueue {
 	rq := new(RequestQueue)
-	rq.queue = make(chan *rmake.BuilderRequest, 64)
+	rq.ready = sync.NewCond(&rq.mutex)
+	rq.room = make(chan struct{})
+	rq.capacity = capacity
 	rq.open = true
 	return rq
 }
 
 // Push a request to the RequestQueue
-func (jq *RequestQueue) Push(br *rmake.BuilderRequest) {
-	jq.rwmutex.RLock()
-	jq.queue <- br
-	jq.rwmutex.RUnlock()
+// Waits while the queue is full, until there is room, the queue is
+// closed or cancel is closed.
+func (jq *RequestQueue) Push(br *rmake.BuilderRequest, cancel <-chan struct{}) error {
+	jq.mutex.Lock()
+	for jq.open && jq.capacity > 0 && jq.queue.Len() >= jq.capacity {
+		room := jq.room
+		jq.blocked++
+		jq.mutex.Unlock()
+		jq.notify()
+
+		var err error
+		select {
+		case <-room:
+		case <-cancel:
+			err = ErrPushAborted
+		}
+
+		jq.mutex.Lock()
+		jq.blocked--
+		if err != nil {
+			jq.mutex.Unlock()
+			jq.notify()
+			return err
+		}
+	}
+	if !jq.open {
+		jq.mutex.Unlock()
+		return ErrQueueClosed
+	}
+	heap.Push(&jq.queue, &queuedRequest{br, jq.pushed})
+	jq.pushed++
+	jq.mutex.Unlock()
+	jq.ready.Signal()
+	jq.notify()
+	return nil
 }
 
 // Pop a request from the RequestQueue
+// Waits for one to be pushed, returns false once the queue is closed.
 func (jq *RequestQueue) Pop() (*rmake.BuilderRequest, bool) {
-	jq.rwmutex.RLock()
+	jq.mutex.Lock()
+	for jq.open && jq.queue.Len() == 0 {
+		jq.ready.Wait()
+	}
 	if !jq.open {
-		return nil,false
+		jq.mutex.Unlock()
+		return nil, false
 	}
-	p := <-jq.queue
-	jq.rwmutex.RUnlock()
-	return p,true
+	req := heap.Pop(&jq.queue).(*queuedRequest).req
+	jq.madeRoomUnsafe()
+	jq.mutex.Unlock()
+	jq.notify()
+	return req, true
 }
 
 // The length of the RequestQueue
 func (jq *RequestQueue) Len() int {
-	jq.rwmutex.RLock()
-	l := jq.lenUnsafe()
-	jq.rwmutex.RUnlock()
+	jq.mutex.Lock()
+	l := jq.queue.Len()
+	jq.mutex.Unlock()
 	return l
 }
 
-func (jq *RequestQueue) Close() {
-	jq.rwmutex.Lock()
+// Whether the queue is full, or pushes are waiting for room
+func (jq *RequestQueue) Full() bool {
+	jq.mutex.Lock()
+	defer jq.mutex.Unlock()
+	return jq.fullUnsafe()
+}
+
+// Change how many requests the queue holds, zero for no limit
+func (jq *RequestQueue) SetCapacity(capacity int) {
+	jq.mutex.Lock()
+	jq.capacity = capacity
+	jq.madeRoomUnsafe()
+	jq.mutex.Unlock()
+	jq.notify()
+}
+
+// Close the queue
+// Pop and Push return right away from then on, including the calls
+// already waiting. The requests that were still queued are returned.
+func (jq *RequestQueue) Close() []*rmake.BuilderRequest {
+	jq.mutex.Lock()
+	if !jq.open {
+		jq.mutex.Unlock()
+		return nil
+	}
 	jq.open = false
-	jq.rwmutex.Unlock()
+	var left []*rmake.BuilderRequest
+	for jq.queue.Len() > 0 {
+		left = append(left, heap.Pop(&jq.queue).(*queuedRequest).req)
+	}
+	close(jq.room)
+	jq.mutex.Unlock()
+	jq.ready.Broadcast()
+	return left
+}
+
+// Take out the request for a job, by its session, build and output
+func (jq *RequestQueue) RemoveJob(session string, build int, output string) *rmake.BuilderRequest {
+	removed := jq.remove(func(br *rmake.BuilderRequest) bool {
+		return br.Session == session && br.Build == build && br.BuildJob.Output == output
+	})
+	if len(removed) == 0 {
+		return nil
+	}
+	return removed[0]
+}
+
+// Take out every request of a build
+func (jq *RequestQueue) RemoveBuild(session string, build int) []*rmake.BuilderRequest {
+	return jq.remove(func(br *rmake.BuilderRequest) bool {
+		return br.Session == session && br.Build == build
+	})
 }
 
-// Get the length of the queue in an unsafe manner
-func (jq *RequestQueue) lenUnsafe() int {
-	return len(jq.queue)
+// Take out every request of a session
+func (jq *RequestQueue) RemoveSession(session string) []*rmake.BuilderRequest {
+	return jq.remove(func(br *rmake.BuilderRequest) bool {
+		return br.Session == session
+	})
 }
 
-// Abort everything with a specific ID
-func (jq *RequestQueue) Remove(id int) []*rmake.BuilderRequest {
-	s := make([]*rmake.BuilderRequest, 0)
-	// Critical section
-	jq.rwmutex.Lock()
-	n := jq.lenUnsafe()
-	// Iterate over each request in the queue
-	for i := 0; i < n; i++ {
-		request := <-jq.queue
-		if request.BuildJob.ID == id {
-			jq.queue <- request
+func (jq *RequestQueue) remove(match func(*rmake.BuilderRequest) bool) []*rmake.BuilderRequest {
+	var s []*rmake.BuilderRequest
+	jq.mutex.Lock()
+	for i := 0; i < jq.queue.Len(); {
+		if match(jq.queue[i].req) {
+			s = append(s, heap.Remove(&jq.queue, i).(*queuedRequest).req)
 		} else {
-			s = append(s, request)
-			i++ // Add another
+			i++
 		}
 	}
-	jq.rwmutex.Unlock()
+	if len(s) > 0 {
+		jq.madeRoomUnsafe()
+	}
+	jq.mutex.Unlock()
+	jq.notify()
 	return s
 }
+
+func (jq *RequestQueue) fullUnsafe() bool {
+	return jq.capacity > 0 && jq.queue.Len()+jq.blocked >= jq.capacity
+}
+
+// Wake the pushes waiting for room
+func (jq *RequestQueue) madeRoomUnsafe() {
+	//Close already woke them for good
+	if jq.open && jq.blocked > 0 {
+		close(jq.room)
+		jq.room = make(chan struct{})
+	}
+}
+
+// Tell OnFull whether the queue is full, if that changed since it was
+// last told
+func (jq *RequestQueue) notify() {
+	jq.mutex.Lock()
+	full := jq.fullUnsafe()
+	f := jq.OnFull
+	changed := f != nil && jq.told != full
+	jq.told = full
+	jq.mutex.Unlock()
+	if changed {
+		f(full)
+	}
+}
+
+type queuedRequest struct {
+	req *rmake.BuilderRequest
+	seq int
+}
+
+// A heap of requests, for container/heap
+type requestHeap []*queuedRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].req.Priority != h[j].req.Priority {
+		return h[i].req.Priority > h[j].req.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *requestHeap) Push(x interface{}) {
+	*h = append(*h, x.(*queuedRequest))
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,226 @@
+package builder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func request(session string, build int, output string, priority time.Duration) *rmake.BuilderRequest {
+	return &rmake.BuilderRequest{
+		BuildJob: &rmake.Job{Output: output},
+		Session:  session,
+		Build:    build,
+		Priority: priority,
+	}
+}
+
+func expectPops(t *testing.T, rq *RequestQueue, outputs ...string) {
+	for _, o := range outputs {
+		br, ok := rq.Pop()
+		if !ok {
+			t.Fatalf("Expected to pop %s, the queue was closed", o)
+		}
+		if br.BuildJob.Output != o {
+			t.Fatalf("Expected to pop %s, got %s", o, br.BuildJob.Output)
+		}
+	}
+}
+
+func TestRequestQueuePriority(t *testing.T) {
+	rq := NewRequestQueue(0)
+	rq.Push(request("s", 1, "a.o", time.Second), nil)
+	rq.Push(request("s", 1, "b.o", 3*time.Second), nil)
+	rq.Push(request("s", 1, "c.o", time.Second), nil)
+	rq.Push(request("s", 1, "d.o", 2*time.Second), nil)
+	if rq.Len() != 4 {
+		t.Fatalf("Expected 4 queued requests, got %d", rq.Len())
+	}
+	//Equal priorities come out in the order they went in
+	expectPops(t, rq, "b.o", "d.o", "a.o", "c.o")
+	if rq.Len() != 0 {
+		t.Fatalf("Expected the queue to be empty, got %d", rq.Len())
+	}
+}
+
+func TestRequestQueueRemove(t *testing.T) {
+	rq := NewRequestQueue(0)
+	rq.Push(request("s", 1, "a.o", 0), nil)
+	rq.Push(request("s", 2, "a.o", 0), nil)
+	rq.Push(request("s", 2, "b.o", 0), nil)
+	rq.Push(request("t", 1, "a.o", 0), nil)
+	rq.Push(request("t", 1, "b.o", 0), nil)
+
+	if br := rq.RemoveJob("s", 2, "b.o"); br == nil || br.Session != "s" || br.Build != 2 || br.BuildJob.Output != "b.o" {
+		t.Fatalf("Expected to remove b.o of build 2 of s, got %v", br)
+	}
+	if br := rq.RemoveJob("s", 2, "b.o"); br != nil {
+		t.Fatal("Expected b.o of build 2 of s to be gone")
+	}
+	if removed := rq.RemoveBuild("s", 1); len(removed) != 1 || removed[0].Build != 1 {
+		t.Fatalf("Expected to remove the one request of build 1 of s, got %d", len(removed))
+	}
+	if removed := rq.RemoveBuild("s", 1); len(removed) != 0 {
+		t.Fatal("Expected build 1 of s to be gone")
+	}
+	if removed := rq.RemoveSession("t"); len(removed) != 2 {
+		t.Fatalf("Expected to remove the 2 requests of t, got %d", len(removed))
+	}
+	if rq.Len() != 1 {
+		t.Fatalf("Expected 1 request left, got %d", rq.Len())
+	}
+	br, _ := rq.Pop()
+	if br.Session != "s" || br.Build != 2 || br.BuildJob.Output != "a.o" {
+		t.Fatalf("Expected a.o of build 2 of s to be left, got %s of build %d of %s", br.BuildJob.Output, br.Build, br.Session)
+	}
+}
+
+func TestRequestQueueCapacity(t *testing.T) {
+	rq := NewRequestQueue(2)
+	reports := make(chan bool, 10)
+	rq.OnFull = func(full bool) {
+		reports <- full
+	}
+	expectReport := func(full bool) {
+		select {
+		case f := <-reports:
+			if f != full {
+				t.Fatalf("Expected to be told the queue is full: %v, got %v", full, f)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected to be told the queue is full: %v", full)
+		}
+	}
+
+	rq.Push(request("s", 1, "a.o", 0), nil)
+	if rq.Full() {
+		t.Fatal("Expected a queue of 2 with 1 request to have room")
+	}
+	rq.Push(request("s", 1, "b.o", 0), nil)
+	if !rq.Full() {
+		t.Fatal("Expected a queue of 2 with 2 requests to be full")
+	}
+	expectReport(true)
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- rq.Push(request("s", 1, "c.o", time.Second), nil)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected the push to wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	expectPops(t, rq, "a.o")
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	expectPops(t, rq, "c.o")
+	expectReport(false)
+
+	//Giving up on a push leaves the queue as it was
+	rq.Push(request("s", 1, "d.o", 0), nil)
+	cancel := make(chan struct{})
+	go func() {
+		pushed <- rq.Push(request("s", 1, "e.o", 0), cancel)
+	}()
+	close(cancel)
+	if err := <-pushed; err != ErrPushAborted {
+		t.Fatalf("Expected the push to be aborted, got %v", err)
+	}
+	if rq.Len() != 2 {
+		t.Fatalf("Expected 2 queued requests, got %d", rq.Len())
+	}
+
+	//Removing requests makes room too
+	go func() {
+		pushed <- rq.Push(request("s", 2, "f.o", 0), nil)
+	}()
+	rq.RemoveBuild("s", 1)
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	expectPops(t, rq, "f.o")
+
+	rq.SetCapacity(0)
+	for i := 0; i < 10; i++ {
+		rq.Push(request("s", 3, "g.o", 0), nil)
+	}
+	if rq.Full() {
+		t.Fatal("Expected a queue without a capacity never to be full")
+	}
+}
+
+func TestRequestQueueClose(t *testing.T) {
+	rq := NewRequestQueue(1)
+	popped := make(chan bool)
+	go func() {
+		_, ok := rq.Pop()
+		popped <- ok
+	}()
+	if left := rq.Close(); len(left) != 0 {
+		t.Fatalf("Expected nothing to be left in the queue, got %d", len(left))
+	}
+	select {
+	case ok := <-popped:
+		if ok {
+			t.Fatal("Expected pop to fail on a closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected closing the queue to wake up pop")
+	}
+	if err := rq.Push(request("s", 1, "a.o", 0), nil); err != ErrQueueClosed {
+		t.Fatalf("Expected pushing to a closed queue to fail, got %v", err)
+	}
+
+	//Pushes waiting for room give up as well, and the requests still
+	//queued are handed back
+	rq = NewRequestQueue(1)
+	rq.Push(request("s", 1, "a.o", 0), nil)
+	pushed := make(chan error)
+	go func() {
+		pushed <- rq.Push(request("s", 1, "b.o", 0), nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	left := rq.Close()
+	if len(left) != 1 || left[0].BuildJob.Output != "a.o" {
+		t.Fatalf("Expected a.o to be left in the queue, got %d requests", len(left))
+	}
+	select {
+	case err := <-pushed:
+		if err != ErrQueueClosed {
+			t.Fatalf("Expected the push to fail on a closed queue, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected closing the queue to wake up push")
+	}
+	rq.SetCapacity(0)
+	rq.Close()
+}
+
+func TestStatusAfterShutdown(t *testing.T) {
+	b := new(Builder)
+	b.outgoing = make(chan interface{})
+	b.stopped = make(chan struct{})
+	b.RequestQueue = NewRequestQueue(1)
+	b.RequestQueue.OnFull = func(full bool) {
+		b.SendStatusUpdate()
+	}
+	close(b.stopped)
+
+	//Filling the queue reports it, which nobody sends on anymore
+	pushed := make(chan error)
+	go func() {
+		pushed <- b.RequestQueue.Push(request("s", 1, "a.o", 0), nil)
+	}()
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected reporting a full queue not to wait once the builder is stopped")
+	}
+}
@@ -3,13 +3,16 @@
 package builder
 
 import (
+	"bytes"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"time"
 
 	"reflect"
@@ -18,15 +21,24 @@ import (
 	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
+//How long to wait before reconnecting to the manager
+var reconnectDelay = time.Second * 5
+
 type Builder struct {
 	manager net.Conn
 	enc     *gob.Encoder
 	dec     *gob.Decoder
 	list    net.Listener
+	//Guards the connection to the manager and what the handshake sets,
+	//which change when reconnecting
+	connLock sync.Mutex
 
 	ListenerAddr string
 	ManagerAddr  string
 
+	//How often to send the manager a status update, as a heartbeat
+	//Offered in the handshake, the manager answers with the interval
+	//to use. Zero leaves it to the manager.
 	UpdateFrequency time.Duration
 	Running         bool
 
@@ -35,10 +47,12 @@ type Builder struct {
 	outgoing chan interface{}
 
 	//Some data structures to synchronize file transfers
-	waitfile    map[string]chan *rmake.File
+	waitfile    map[fileKey][]chan *rmake.File
+	arrived     map[fileKey]*rmake.File
 	reqfilewait chan *FileWait
-	localfiles  chan []string //session, filepath
+	localfiles  chan fileKey
 	newfiles    chan *rmake.RequiredFileMessage
+	releases    chan string
 
 	mgrReconnect chan struct{}
 
@@ -47,18 +61,46 @@ type Builder struct {
 
 	//Channel to signal that the builder should shutdown
 	Halt chan struct{}
+	//Closed once the builder is shutting down, nothing is sent to the
+	//manager from then on
+	stopped chan struct{}
 
 	RequestQueue *RequestQueue
 	RunningJobs chan struct{}
+	//Cancelled builds and the commands running for each build
+	builds *buildTracker
+
+	//File contents by digest, shared between sessions
+	Blobs *BlobCache
+
+	//The environment jobs start from, before a build's variables
+	Env []string
+
+	//The compression level we would like to use on our connections
+	Compression int
+	//The compression agreed on with the manager
+	managerComp *rmake.Compression
+	//CPU usage since the last status update
+	cpu cpuSampler
 }
 
 //A struct to aid in waiting on dependency files
 type FileWait struct {
 	File    string
 	Session string
+	Build   int
 	Reply   chan *rmake.File
 }
 
+//Identifies a file needed by a single build of a session
+//Session directories outlive builds, so a file left over from an
+//earlier build must not satisfy a wait in a later one.
+type fileKey struct {
+	session string
+	build   int
+	path    string
+}
+
 func NewBuilder(listen string, manager string, nprocs int) *Builder {
 	// Setup manager connection
 	mgr, err := net.Dial("tcp", manager)
@@ -93,15 +135,25 @@ func NewBuilder(listen string, manager string, nprocs int) *Builder {
 	b.outgoing = make(chan interface{})
 
 	b.newfiles = make(chan *rmake.RequiredFileMessage)
-	b.waitfile = make(map[string]chan *rmake.File)
+	b.waitfile = make(map[fileKey][]chan *rmake.File)
+	b.arrived = make(map[fileKey]*rmake.File)
 	b.reqfilewait = make(chan *FileWait)
-	b.localfiles = make(chan []string)
+	b.localfiles = make(chan fileKey)
+	b.releases = make(chan string)
 
-	b.RequestQueue = NewRequestQueue()
+	b.RequestQueue = NewRequestQueue(0)
+	//The manager should hear right away when we can't take more
+	b.RequestQueue.OnFull = func(full bool) {
+		go b.SendStatusUpdate()
+	}
+	b.builds = newBuildTracker()
+	b.Blobs = NewBlobCache(path.Join("builds", "blobs"))
+	b.Env = BaseEnv()
+	b.Compression = rmake.CompressFast
 	b.RunningJobs = make(chan struct{}, nprocs)
 
-	b.UpdateFrequency = time.Second * 60
 	b.Halt = make(chan struct{})
+	b.stopped = make(chan struct{})
 	b.mgrReconnect = make(chan struct{})
 
 	for i := 0; i < nprocs; i++ {
@@ -111,59 +163,115 @@ func NewBuilder(listen string, manager string, nprocs int) *Builder {
 }
 
 //Handles incoming files and requests for them
+//Files are remembered for the rest of their build, since several jobs
+//may need the same one, whether they ask before or after it shows up.
 func (b *Builder) FileSyncRoutine() {
 	for {
 		select {
 		case req := <-b.reqfilewait:
-			wpath := path.Join("builds", req.Session, req.File)
-			slog.Infof("Now waiting on: '%s'", wpath)
-			b.waitfile[wpath] = req.Reply
+			key := fileKey{req.Session, req.Build, req.File}
+			//Anything older builds of this session left behind is stale
+			for k := range b.arrived {
+				if k.session == req.Session && k.build < req.Build {
+					delete(b.arrived, k)
+				}
+			}
+			if fi, ok := b.arrived[key]; ok {
+				req.Reply <- fi
+				continue
+			}
+			slog.Infof("Now waiting on: '%s' for build %d of session '%s'", req.File, req.Build, req.Session)
+			b.waitfile[key] = append(b.waitfile[key], req.Reply)
 		case fi := <-b.newfiles:
 			if fi.Payload == nil {
 				slog.Error("Received nil file!")
 				continue
 			}
-			wpath := path.Join("builds", fi.Session, fi.Payload.Path)
-			ch, ok := b.waitfile[wpath]
-			if !ok {
-				slog.Warnf("Received file nobody was asking for, session: '%s', path: '%s'",
-					fi.Session, fi.Payload.Path)
+			err := fi.Payload.Save(path.Join("builds", fi.Session))
+			if err != nil {
+				slog.Error("Error saving file!")
+				slog.Error(err)
 			}
-			ch <- fi.Payload
-			delete(b.waitfile, wpath)
-		case fi := <-b.localfiles:
-			wpath := path.Join("builds", fi[0], fi[1])
-			ch, ok := b.waitfile[wpath]
-			if !ok {
-				slog.Warnf("Received file nobody was asking for, session: '%s', path: '%s'",
-					fi[0], fi[1])
+			b.fileArrived(fileKey{fi.Session, fi.Build, fi.Payload.Path}, fi.Payload)
+		case key := <-b.localfiles:
+			b.fileArrived(key, nil)
+		case session := <-b.releases:
+			for k := range b.arrived {
+				if k.session == session {
+					delete(b.arrived, k)
+				}
 			}
-			ch <- nil
-			delete(b.waitfile, wpath)
+		case <-b.stopped:
+			return
 		}
 	}
 }
 
+//Hand a file to whoever is waiting on it, and keep it for later
+//A nil file means it was produced locally.
+func (b *Builder) fileArrived(key fileKey, fi *rmake.File) {
+	if fi != nil {
+		//The contents are in the session directory already
+		fi = &rmake.File{Path: fi.Path, Mode: fi.Mode}
+	}
+	b.arrived[key] = fi
+	for _, ch := range b.waitfile[key] {
+		ch <- fi
+	}
+	delete(b.waitfile, key)
+}
+
 //Register a listener for receiving a certain file
 //The requested file will be sent on the returned channel when it
-//is received.
-func (b *Builder) WaitForFile(session, file string) chan *rmake.File {
+//is received, after it has been saved into the session directory.
+func (b *Builder) WaitForFile(session string, build int, file string) chan *rmake.File {
 	fw := new(FileWait)
 	fw.File = file
 	fw.Session = session
-	fw.Reply = make(chan *rmake.File)
+	fw.Build = build
+	fw.Reply = make(chan *rmake.File, 1)
 
-	b.reqfilewait <- fw
+	select {
+	case b.reqfilewait <- fw:
+	case <-b.stopped:
+	}
 	return fw.Reply
 }
 
+//Remove everything kept for a session that is over
+func (b *Builder) ReleaseSession(session string) {
+	b.RequestQueue.RemoveSession(session)
+	if b.removeSession(session) {
+		b.builds.Release(session)
+	}
+}
+
+//Remove the work directory of a session and forget the files it got
+//Returns false for session IDs that would escape builds/.
+func (b *Builder) removeSession(session string) bool {
+	//Session IDs come over the network, don't let them escape builds/
+	if session == "" || session != path.Base(session) || session == ".." || session == "blobs" {
+		slog.Warnf("Refusing to remove bad session '%s'", session)
+		return false
+	}
+	select {
+	case b.releases <- session:
+	case <-b.stopped:
+		return false
+	}
+	err := os.RemoveAll(path.Join("builds", session))
+	if err != nil {
+		slog.Error(err)
+	}
+	return true
+}
+
 //A routine that waits for jobs in the job queue
-//One of these should be spawned per processor core.
-//TODO: Eventually add in shutdown channel to the select statement
-//for clean shutdowns
+//One of these should be spawned per processor core. It returns once the
+//queue is closed.
 func (b *Builder) BuilderThread() {
 	for {
-		work,ok := b.RequestQueue.Pop()
+		work, ok := b.RequestQueue.Pop()
 		if !ok {
 			return
 		}
@@ -175,46 +283,72 @@ func (b *Builder) BuilderThread() {
 
 //
 func (b *Builder) RunJob(req *rmake.BuilderRequest) {
+	if b.builds.IsCancelled(req.Session, req.Build) {
+		slog.Infof("Dropping job for '%s' of cancelled build.", req.BuildJob.Output)
+		return
+	}
 	slog.Infof("Starting job for session: '%s'\n", req.Session)
 	slog.Info(req.BuildJob)
 	sdir := path.Join("builds", req.Session)
 	os.Mkdir(sdir, 0777|os.ModeDir)
 
-	for _, f := range req.Input {
-		err := f.Save(sdir)
-		if err != nil {
-			slog.Error(err)
+	//Everything the job needs is here by the time it is queued
+	for _, e := range req.Input {
+		f, err := b.Blobs.File(e)
+		if err == nil {
+			err = f.Save(sdir)
 		}
-	}
-
-	var waitlist []chan *rmake.File
-	for _, dep := range req.BuildJob.Deps {
-		depPath := path.Join(sdir, dep)
-		_, err := os.Stat(depPath)
 		if err != nil {
-			slog.Infof("Missing dependency: '%s'\n", dep)
-			fch := b.WaitForFile(req.Session, dep)
-			waitlist = append(waitlist, fch)
+			slog.Error(err)
 		}
 	}
 
-	for _, ch := range waitlist {
-		f := <-ch
-		if f == nil {
-			slog.Info("Got notified of local file.")
-		} else {
-			slog.Infof("Got file we were waiting for: '%s'", f.Path)
-			f.Save(sdir)
-		}
+	//Imported jobs often write into directories that don't exist yet
+	for _, o := range req.BuildJob.OutputFiles() {
+		os.MkdirAll(path.Dir(path.Join(sdir, o)), 0777|os.ModeDir)
 	}
 
 	resp := new(rmake.JobFinishedMessage)
-	cmd := exec.Command(req.BuildJob.Command, req.BuildJob.Args...)
+	job := req.BuildJob.Expand(req.Vars)
+	cmd := exec.Command(job.Command, job.Args...)
 	cmd.Dir = sdir
-
-	out, err := cmd.CombinedOutput()
-	resp.Stdout = string(out)
+	cmd.Env = JobEnv(b.Env, req.Vars)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	start := time.Now()
+	started, err := b.builds.Start(req.Session, req.Build, cmd)
+	if started {
+		b.SendToManager(&rmake.JobStartedMessage{Session: req.Session, Build: req.Build, Output: req.BuildJob.Output})
+		err = cmd.Wait()
+		b.builds.Finished(req.Session, req.Build, cmd)
+	} else if err == nil {
+		slog.Infof("Dropping job for '%s' of cancelled build.", req.BuildJob.Output)
+		return
+	}
+	if b.builds.IsCancelled(req.Session, req.Build) {
+		slog.Infof("Job for '%s' was cancelled.", req.BuildJob.Output)
+		return
+	}
+	resp.Duration = time.Since(start)
+	resp.Stdout = out.String()
 	resp.Session = req.Session
+	resp.Build = req.Build
+	resp.Output = req.BuildJob.Output
+	if err == nil {
+		//A job that didn't make what it promised failed too
+		resp.OutputSizes = make(map[string]int64)
+		for _, o := range req.BuildJob.OutputFiles() {
+			inf, serr := os.Stat(path.Join(sdir, o))
+			if serr != nil {
+				err = fmt.Errorf("The command did not create '%s'", o)
+				break
+			}
+			resp.OutputSizes[o] = inf.Size()
+		}
+	}
+	resp.Success = err == nil
 	if err != nil {
 		slog.Error(err)
 		resp.Error = err.Error()
@@ -222,54 +356,52 @@ func (b *Builder) RunJob(req *rmake.BuilderRequest) {
 	}
 	slog.Info(resp.Stdout)
 	b.SendToManager(resp)
-
-	if req.ResultAddress == "" {
-		slog.Info("Im the final node! no need to send.")
-		b.localfiles <- []string{req.Session, req.BuildJob.Output}
+	if !resp.Success {
 		return
 	}
-
-	var outEnc *gob.Encoder
-	if req.ResultAddress == "manager" {
-		//Send to manager
-		outEnc = nil
-		fmt.Println("Sending back to manager!")
-	} else {
-		//Send to other builder
-		fmt.Printf("Sending output to: %s\n", req.ResultAddress)
-		send, err := net.Dial("tcp", req.ResultAddress)
-		if err != nil {
-			slog.Error(err)
-			slog.Error("Given incorrection information by manager.")
-			//TODO: decide what to do if this happens
-			slog.Error("ERROR: this is pretty bad... what do?")
+	//Later jobs of the build on this builder can use the outputs
+	for _, o := range req.BuildJob.OutputFiles() {
+		select {
+		case b.localfiles <- fileKey{req.Session, req.Build, o}:
+		case <-b.stopped:
+			return
 		}
-		outEnc = gob.NewEncoder(send)
 	}
 
-	fipath := path.Join("builds", req.Session)
-	slog.Infof("Loading %s to send on.\n", req.BuildJob.Output)
-	fi, err := rmake.LoadFile(fipath, req.BuildJob.Output)
-	if err != nil {
-		slog.Error("Failed to load output file!")
+	//Files the client asked for go back through the manager
+	ret := req.Return
+	if req.ResultAddress == "manager" && len(ret) == 0 {
+		ret = req.BuildJob.OutputFiles()
 	}
-
-	if outEnc == nil {
+	if len(ret) > 0 {
+		fmt.Println("Sending back to manager!")
 		results := new(rmake.BuilderResult)
-		if fi != nil {
+		for _, o := range ret {
+			fi, err := rmake.LoadFile(sdir, o)
+			if err != nil {
+				slog.Errorf("Failed to load output file '%s'!", o)
+				continue
+			}
+			fi.Compress(b.managerCompression())
 			results.Results = append(results.Results, fi)
 		}
 		results.Session = req.Session
+		results.Build = req.Build
+		results.Output = req.BuildJob.Output
 		b.SendToManager(results)
-	} else {
-		rfi := new(rmake.RequiredFileMessage)
-		rfi.Session = req.Session
-		rfi.Payload = fi
-		i := interface{}(rfi)
-		err := outEnc.Encode(&i)
-		if err != nil {
-			slog.Error(err)
-		}
+	}
+
+	switch req.ResultAddress {
+	case "manager", "":
+		slog.Info("Keeping outputs until they are needed.")
+	default:
+		fmt.Printf("Sending output to: %s\n", req.ResultAddress)
+		b.ForwardFiles(&rmake.FileForwardMessage{
+			Session: req.Session,
+			Build:   req.Build,
+			Files:   req.BuildJob.OutputFiles(),
+			Address: req.ResultAddress,
+		})
 	}
 
 	slog.Infof("Job for session '%s' finished.\n", req.Session)
@@ -294,12 +426,16 @@ func (b *Builder) Run() {
 
 	slog.Info("Shutting down builder.")
 	b.Running = false
-	close(b.outgoing)
-	close(b.incoming)
-	close(b.reqfilewait)
-	b.RequestQueue.Close()
+	//Every routine returns once it sees this, the channels between
+	//them are left open so nobody sends on a closed one
+	close(b.stopped)
+	if left := b.RequestQueue.Close(); len(left) > 0 {
+		slog.Infof("Dropped %d queued jobs.", len(left))
+	}
 	b.list.Close()
+	b.connLock.Lock()
 	b.manager.Close()
+	b.connLock.Unlock()
 }
 
 func (b *Builder) Stop() {
@@ -310,19 +446,29 @@ func (b *Builder) Stop() {
 func (b *Builder) ManagerListener() {
 	for {
 		mes, err := b.ReceiveFromManager()
+		if b.isStopped() {
+			//Run closed the connection
+			return
+		}
 		if err != nil {
-			if err.Error() == "EOF" {
-				slog.Warn("Connection to manager closed. Attemping reconnect in 5 seconds.")
-				time.Sleep(time.Second * 5)
-				con, err := net.Dial("tcp", b.ManagerAddr)
+			//The manager drops builders that miss heartbeats, or the
+			//sender may have closed the connection after a failed write
+			if _, neterr := err.(net.Error); err == io.EOF || neterr {
+				slog.Warnf("Connection to manager closed. Attemping reconnect in %s.", reconnectDelay)
+				select {
+				case <-time.After(reconnectDelay):
+				case <-b.stopped:
+					return
+				}
+				err := b.Reconnect()
 				if err != nil {
 					slog.Errorf("Reconnect failed: %s", err)
 					os.Exit(1)
 				}
-				b.manager = con
-				b.dec = gob.NewDecoder(con)
-				b.enc = gob.NewEncoder(con)
-				b.DoHandshake()
+				if pending := b.Blobs.Pending(); len(pending) > 0 {
+					slog.Infof("Requesting %d inputs again.", len(pending))
+					b.SendToManager(&rmake.BlobRequest{Hashes: pending})
+				}
 				continue
 			} else {
 				slog.Critical(err)
@@ -330,19 +476,58 @@ func (b *Builder) ManagerListener() {
 				return
 			}
 		}
-		b.incoming <- mes
+		select {
+		case b.incoming <- mes:
+		case <-b.stopped:
+			return
+		}
+	}
+}
+
+//Whether the builder is shutting down
+func (b *Builder) isStopped() bool {
+	select {
+	case <-b.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+//Open a new connection to the manager and shake hands again
+//Nothing else is sent to the manager until the handshake is done.
+func (b *Builder) Reconnect() error {
+	con, err := net.Dial("tcp", b.ManagerAddr)
+	if err != nil {
+		return err
 	}
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	b.manager.Close()
+	b.manager = con
+	b.dec = gob.NewDecoder(con)
+	b.enc = gob.NewEncoder(con)
+	return b.handshakeUnsafe()
 }
 
 //Synchronize sending messages to manager
 func (b *Builder) ManagerSender() {
 	for {
-		mes := <-b.outgoing
+		var mes interface{}
+		select {
+		case mes = <-b.outgoing:
+		case <-b.stopped:
+			return
+		}
+		b.connLock.Lock()
 		err := b.enc.Encode(&mes)
 		if err != nil {
-			slog.Critical(err)
-			panic("Error!")
+			//The listener reconnects once it notices the connection
+			//is gone
+			slog.Errorf("Failed to send %s to manager: %s", reflect.TypeOf(mes), err)
+			b.manager.Close()
 		}
+		b.connLock.Unlock()
 	}
 }
 
@@ -351,31 +536,153 @@ func (b *Builder) ManagerSender() {
 //asynchronously
 func (b *Builder) HandleMessages() {
 	for {
-		m := <-b.incoming
+		var m interface{}
+		select {
+		case m = <-b.incoming:
+		case <-b.stopped:
+			return
+		}
 		switch message := m.(type) {
 		case *rmake.RequiredFileMessage:
 			slog.Info("Received required file.")
 			//Get a file from another node
-			b.newfiles <- message
+			select {
+			case b.newfiles <- message:
+			case <-b.stopped:
+				return
+			}
 
 		case *rmake.BuilderRequest:
 			slog.Info("Received builder request.")
-			b.RequestQueue.Push(message)
+			b.RequestInputs(message)
+			go b.QueueWhenReady(message)
+
+		case *rmake.FileForwardMessage:
+			go b.ForwardFiles(message)
+
+		case *rmake.Ping:
+			b.SendToManager(message)
+
+		case *rmake.BuildCancelMessage:
+			slog.Infof("Cancelling build %d of session '%s'", message.Build, message.Session)
+			b.builds.Cancel(message.Session, message.Build)
+			dropped := b.RequestQueue.RemoveBuild(message.Session, message.Build)
+			if len(dropped) > 0 {
+				slog.Infof("Dropped %d queued jobs of the build.", len(dropped))
+			}
+			if message.Clean {
+				//The cancellation stays known, so jobs still on
+				//their way don't recreate the directory
+				go b.removeSession(message.Session)
+			}
+
+		case *rmake.BlobData:
+			slog.Infof("Received %d blobs.", len(message.Blobs))
+			for _, bl := range message.Blobs {
+				err := b.Blobs.Put(bl)
+				if err != nil {
+					slog.Error(err)
+				}
+			}
+			for _, h := range message.Missing {
+				slog.Errorf("The manager doesn't have blob %s.", h)
+				b.Blobs.Fail(h)
+			}
 
 		case *rmake.BuilderResult:
 			slog.Info("Received builder result.")
 			b.HandleBuilderResult(message)
 
+		case *rmake.SessionReleaseMessage:
+			slog.Infof("Releasing session '%s'", message.Session)
+			b.ReleaseSession(message.Session)
+
 		default:
 			slog.Warnf("Received invalid message type. '%s'", reflect.TypeOf(message))
 		}
 	}
 }
 
+//Ask the manager for the contents of a request's inputs we don't have
+//so they are on their way while the job sits in the queue
+func (b *Builder) RequestInputs(req *rmake.BuilderRequest) {
+	var hashes []string
+	for _, e := range req.Input {
+		hashes = append(hashes, e.Hash)
+	}
+	missing := b.Blobs.Missing(hashes)
+	if len(missing) > 0 {
+		slog.Infof("Requesting %d of %d inputs.", len(missing), len(hashes))
+		b.SendToManager(&rmake.BlobRequest{Hashes: missing})
+	}
+}
+
+//Queue a request once all of its inputs are here
+//Requests wait outside of the queue so that the threads running jobs
+//are never stuck waiting on files.
+func (b *Builder) QueueWhenReady(req *rmake.BuilderRequest) {
+	cancel := b.builds.Done(req.Session, req.Build)
+	for _, e := range req.Input {
+		select {
+		case <-b.Blobs.Wait(e.Hash):
+		case <-cancel:
+			return
+		}
+		if !b.Blobs.Has(e.Hash) {
+			//The build fails instead of waiting forever
+			b.SendToManager(&rmake.JobFinishedMessage{
+				Session: req.Session,
+				Build:   req.Build,
+				Output:  req.BuildJob.Output,
+				Error:   fmt.Sprintf("The manager no longer has the contents of '%s'", e.Path),
+			})
+			return
+		}
+	}
+	for _, w := range req.Wait {
+		select {
+		case f := <-b.WaitForFile(req.Session, req.Build, w):
+			if f == nil {
+				slog.Infof("'%s' was made here.", w)
+			} else {
+				slog.Infof("Got file we were waiting for: '%s'", f.Path)
+			}
+		case <-cancel:
+			return
+		}
+	}
+	err := b.RequestQueue.Push(req, cancel)
+	if err == ErrPushAborted {
+		slog.Infof("Dropping job for '%s' of cancelled build.", req.BuildJob.Output)
+	} else if err != nil {
+		slog.Error(err)
+	}
+}
+
+//Send outputs of a build to the builder that needs them
+func (b *Builder) ForwardFiles(m *rmake.FileForwardMessage) {
+	sdir := path.Join("builds", m.Session)
+	for _, f := range m.Files {
+		slog.Infof("Sending '%s' to %s", f, m.Address)
+		fi, err := rmake.LoadFile(sdir, f)
+		if err != nil {
+			slog.Errorf("Failed to load output file '%s'!", f)
+			continue
+		}
+		err = b.SendFile(m.Address, m.Session, m.Build, fi)
+		if err != nil {
+			slog.Error(err)
+		}
+	}
+}
+
 func (b *Builder) HandleBuilderResult(m *rmake.BuilderResult) {
 	sdir := path.Join("builds", m.Session)
 	for _, f := range m.Results {
-		err := f.Save(sdir)
+		err := f.Decompress()
+		if err == nil {
+			err = f.Save(sdir)
+		}
 		if err != nil {
 			slog.Error("Error saving file!")
 			slog.Error(err)
@@ -389,7 +696,7 @@ func (b *Builder) SocketListener() {
 		con, err := b.list.Accept()
 		if err != nil {
 			slog.Error(err)
-			if b.Running {
+			if !b.isStopped() {
 				//Diagnose?
 				slog.Criticalf("Listener Error: %s", err)
 				b.Stop()
@@ -404,14 +711,25 @@ func (b *Builder) SocketListener() {
 }
 
 // Send a message to the manager
+//Messages sent while shutting down are dropped.
 func (b *Builder) SendToManager(i interface{}) {
-	b.outgoing <- i
+	select {
+	case b.outgoing <- i:
+	case <-b.stopped:
+	}
 }
 
 // Read a message from the manager
 func (b *Builder) ReceiveFromManager() (interface{}, error) {
+	b.connLock.Lock()
+	dec := b.dec
+	b.connLock.Unlock()
+	return receiveFrom(dec)
+}
+
+func receiveFrom(dec *gob.Decoder) (interface{}, error) {
 	var i interface{}
-	err := b.dec.Decode(&i)
+	err := dec.Decode(&i)
 	slog.Info("Received from manager.")
 	if err != nil {
 		return nil, err
@@ -429,13 +747,16 @@ func (b *Builder) HandleMessage(i interface{}) {
 
 	case *rmake.BuilderRequest:
 		slog.Info("Received builder request.")
-		b.RequestQueue.Push(message)
+		go b.QueueWhenReady(message)
 
 	case *rmake.BuilderResult:
 		slog.Info("Received builder result.")
 		sdir := path.Join("builds", message.Session)
 		for _, f := range message.Results {
-			err := f.Save(sdir)
+			err := f.Decompress()
+			if err == nil {
+				err = f.Save(sdir)
+			}
 			if err != nil {
 				slog.Error("Error saving file!")
 				slog.Error(err)
@@ -447,11 +768,101 @@ func (b *Builder) HandleMessage(i interface{}) {
 	}
 }
 
+//Send a job's output to the builder that needs it
+//The file is offered by digest first, and only sent if the other
+//builder doesn't already have the contents.
+func (b *Builder) SendFile(addr, session string, build int, fi *rmake.File) error {
+	con, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+	enc := gob.NewEncoder(con)
+	dec := gob.NewDecoder(con)
+
+	offer := new(rmake.FileOffer)
+	offer.Entry = fi.Entry()
+	offer.Session = session
+	offer.Build = build
+	offer.Compression = rmake.NewCompressionOffer(b.Compression)
+	var i interface{}
+	i = offer
+	err = enc.Encode(&i)
+	if err != nil {
+		return err
+	}
+
+	err = dec.Decode(&i)
+	if err != nil {
+		return err
+	}
+	req, ok := i.(*rmake.BlobRequest)
+	if !ok {
+		return fmt.Errorf("Expected blob request, got %s", reflect.TypeOf(i))
+	}
+	if len(req.Hashes) == 0 {
+		slog.Infof("'%s' already has '%s'", addr, fi.Path)
+		return nil
+	}
+	blob := rmake.NewBlob(fi.Contents)
+	blob.Compress(req.Compression)
+	i = &rmake.BlobData{Blobs: []*rmake.Blob{blob}}
+	return enc.Encode(&i)
+}
+
+//Receive a file offered by another builder
+func (b *Builder) HandleFileOffer(offer *rmake.FileOffer, enc *gob.Encoder, dec *gob.Decoder) error {
+	if offer.Entry == nil || !rmake.ValidHash(offer.Entry.Hash) {
+		return errors.New("Received bad file offer.")
+	}
+	req := new(rmake.BlobRequest)
+	if !b.Blobs.Has(offer.Entry.Hash) {
+		req.Hashes = []string{offer.Entry.Hash}
+		req.Compression = offer.Compression.Negotiate(b.Compression)
+	}
+	var i interface{}
+	i = req
+	err := enc.Encode(&i)
+	if err != nil {
+		return err
+	}
+
+	if len(req.Hashes) > 0 {
+		err := dec.Decode(&i)
+		if err != nil {
+			return err
+		}
+		data, ok := i.(*rmake.BlobData)
+		if !ok || len(data.Blobs) != 1 {
+			return fmt.Errorf("Expected blob data, got %s", reflect.TypeOf(i))
+		}
+		err = b.Blobs.Put(data.Blobs[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	fi, err := b.Blobs.File(offer.Entry)
+	if err != nil {
+		return err
+	}
+	rfi := new(rmake.RequiredFileMessage)
+	rfi.Session = offer.Session
+	rfi.Build = offer.Build
+	rfi.Payload = fi
+	select {
+	case b.newfiles <- rfi:
+	case <-b.stopped:
+	}
+	return nil
+}
+
 // Handles a connection from the listener
 // This could come from another builder.
 // Possibly from the manager too, but most likely another builder.
 func (b *Builder) HandleConnection(con net.Conn) {
 	slog.Infof("Handling new connection from %s", con.RemoteAddr().String())
+	defer con.Close()
 	dec := gob.NewDecoder(con)
 	var i interface{}
 	err := dec.Decode(&i)
@@ -460,33 +871,67 @@ func (b *Builder) HandleConnection(con net.Conn) {
 		return
 	}
 
+	if offer, ok := i.(*rmake.FileOffer); ok {
+		err := b.HandleFileOffer(offer, gob.NewEncoder(con), dec)
+		if err != nil {
+			slog.Error(err)
+		}
+		return
+	}
+
 	// We'll only handle one message ber connection
-	b.incoming <- i
-	con.Close()
+	select {
+	case b.incoming <- i:
+	case <-b.stopped:
+	}
 }
 
 func (b *Builder) SendStatusUpdate() {
 	slog.Info("Sending system load update!")
 	stat := new(rmake.BuilderStatusUpdate)
-	stat.CPULoad = GetCpuUsage()
+	stat.CPULoad = b.cpu.Sample()
+	stat.MemUse = GetMemUsage()
 	stat.QueuedJobs = b.RequestQueue.Len()
+	stat.QueueFull = b.RequestQueue.Full()
 	stat.RunningJobs = len(b.RunningJobs)
 
 	b.SendToManager(stat)
 }
 
+//Send status updates at the interval agreed on with the manager
+//The interval is read again every time, a new handshake after the
+//connection to the manager is lost may change it.
 func (b *Builder) StartPublisher() {
-	tick := time.NewTicker(b.UpdateFrequency)
 	for {
+		b.connLock.Lock()
+		freq := b.UpdateFrequency
+		b.connLock.Unlock()
+		if freq <= 0 {
+			freq = rmake.DefaultHeartbeatInterval
+		}
 		select {
-		case <-tick.C:
-			b.SendStatusUpdate()
-			//TODO: have a 'shutdown' channel
+		case <-time.After(freq):
+		case <-b.stopped:
+			return
 		}
+		b.SendStatusUpdate()
 	}
 }
 
+//The compression agreed on with the manager
+func (b *Builder) managerCompression() *rmake.Compression {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	return b.managerComp
+}
+
 func (b *Builder) DoHandshake() error {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	return b.handshakeUnsafe()
+}
+
+func (b *Builder) handshakeUnsafe() error {
 	slog.Info("Starting Handshake")
 
 	host, err := os.Hostname()
@@ -496,11 +941,15 @@ func (b *Builder) DoHandshake() error {
 	}
 
 	var i interface{}
-	i = rmake.NewBuilderAnnouncement(host, b.ListenerAddr)
+	ann := rmake.NewBuilderAnnouncement(host, b.ListenerAddr)
+	ann.Compression = rmake.NewCompressionOffer(b.Compression)
+	ann.HeartbeatInterval = b.UpdateFrequency
+	ann.Procs = b.Procs
+	i = ann
 	b.enc.Encode(&i)
 	slog.Info("Sent Announcement")
 
-	inter, err := b.ReceiveFromManager()
+	inter, err := receiveFrom(b.dec)
 	if err != nil {
 		slog.Critical(err)
 		return err
@@ -518,7 +967,11 @@ func (b *Builder) DoHandshake() error {
 
 	if ack.Success {
 		b.UUID = ack.UUID
-		slog.Infof("Handshake Complete, new UUID: %d", b.UUID)
+		b.managerComp = ack.Compression
+		if ack.HeartbeatInterval > 0 {
+			b.UpdateFrequency = ack.HeartbeatInterval
+		}
+		slog.Infof("Handshake Complete, new UUID: %d, compression %s, heartbeat every %s", b.UUID, b.managerComp, b.UpdateFrequency)
 	}
 	return nil
 }
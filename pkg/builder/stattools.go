@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,12 +20,17 @@ func getStatNums() []int {
 	sfi, err := os.Open("/proc/stat")
 	if err != nil {
 		//Who cares!
+		return nil
 	}
+	defer sfi.Close()
 	out := make([]int, 4)
 	scan := bufio.NewScanner(sfi)
 	scan.Scan()
 
 	spl := strings.Split(scan.Text(), " ")
+	if len(spl) < 6 {
+		return nil
+	}
 	n := 0
 	if spl[1] == "" {
 		n++
@@ -40,10 +46,66 @@ func GetCpuUsage() float32 {
 	polla := getStatNums()
 	time.Sleep(time.Second)
 	pollb := getStatNums()
+	return cpuUsage(polla, pollb)
+}
+
+//The CPU usage between two readings of /proc/stat
+func cpuUsage(polla, pollb []int) float32 {
+	if polla == nil || pollb == nil {
+		return 0
+	}
 	sum := 0
+	diff := make([]int, len(pollb))
 	for i, v := range polla {
-		pollb[i] -= v
-		sum += pollb[i]
+		diff[i] = pollb[i] - v
+		sum += diff[i]
+	}
+	if sum == 0 {
+		return 0
+	}
+	return float32(sum-diff[IDLE]) / float32(sum)
+}
+
+//Measures CPU usage since the last time it was asked
+//Lets status updates report the load over the whole interval since the
+//previous one, without waiting to take a second reading.
+type cpuSampler struct {
+	last []int
+	lock sync.Mutex
+}
+
+func (c *cpuSampler) Sample() float32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := getStatNums()
+	use := cpuUsage(c.last, now)
+	c.last = now
+	return use
+}
+
+//The fraction of memory in use, from /proc/meminfo
+func GetMemUsage() float32 {
+	fi, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer fi.Close()
+	var total, avail int
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		f := strings.Fields(scan.Text())
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case "MemTotal:":
+			total, _ = strconv.Atoi(f[1])
+		case "MemAvailable:":
+			avail, _ = strconv.Atoi(f[1])
+		}
+	}
+	if total == 0 {
+		return 0
 	}
-	return float32(sum-pollb[3]) / float32(sum)
+	return float32(total-avail) / float32(total)
 }
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//An entry in a clang compilation database (compile_commands.json)
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Command   string   `json:"command,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+	Output    string   `json:"output,omitempty"`
+}
+
+//Compiler flags whose argument is a path
+//They take a separate argument when not joined
+var compilerPathFlags = []string{
+	"-I", "-isystem", "-iquote", "-idirafter", "-include", "-imacros", "-o",
+	"-L", "-B", "-F", "-isysroot", "--sysroot", "-include-pch",
+}
+
+//Compiler flags that take a separate argument that isn't a path
+var compilerValueFlags = map[string]bool{
+	"-D":             true,
+	"-U":             true,
+	"-x":             true,
+	"-arch":          true,
+	"-target":        true,
+	"-Xclang":        true,
+	"-Xlinker":       true,
+	"-Xpreprocessor": true,
+	"-Xassembler":    true,
+	"-mllvm":         true,
+	"--param":        true,
+}
+
+//Load a compilation database
+func LoadCompDB(file string) ([]*CompileCommand, error) {
+	fi, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	var cmds []*CompileCommand
+	err = json.NewDecoder(fi).Decode(&cmds)
+	if err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
+
+//Convert a compilation database into jobs
+//All paths are rewritten relative to root, the directory rmake.json
+//lives in, since that is where builders will run the commands.
+func ImportCompDB(file, root string) ([]*rmake.Job, error) {
+	cmds, err := LoadCompDB(file)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*rmake.Job
+	for _, cc := range cmds {
+		j, err := cc.Job(root)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+//Make a path that was relative to dir relative to root instead
+//Paths outside of root are left absolute.
+func rootRelative(root, dir, p string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+//Convert a single compile command into a job
+func (cc *CompileCommand) Job(root string) (*rmake.Job, error) {
+	args := cc.Arguments
+	if len(args) == 0 {
+		var err error
+		args, err = SplitShellWords(cc.Command)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty command for '%s'", cc.File)
+	}
+	dir := cc.Directory
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+
+	src := rootRelative(root, dir, cc.File)
+	if filepath.IsAbs(src) {
+		return nil, fmt.Errorf("Source file '%s' is outside of '%s'", cc.File, root)
+	}
+
+	j := new(rmake.Job)
+	j.Command = args[0]
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		//Dependency files are not something builders can send back
+		if a == "-MD" || a == "-MMD" {
+			continue
+		}
+		if depFileFlags[a] {
+			i++
+			continue
+		}
+		if strings.HasPrefix(a, "-MF") || strings.HasPrefix(a, "-MT") || strings.HasPrefix(a, "-MQ") {
+			continue
+		}
+
+		if compilerValueFlags[a] && i+1 < len(args) {
+			i++
+			j.Args = append(j.Args, a, args[i])
+			continue
+		}
+		//Anything that isn't a flag is a file, usually the source
+		if !strings.HasPrefix(a, "-") {
+			j.Args = append(j.Args, rootRelative(root, dir, a))
+			continue
+		}
+		rewritten := false
+		for _, flag := range compilerPathFlags {
+			if a == flag && i+1 < len(args) {
+				i++
+				p := rootRelative(root, dir, args[i])
+				j.Args = append(j.Args, a, p)
+				if flag == "-o" {
+					j.Output = p
+				}
+				rewritten = true
+				break
+			}
+			//Only single letter flags can be joined with their path
+			if len(flag) == 2 && len(a) > 2 && strings.HasPrefix(a, flag) {
+				p := rootRelative(root, dir, a[2:])
+				j.Args = append(j.Args, flag+p)
+				if flag == "-o" {
+					j.Output = p
+				}
+				rewritten = true
+				break
+			}
+		}
+		if !rewritten {
+			j.Args = append(j.Args, a)
+		}
+	}
+
+	if j.Output == "" {
+		out := cc.Output
+		if out == "" {
+			out = strings.TrimSuffix(filepath.Base(cc.File), filepath.Ext(cc.File)) + ".o"
+		}
+		j.Output = rootRelative(root, dir, out)
+		j.Args = append(j.Args, "-o", j.Output)
+	}
+
+	headers, err := ScanHeaders(dir, args[0], args[1:])
+	if err != nil {
+		return nil, err
+	}
+	j.Deps = []string{src}
+	for _, h := range headers {
+		p := rootRelative(root, dir, h)
+		if filepath.IsAbs(p) {
+			//System headers are expected to exist on the builders
+			continue
+		}
+		j.Deps = append(j.Deps, p)
+	}
+	j.Deps = uniqueStrings(j.Deps)
+	return j, nil
+}
+
+//Whether a job compiles C++ rather than C
+func isCxxJob(j *rmake.Job) bool {
+	if strings.Contains(filepath.Base(j.Command), "++") {
+		return true
+	}
+	for _, d := range j.Deps {
+		switch filepath.Ext(d) {
+		case ".cpp", ".cc", ".cxx", ".C", ".c++":
+			return true
+		}
+	}
+	return false
+}
+
+//Synthesize a job that links the outputs of the given compile jobs
+//into output, using the compiler of the first job.
+func LinkJob(jobs []*rmake.Job, output string) *rmake.Job {
+	if len(jobs) == 0 {
+		return nil
+	}
+	link := new(rmake.Job)
+	link.Command = jobs[0].Command
+	for _, j := range jobs {
+		if isCxxJob(j) && !strings.Contains(filepath.Base(link.Command), "++") {
+			//Link with the C++ driver so the standard library comes along
+			link.Command = strings.Replace(link.Command, "clang", "clang++", 1)
+			link.Command = strings.Replace(link.Command, "gcc", "g++", 1)
+			if link.Command == "cc" {
+				link.Command = "c++"
+			}
+		}
+		link.Deps = append(link.Deps, j.Output)
+	}
+	link.Output = output
+	link.Args = append([]string{"-o", output}, link.Deps...)
+	return link
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//A project whose compile commands run in build/, the way CMake does it
+const testCompDB = `[
+{
+	"directory": "ROOT/build",
+	"file": "../src/main.c",
+	"command": "cc -I../include -include ../include/config.h -DNAME=main -x c -c ../src/main.c ../src/extra.c -MD -MF main.d -o main.o"
+},
+{
+	"directory": "ROOT/build",
+	"file": "../src/util.c",
+	"arguments": ["cc", "-iquote", "../include", "-c", "../src/util.c"]
+}
+]`
+
+var testCompDBFiles = map[string]string{
+	"include/config.h": "",
+	"include/util.h":   "",
+	"src/main.c":       "#include \"util.h\"\n",
+	"src/extra.c":      "",
+	"src/util.c":       "#include \"util.h\"\n",
+}
+
+func TestImportCompDB(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("No C compiler to scan headers with")
+	}
+	root := t.TempDir()
+	for f, cnt := range testCompDBFiles {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(cnt), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "build"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	db := filepath.Join(root, "build", "compile_commands.json")
+	cnt := []byte(strings.Replace(testCompDB, "ROOT", root, -1))
+	if err := os.WriteFile(db, cnt, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := ImportCompDB(db, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(jobs))
+	}
+
+	main := jobs[0]
+	if main.Output != "build/main.o" {
+		t.Fatalf("Expected main to output build/main.o, got %s", main.Output)
+	}
+	args := []string{"-Iinclude", "-include", "include/config.h", "-DNAME=main",
+		"-x", "c", "-c", "src/main.c", "src/extra.c", "-o", "build/main.o"}
+	if !reflect.DeepEqual(main.Args, args) {
+		t.Fatalf("Expected main's arguments to be %v, got %v", args, main.Args)
+	}
+	deps := []string{"src/main.c", "src/extra.c", "include/config.h", "include/util.h"}
+	if !sameStrings(main.Deps, deps) {
+		t.Fatalf("Expected main to depend on %v, got %v", deps, main.Deps)
+	}
+
+	util := jobs[1]
+	args = []string{"-iquote", "include", "-c", "src/util.c", "-o", "build/util.o"}
+	if !reflect.DeepEqual(util.Args, args) {
+		t.Fatalf("Expected util's arguments to be %v, got %v", args, util.Args)
+	}
+	deps = []string{"src/util.c", "include/util.h"}
+	if !sameStrings(util.Deps, deps) {
+		t.Fatalf("Expected util to depend on %v, got %v", deps, util.Deps)
+	}
+
+	link := LinkJob(jobs, "prog")
+	args = []string{"-o", "prog", "build/main.o", "build/util.o"}
+	if link.Command != "cc" || !reflect.DeepEqual(link.Args, args) {
+		t.Fatalf("Expected the link job to be cc %v, got %s %v", args, link.Command, link.Args)
+	}
+}
+
+func TestCompDBOutsideRoot(t *testing.T) {
+	cc := &CompileCommand{
+		Directory: "/somewhere/else",
+		File:      "main.c",
+		Arguments: []string{"cc", "-c", "main.c"},
+	}
+	if _, err := cc.Job(t.TempDir()); err == nil {
+		t.Fatal("Expected a source outside of the root to be rejected")
+	}
+}
+
+func TestParseDepRule(t *testing.T) {
+	rule := "main.o: ../src/main.c ../include/util.h \\\n  ../include/my\\ header.h\n" +
+		"util.o: ../src/util.c ../include/util.h\n\n"
+	deps := parseDepRule(rule)
+	exp := []string{"../src/main.c", "../include/util.h", "../include/my header.h", "../src/util.c"}
+	if !sameStrings(deps, exp) {
+		t.Fatalf("Expected %v, got %v", exp, deps)
+	}
+}
+
+//Whether two lists hold the same strings, in any order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		if seen[s] == 0 {
+			return false
+		}
+		seen[s]--
+	}
+	return true
+}
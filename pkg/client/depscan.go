@@ -0,0 +1,85 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+//Compiler flags that write dependency files or name their targets
+//They take a separate argument when not joined
+var depFileFlags = map[string]bool{
+	"-MF": true,
+	"-MT": true,
+	"-MQ": true,
+}
+
+//Run a compile command in the preprocessor's dependency mode and
+//return the files the compilation reads, as the compiler prints them.
+//The source file itself is included. Headers that do not exist yet
+//are assumed to be generated and are still reported.
+func ScanHeaders(dir, command string, args []string) ([]string, error) {
+	var scan []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-o" || depFileFlags[a]:
+			i++
+			continue
+		case a == "-c" || a == "-M" || a == "-MM" || a == "-MD" || a == "-MMD" || a == "-MG" || a == "-MP":
+			continue
+		case strings.HasPrefix(a, "-o") || strings.HasPrefix(a, "-MF") ||
+			strings.HasPrefix(a, "-MT") || strings.HasPrefix(a, "-MQ"):
+			continue
+		}
+		scan = append(scan, a)
+	}
+	scan = append(scan, "-MM", "-MG")
+
+	cmd := exec.Command(command, scan...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Dependency scan with %s failed: %s\n%s", command, err, stderr.String())
+	}
+	return parseDepRule(string(out)), nil
+}
+
+//Parse the prerequisites out of make style rules as printed by -MM
+func parseDepRule(rule string) []string {
+	rule = strings.Replace(rule, "\\\n", " ", -1)
+	var deps []string
+	for _, line := range strings.Split(rule, "\n") {
+		colon := strings.Index(line, ": ")
+		if colon < 0 {
+			//Empty lines, or a target with no prerequisites
+			continue
+		}
+		prereqs := line[colon+1:]
+		//Spaces in file names are escaped with a backslash
+		var cur strings.Builder
+		for i := 0; i < len(prereqs); i++ {
+			c := prereqs[i]
+			if c == '\\' && i+1 < len(prereqs) && prereqs[i+1] == ' ' {
+				cur.WriteByte(' ')
+				i++
+				continue
+			}
+			if c == ' ' || c == '\t' {
+				if cur.Len() > 0 {
+					deps = append(deps, cur.String())
+					cur.Reset()
+				}
+				continue
+			}
+			cur.WriteByte(c)
+		}
+		if cur.Len() > 0 {
+			deps = append(deps, cur.String())
+		}
+	}
+	return uniqueStrings(deps)
+}
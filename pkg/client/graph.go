@@ -0,0 +1,347 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//Formats a graph can be written in
+var GraphFormats = []string{"dot", "json", "mermaid"}
+
+//What to point out in a graph
+type GraphOptions struct {
+	//Files modified since the last build, and the jobs they affect
+	Changed bool
+	//The longest chain of jobs, by the time they took last build
+	Critical bool
+	//Jobs that failed in the last build
+	Failed bool
+}
+
+//A file or job in the dependency graph
+//Jobs are named after their primary output.
+type GraphNode struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	Outputs  []string `json:"outputs,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	Duration string   `json:"duration,omitempty"`
+	Changed  bool     `json:"changed,omitempty"`
+	Critical bool     `json:"critical,omitempty"`
+	Failed   bool     `json:"failed,omitempty"`
+	//Whether the file is neither tracked nor made by a job
+	Missing bool `json:"missing,omitempty"`
+}
+
+//A dependency of the job To on the file or job From
+type GraphEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Critical bool   `json:"critical,omitempty"`
+}
+
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+//Create the graph of every job and the files they use
+func (rmc *RMakeConf) Graph(opts GraphOptions) *Graph {
+	g := new(Graph)
+	byout := rmake.JobsByOutput(rmc.Jobs)
+	nodes := make(map[string]*GraphNode)
+	last := rmc.LastBuild
+
+	for _, j := range rmc.Jobs {
+		n := &GraphNode{ID: j.Output, Type: "job", Command: CommandLine(j)}
+		if len(j.Outputs) > 0 {
+			n.Outputs = j.OutputFiles()
+		}
+		if last != nil {
+			if d, ok := last.Durations[j.Output]; ok {
+				n.Duration = d.Round(time.Millisecond).String()
+			}
+			n.Failed = opts.Failed && last.HasFailed(j.Output)
+		}
+		nodes[n.ID] = n
+		g.Nodes = append(g.Nodes, n)
+	}
+
+	var files []*GraphNode
+	for _, j := range rmc.Jobs {
+		for _, d := range j.Deps {
+			from := d
+			if dj, ok := byout[d]; ok {
+				from = dj.Output
+			} else if _, ok := nodes[d]; !ok {
+				n := &GraphNode{ID: d, Type: "file", Missing: !rmc.HasFile(d)}
+				nodes[d] = n
+				files = append(files, n)
+			}
+			g.Edges = append(g.Edges, &GraphEdge{From: from, To: j.Output})
+		}
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].ID < files[b].ID })
+	g.Nodes = append(files, g.Nodes...)
+
+	if opts.Changed {
+		for _, f := range rmc.ChangedFiles() {
+			if n, ok := nodes[f]; ok {
+				n.Changed = true
+			}
+		}
+		//Everything downstream of a change gets rebuilt
+		for changed := true; changed; {
+			changed = false
+			for _, e := range g.Edges {
+				if nodes[e.From].Changed && !nodes[e.To].Changed {
+					nodes[e.To].Changed = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	if opts.Critical {
+		g.markCritical(rmc.jobWeights())
+	}
+	return g
+}
+
+//Files that were modified since they were last sent to a build
+func (rmc *RMakeConf) ChangedFiles() []string {
+	var out []string
+	for _, v := range rmc.Files {
+		inf, err := os.Stat(v.Path)
+		if err != nil || inf.ModTime().After(v.LastTime) {
+			out = append(out, v.Path)
+		}
+	}
+	return out
+}
+
+//How long each job is expected to take
+//Jobs without a recorded time get the average of the others, and when
+//nothing was recorded every job counts the same.
+func (rmc *RMakeConf) jobWeights() map[string]time.Duration {
+	w := make(map[string]time.Duration)
+	var total time.Duration
+	known := 0
+	if rmc.LastBuild != nil {
+		for _, j := range rmc.Jobs {
+			if d, ok := rmc.LastBuild.Durations[j.Output]; ok {
+				w[j.Output] = d
+				total += d
+				known++
+			}
+		}
+	}
+	avg := time.Duration(1)
+	if known > 0 {
+		avg = total / time.Duration(known)
+	}
+	for _, j := range rmc.Jobs {
+		if _, ok := w[j.Output]; !ok {
+			w[j.Output] = avg
+		}
+	}
+	return w
+}
+
+//Mark the heaviest path through the jobs
+func (g *Graph) markCritical(weights map[string]time.Duration) {
+	deps := make(map[string][]*GraphEdge)
+	for _, e := range g.Edges {
+		deps[e.To] = append(deps[e.To], e)
+	}
+	cost := make(map[string]time.Duration)
+	via := make(map[string]*GraphEdge)
+	visiting := make(map[string]bool)
+	var longest func(id string) time.Duration
+	longest = func(id string) time.Duration {
+		if c, ok := cost[id]; ok {
+			return c
+		}
+		if visiting[id] {
+			//Cycles are reported by 'rmake check'
+			return 0
+		}
+		visiting[id] = true
+		var best time.Duration
+		for _, e := range deps[id] {
+			if c := longest(e.From); via[id] == nil || c > best {
+				best = c
+				via[id] = e
+			}
+		}
+		visiting[id] = false
+		cost[id] = best + weights[id]
+		return cost[id]
+	}
+
+	var end string
+	var max time.Duration
+	for _, n := range g.Nodes {
+		if n.Type == "job" {
+			if c := longest(n.ID); end == "" || c > max {
+				end, max = n.ID, c
+			}
+		}
+	}
+	byid := make(map[string]*GraphNode)
+	for _, n := range g.Nodes {
+		byid[n.ID] = n
+	}
+	for id := end; id != ""; {
+		n := byid[id]
+		if n.Type != "job" {
+			break
+		}
+		n.Critical = true
+		e := via[id]
+		if e == nil || byid[e.From].Type != "job" {
+			break
+		}
+		e.Critical = true
+		id = e.From
+	}
+}
+
+//Write the graph in one of GraphFormats
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch format {
+	case "dot":
+		return g.WriteDot(w)
+	case "json":
+		return g.WriteJSON(w)
+	case "mermaid":
+		return g.WriteMermaid(w)
+	}
+	return fmt.Errorf("Unknown graph format '%s', use one of %s", format, strings.Join(GraphFormats, ", "))
+}
+
+func (g *Graph) WriteJSON(w io.Writer) error {
+	out, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+//Write the graph for Graphviz
+func (g *Graph) WriteDot(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph rmake {\n\trankdir=LR;\n")
+	for _, n := range g.Nodes {
+		attrs := []string{"label=" + dotQuote(n.label())}
+		if n.Type == "job" {
+			attrs = append(attrs, "shape=box")
+		} else {
+			attrs = append(attrs, "shape=note")
+		}
+		var fill string
+		switch {
+		case n.Failed:
+			fill = "#f4a6a6"
+		case n.Changed:
+			fill = "#fbe3a0"
+		case n.Missing:
+			fill = "#dddddd"
+		}
+		if fill != "" {
+			attrs = append(attrs, "style=filled", "fillcolor="+dotQuote(fill))
+		}
+		if n.Critical {
+			attrs = append(attrs, "penwidth=3", `color="#c0392b"`)
+		}
+		fmt.Fprintf(&b, "\t%s [%s];\n", dotQuote(n.ID), strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		attr := ""
+		if e.Critical {
+			attr = ` [penwidth=3, color="#c0392b"]`
+		}
+		fmt.Fprintf(&b, "\t%s -> %s%s;\n", dotQuote(e.From), dotQuote(e.To), attr)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+//Write the graph as a Mermaid flowchart
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	ids := make(map[string]string)
+	for i, n := range g.Nodes {
+		id := fmt.Sprintf("n%d", i)
+		ids[n.ID] = id
+		label := strings.Replace(n.label(), `"`, "#quot;", -1)
+		label = strings.Replace(label, "\n", "<br>", -1)
+		if n.Type == "job" {
+			fmt.Fprintf(&b, "\t%s[\"%s\"]\n", id, label)
+		} else {
+			fmt.Fprintf(&b, "\t%s([\"%s\"])\n", id, label)
+		}
+	}
+	for i, e := range g.Edges {
+		arrow := "-->"
+		if e.Critical {
+			arrow = "==>"
+		}
+		fmt.Fprintf(&b, "\t%s %s %s\n", ids[e.From], arrow, ids[e.To])
+		if e.Critical {
+			fmt.Fprintf(&b, "\tlinkStyle %d stroke:#c0392b,stroke-width:3px\n", i)
+		}
+	}
+
+	classes := []struct {
+		name, style string
+		has         func(n *GraphNode) bool
+	}{
+		{"missing", "fill:#dddddd", func(n *GraphNode) bool { return n.Missing }},
+		{"changed", "fill:#fbe3a0", func(n *GraphNode) bool { return n.Changed && !n.Failed }},
+		{"failed", "fill:#f4a6a6", func(n *GraphNode) bool { return n.Failed }},
+		{"critical", "stroke:#c0392b,stroke-width:3px", func(n *GraphNode) bool { return n.Critical }},
+	}
+	for _, c := range classes {
+		var members []string
+		for _, n := range g.Nodes {
+			if c.has(n) {
+				members = append(members, ids[n.ID])
+			}
+		}
+		if len(members) > 0 {
+			fmt.Fprintf(&b, "\tclassDef %s %s\n", c.name, c.style)
+			fmt.Fprintf(&b, "\tclass %s %s\n", strings.Join(members, ","), c.name)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (n *GraphNode) label() string {
+	label := n.ID
+	if len(n.Outputs) > 1 {
+		label = strings.Join(n.Outputs, "\n")
+	}
+	if n.Duration != "" {
+		label += "\n" + n.Duration
+	}
+	return label
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraph(t *testing.T) {
+	rmc := testConf()
+	rmc.LastBuild = NewBuildRecord()
+	rmc.LastBuild.Durations["main.o"] = time.Second
+	rmc.LastBuild.Durations["f.o"] = 3 * time.Second
+	rmc.LastBuild.Durations["prog"] = time.Second
+	rmc.LastBuild.Failed = []string{"f.o"}
+
+	g := rmc.Graph(GraphOptions{Critical: true, Failed: true})
+	if len(g.Nodes) != 5 || len(g.Edges) != 4 {
+		t.Fatalf("Expected 5 nodes and 4 edges, got %d and %d", len(g.Nodes), len(g.Edges))
+	}
+	marked := make(map[string]bool)
+	for _, n := range g.Nodes {
+		marked[n.ID] = n.Critical
+		if n.Failed != (n.ID == "f.o") {
+			t.Errorf("%s: failed is %v", n.ID, n.Failed)
+		}
+	}
+	if !marked["f.o"] || !marked["prog"] || marked["main.o"] {
+		t.Fatalf("Expected f.o -> prog to be critical, got %v", marked)
+	}
+
+	//Files that were never sent count as changed
+	g = rmc.Graph(GraphOptions{Changed: true})
+	for _, n := range g.Nodes {
+		if !n.Changed {
+			t.Errorf("Expected %s to be changed", n.ID)
+		}
+	}
+
+	for _, format := range GraphFormats {
+		buf := new(bytes.Buffer)
+		if err := g.Write(buf, format); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "main.o") {
+			t.Errorf("%s output is missing main.o:\n%s", format, buf)
+		}
+	}
+	if err := g.Write(new(bytes.Buffer), "png"); err == nil {
+		t.Fatal("Expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//The result of scanning a compile job for the headers it includes
+type HeaderScan struct {
+	//When the scan was performed
+	Scanned time.Time
+	//The command line that was scanned
+	Command string
+	//Dependencies found by the scan
+	Deps []string
+	//The ones the scan added to the job, that weren't listed already
+	Added []string `json:",omitempty"`
+}
+
+//Matches gcc, g++, cc, c++, clang and clang++, with or without a
+//target prefix or version suffix (x86_64-linux-gnu-gcc-12, clang-17)
+var compilerName = regexp.MustCompile(`^([\w.]+-)*(gcc|g\+\+|cc|c\+\+|clang|clang\+\+)(-[\d.]+)?$`)
+
+//File extensions the C preprocessor knows how to scan
+var sourceExts = map[string]bool{
+	".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".c++": true,
+	".C": true, ".m": true, ".mm": true, ".S": true,
+}
+
+//Whether a job runs a C or C++ compiler on a source file
+func IsCompileJob(j *rmake.Job) bool {
+	if !compilerName.MatchString(filepath.Base(j.Command)) {
+		return false
+	}
+	for _, a := range j.Args {
+		if !strings.HasPrefix(a, "-") && sourceExts[filepath.Ext(a)] {
+			return true
+		}
+	}
+	return false
+}
+
+func jobCommandLine(j *rmake.Job) string {
+	return strings.Join(append([]string{j.Command}, j.Args...), " ")
+}
+
+//Scan a compile job for the headers it includes
+//Headers the previous scan added are replaced in the job's Deps, and
+//any new headers that exist get tracked. Deps the user listed stay,
+//even when the source stops including them.
+func (rmc *RMakeConf) UpdateHeaderDeps(j *rmake.Job) error {
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+	ej := j.Expand(rmc.Vars)
+	found, err := ScanHeaders(".", ej.Command, ej.Args)
+	if err != nil {
+		return err
+	}
+
+	outputs := make(map[string]bool)
+	for _, oj := range rmc.Jobs {
+		for _, o := range oj.OutputFiles() {
+			outputs[o] = true
+		}
+	}
+
+	scan := new(HeaderScan)
+	scan.Scanned = time.Now()
+	scan.Command = jobCommandLine(ej)
+	for _, h := range found {
+		p := rootRelative(root, root, h)
+		if filepath.IsAbs(p) {
+			//Headers outside the project must exist on the builders
+			continue
+		}
+		if _, err := os.Stat(p); err != nil && !outputs[p] {
+			fmt.Printf("Warning: '%s' includes '%s', which does not exist and no job makes.\n", j.Output, p)
+			continue
+		}
+		scan.Deps = append(scan.Deps, p)
+	}
+
+	if rmc.HeaderDeps == nil {
+		rmc.HeaderDeps = make(map[string]*HeaderScan)
+	}
+	old := make(map[string]bool)
+	if prev, ok := rmc.HeaderDeps[j.Output]; ok {
+		for _, d := range prev.Added {
+			old[d] = true
+		}
+	}
+	listed := make(map[string]bool)
+	var deps []string
+	for _, d := range j.Deps {
+		if !old[d] {
+			deps = append(deps, d)
+			listed[d] = true
+		}
+	}
+	for _, d := range scan.Deps {
+		if !listed[d] {
+			scan.Added = append(scan.Added, d)
+		}
+	}
+	j.Deps = uniqueStrings(append(deps, scan.Deps...))
+	rmc.HeaderDeps[j.Output] = scan
+
+	for _, d := range scan.Deps {
+		if !outputs[d] && !rmc.HasFile(d) && !rmc.IsIgnored(d) {
+			rmc.AddFile(d)
+		}
+	}
+	return nil
+}
+
+//Mark deps of a job as listed by the user
+//A later scan keeps them, even if it was a scan that added them.
+func (rmc *RMakeConf) ListDeps(j *rmake.Job, deps []string) {
+	scan, ok := rmc.HeaderDeps[j.Output]
+	if !ok {
+		return
+	}
+	listed := make(map[string]bool)
+	for _, d := range deps {
+		listed[d] = true
+	}
+	var added []string
+	for _, d := range scan.Added {
+		if !listed[d] {
+			added = append(added, d)
+		}
+	}
+	scan.Added = added
+}
+
+//Whether a compile job needs its headers scanned again
+//That is the case when it was never scanned, its command changed, or
+//one of its inputs was modified since the last scan.
+func (rmc *RMakeConf) headersStale(j *rmake.Job) bool {
+	scan, ok := rmc.HeaderDeps[j.Output]
+	if !ok || scan.Command != jobCommandLine(j.Expand(rmc.Vars)) {
+		return true
+	}
+	for _, d := range j.Deps {
+		inf, err := os.Stat(d)
+		if err != nil {
+			continue
+		}
+		if inf.ModTime().After(scan.Scanned) {
+			return true
+		}
+	}
+	return false
+}
+
+//Rescan the headers of every compile job whose inputs have changed
+func (rmc *RMakeConf) RefreshHeaderDeps() {
+	for _, j := range rmc.Jobs {
+		if !IsCompileJob(j.Expand(rmc.Vars)) || !rmc.headersStale(j) {
+			continue
+		}
+		if rmc.Verbose {
+			fmt.Printf("Scanning headers for '%s'\n", j.Output)
+		}
+		err := rmc.UpdateHeaderDeps(j)
+		if err != nil {
+			fmt.Printf("Could not scan headers for '%s': %s\n", j.Output, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestUpdateHeaderDeps(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("No C compiler to scan headers with")
+	}
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	write := func(name, cnt string) {
+		if err := os.WriteFile(name, []byte(cnt), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.h", "")
+	write("b.h", "")
+	write("c.h", "")
+	write("main.c", "#include \"a.h\"\n#include \"b.h\"\n")
+
+	rmc := NewRMakeConf()
+	rmc.AddFile("main.c")
+	j := &rmake.Job{Command: "gcc", Args: []string{"-c", "main.c"}, Output: "main.o", Deps: []string{"main.c", "a.h"}}
+	rmc.Jobs = []*rmake.Job{j}
+	if !IsCompileJob(j) {
+		t.Fatal("Expected gcc -c main.c to be a compile job")
+	}
+
+	if err := rmc.UpdateHeaderDeps(j); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"main.c", "a.h", "b.h"}; !sameStrings(j.Deps, exp) {
+		t.Fatalf("Expected %v, got %v", exp, j.Deps)
+	}
+	if !rmc.HasFile("b.h") {
+		t.Fatal("Expected the scanned header b.h to be tracked")
+	}
+
+	//a.h was listed by hand, so it stays when main.c stops including it,
+	//but b.h only came from the scan and goes
+	write("main.c", "#include \"c.h\"\n")
+	if err := rmc.UpdateHeaderDeps(j); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"main.c", "a.h", "c.h"}; !sameStrings(j.Deps, exp) {
+		t.Fatalf("Expected %v, got %v", exp, j.Deps)
+	}
+
+	//Listing a scanned header by hand keeps it too
+	rmc.ListDeps(j, []string{"c.h"})
+	write("main.c", "")
+	if err := rmc.UpdateHeaderDeps(j); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"main.c", "a.h", "c.h"}; !sameStrings(j.Deps, exp) {
+		t.Fatalf("Expected %v, got %v", exp, j.Deps)
+	}
+}
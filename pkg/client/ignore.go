@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//Name of the file listing paths rmake should leave alone
+const IgnoreFile = ".rmakeignore"
+
+//Rules that apply before any .rmakeignore, hidden files were never
+//tracked and the configuration itself doesn't belong in a build
+var defaultIgnores = []string{".*", "/rmake.json"}
+
+var errIgnored = errors.New("path is ignored by " + IgnoreFile)
+var errOutsideTree = errors.New("path is outside of the project")
+
+//A single pattern from an ignore file, with the same meaning it would
+//have in a .gitignore
+type IgnoreRule struct {
+	Pattern string
+	//Whether the pattern re-includes what an earlier one excluded
+	Negate bool
+	//Whether the pattern only matches directories
+	DirOnly bool
+
+	re *regexp.Regexp
+}
+
+//Parse a line of an ignore file
+//Returns nil for blank lines and comments.
+func ParseIgnoreRule(line string) *IgnoreRule {
+	line = trimIgnoreSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	r := new(IgnoreRule)
+	r.Pattern = line
+	if line[0] == '!' {
+		r.Negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	//Patterns without a slash match at any depth, others are
+	//relative to the directory of the ignore file
+	if !strings.Contains(line, "/") {
+		expr.WriteString("(?:.*/)?")
+	}
+	line = strings.TrimPrefix(line, "/")
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/") && (i == 0 || line[i-1] == '/'):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case line[i:] == "**" && (i == 0 || line[i-1] == '/'):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := line[i+1 : i+1+end]
+			if end == 0 {
+				//A ']' right after the '[' is part of the class
+				rest := strings.IndexByte(line[i+2:], ']')
+				if rest < 0 {
+					expr.WriteString(`\[`)
+					continue
+				}
+				end = rest + 1
+				class = line[i+1 : i+1+end]
+			}
+			expr.WriteString("[")
+			if class[0] == '!' || class[0] == '^' {
+				expr.WriteString("^/")
+				class = class[1:]
+			}
+			expr.WriteString(regexp.QuoteMeta(class))
+			expr.WriteString("]")
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil
+	}
+	r.re = re
+	return r
+}
+
+//Trailing spaces are dropped unless escaped with a backslash
+func trimIgnoreSpace(line string) string {
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+//Whether the rule matches a slash separated path relative to the
+//directory of its ignore file
+func (r *IgnoreRule) Match(p string, isDir bool) bool {
+	if r.DirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(p)
+}
+
+//Read the rules of an ignore file
+func LoadIgnoreFile(file string) ([]*IgnoreRule, error) {
+	fi, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	var rules []*IgnoreRule
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		if r := ParseIgnoreRule(scan.Text()); r != nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules, scan.Err()
+}
+
+//Load the rules for the directory an ignore file is in
+//Ignore files in other directories are loaded when first needed.
+func (rmc *RMakeConf) LoadIgnores(igfile string) {
+	rules, err := LoadIgnoreFile(igfile)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if rmc.ignores == nil {
+		rmc.ignores = make(map[string][]*IgnoreRule)
+	}
+	dir := path.Clean(filepath.ToSlash(filepath.Dir(igfile)))
+	if dir == "." {
+		var defaults []*IgnoreRule
+		for _, p := range defaultIgnores {
+			defaults = append(defaults, ParseIgnoreRule(p))
+		}
+		rules = append(defaults, rules...)
+	}
+	rmc.ignores[dir] = rules
+}
+
+func (rmc *RMakeConf) ignoreRules(dir string) []*IgnoreRule {
+	if _, ok := rmc.ignores[dir]; !ok {
+		rmc.LoadIgnores(path.Join(dir, IgnoreFile))
+	}
+	return rmc.ignores[dir]
+}
+
+//Make a path slash separated and relative to the current directory
+//Returns "" for paths outside of it.
+func cleanPath(p string) string {
+	if filepath.IsAbs(p) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return ""
+		}
+		p, err = filepath.Rel(wd, p)
+		if err != nil {
+			return ""
+		}
+	}
+	p = path.Clean(filepath.ToSlash(p))
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return ""
+	}
+	return p
+}
+
+//Whether a path is excluded by the ignore files
+//A path is ignored when it, or any directory it is in, is matched by
+//the last rule that matches it. Rules in deeper directories come
+//after those above them, and nothing inside an ignored directory can
+//be included again.
+func (rmc *RMakeConf) IsIgnored(fi string) bool {
+	p := cleanPath(fi)
+	if p == "" || p == "." {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for i := 1; i <= len(parts); i++ {
+		isDir := i < len(parts)
+		if !isDir {
+			inf, err := os.Stat(p)
+			isDir = err == nil && inf.IsDir()
+		}
+		ignored := false
+		for j := 0; j < i; j++ {
+			dir := "."
+			if j > 0 {
+				dir = strings.Join(parts[:j], "/")
+			}
+			rel := strings.Join(parts[j:i], "/")
+			for _, r := range rmc.ignoreRules(dir) {
+				if r.Match(rel, isDir) {
+					ignored = !r.Negate
+				}
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	return false
+}
+
+//Walk the tree under dir, calling fn for every file that isn't ignored
+func (rmc *RMakeConf) WalkFiles(dir string, fn func(p string) error) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if cleanPath(p) != cleanPath(dir) && rmc.IsIgnored(p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(cleanPath(p))
+	})
+}
+
+//Track a file, or every file under a directory that isn't ignored
+//Files that are already tracked are skipped. Returns the paths of
+//newly tracked files.
+func (rmc *RMakeConf) AddPath(p string) ([]string, error) {
+	inf, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if cleanPath(p) == "" {
+		return nil, &os.PathError{Op: "add", Path: p, Err: errOutsideTree}
+	}
+	if rmc.IsIgnored(p) {
+		return nil, &os.PathError{Op: "add", Path: p, Err: errIgnored}
+	}
+	var added []string
+	if !inf.IsDir() {
+		p = cleanPath(p)
+		if !rmc.HasFile(p) {
+			rmc.AddFile(p)
+			added = append(added, p)
+		}
+		return added, nil
+	}
+	err = rmc.WalkFiles(p, func(f string) error {
+		if !rmc.HasFile(f) {
+			rmc.AddFile(f)
+			added = append(added, f)
+		}
+		return nil
+	})
+	return added, err
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRuleMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.o", "main.o", false, true},
+		{"*.o", "src/lib/f.o", false, true},
+		{"*.o", "main.c", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "doc/sub/a.txt", false, false},
+		{"**/gen", "a/b/gen", true, true},
+		{"**/gen", "gen", true, true},
+		{"out/**", "out/a/b.o", false, true},
+		{"out/**", "out", true, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"f?.c", "f1.c", false, true},
+		{"f[0-9].c", "f7.c", false, true},
+		{"f[!0-9].c", "f7.c", false, false},
+		{`\#tmp`, "#tmp", false, true},
+		{"!keep.o", "keep.o", false, true},
+	}
+	for _, c := range cases {
+		r := ParseIgnoreRule(c.pattern)
+		if r == nil {
+			t.Fatalf("Failed to parse '%s'", c.pattern)
+		}
+		if r.Match(c.path, c.isDir) != c.match {
+			t.Errorf("Pattern '%s' on '%s': expected match %v", c.pattern, c.path, c.match)
+		}
+	}
+	if ParseIgnoreRule("# comment") != nil || ParseIgnoreRule("   ") != nil {
+		t.Fatal("Expected comments and blank lines to be skipped")
+	}
+}
+
+func TestAddPathIgnores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmake-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	files := map[string]string{
+		IgnoreFile:          "*.o\nbuild/\n!keep.o\n",
+		"main.c":            "",
+		"main.o":            "",
+		"keep.o":            "",
+		"build/out.c":       "",
+		"src/a.c":           "",
+		"src/.hidden":       "",
+		"src/gen/x.c":       "",
+		"src/gen/x.o":       "",
+		"src/" + IgnoreFile: "gen/\n",
+	}
+	for p, c := range files {
+		os.MkdirAll(filepath.Dir(p), 0755)
+		err := ioutil.WriteFile(p, []byte(c), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rmc := NewRMakeConf()
+	added, err := rmc.AddPath(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(added)
+	got := strings.Join(added, " ")
+	expect := "keep.o main.c src/a.c"
+	if got != expect {
+		t.Fatalf("Expected '%s', got '%s'", expect, got)
+	}
+
+	_, err = rmc.AddPath("build/out.c")
+	if err == nil {
+		t.Fatal("Expected adding an ignored file to fail")
+	}
+	added, _ = rmc.AddPath("src")
+	if len(added) != 0 {
+		t.Fatalf("Expected nothing new, got %v", added)
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//Check whether a file is already being tracked
+func (rmc *RMakeConf) HasFile(path string) bool {
+	for _, fi := range rmc.Files {
+		if fi.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+//Merge jobs created by an importer into the configuration
+//A job replaces any existing job with the same output, and every
+//dependency that no job produces and isn't ignored gets tracked as a
+//source file.
+//Returns the paths of newly tracked files.
+func (rmc *RMakeConf) ImportJobs(jobs []*rmake.Job) []string {
+	byout := make(map[string]int)
+	for i, j := range rmc.Jobs {
+		byout[j.Output] = i
+	}
+	for _, j := range jobs {
+		if i, ok := byout[j.Output]; ok {
+			rmc.Jobs[i] = j
+			continue
+		}
+		byout[j.Output] = len(rmc.Jobs)
+		rmc.Jobs = append(rmc.Jobs, j)
+	}
+
+	produced := rmake.JobsByOutput(rmc.Jobs)
+	var added []string
+	for _, j := range jobs {
+		for _, dep := range j.Deps {
+			if _, ok := produced[dep]; ok {
+				continue
+			}
+			if !rmc.HasFile(dep) && !rmc.IsIgnored(dep) {
+				rmc.AddFile(dep)
+				added = append(added, dep)
+			}
+		}
+	}
+	return added
+}
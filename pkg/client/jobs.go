@@ -0,0 +1,316 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//Something wrong with the jobs of a configuration
+//Fatal problems keep a build from working at all, others may just
+//mean the configuration isn't finished yet.
+type JobProblem struct {
+	Output  string
+	Message string
+	Fatal   bool
+}
+
+func (p *JobProblem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Output, p.Message)
+}
+
+//A job's command line the way it would be typed in a shell
+func CommandLine(j *rmake.Job) string {
+	words := []string{j.Command}
+	for _, a := range j.Args {
+		words = append(words, quoteArg(a))
+	}
+	return strings.Join(words, " ")
+}
+
+//Quote an argument the way ParseCommand reads it back
+//ParseCommand keeps $(NAME) and ${NAME} inside single quotes literal, so
+//arguments using variables are left bare or double quoted.
+func quoteArg(a string) string {
+	if a == "" {
+		return "''"
+	}
+	var plain, quoted strings.Builder
+	refs := false
+	for i := 0; i < len(a); i++ {
+		if n := varRef(a[i:]); n > 0 {
+			refs = true
+			quoted.WriteString(a[i : i+n])
+			i += n - 1
+			continue
+		}
+		if strings.IndexByte("$`\"\\", a[i]) >= 0 {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteByte(a[i])
+		plain.WriteByte(a[i])
+	}
+	if !strings.ContainsAny(plain.String(), shellMeta+" \t'\"\\") {
+		return a
+	}
+	if !refs {
+		return shellQuote(a)
+	}
+	return `"` + quoted.String() + `"`
+}
+
+//The length of the variable reference s starts with, or 0
+//Escaped references, $$(NAME) and $${NAME}, count too.
+func varRef(s string) int {
+	start := 0
+	if strings.HasPrefix(s, "$$") {
+		start = 1
+	}
+	if len(s) < start+2 || s[start] != '$' || (s[start+1] != '(' && s[start+1] != '{') {
+		return 0
+	}
+	close := strings.IndexAny(s[start+2:], ")}")
+	if close < 0 {
+		return 0
+	}
+	return start + close + 3
+}
+
+//Find the job that produces a file
+func (rmc *RMakeConf) FindJob(output string) *rmake.Job {
+	for _, j := range rmc.Jobs {
+		if j.Produces(output) {
+			return j
+		}
+	}
+	return nil
+}
+
+//Jobs with a dependency on any output of j
+func (rmc *RMakeConf) Dependents(j *rmake.Job) []*rmake.Job {
+	var out []*rmake.Job
+	for _, oj := range rmc.Jobs {
+		if oj == j {
+			continue
+		}
+		for _, d := range oj.Deps {
+			if j.Produces(d) {
+				out = append(out, oj)
+				break
+			}
+		}
+	}
+	return out
+}
+
+//Track the dependencies of a job that are source files
+//Dependencies made by other jobs, or that don't exist yet, are left
+//for validation to report.
+func (rmc *RMakeConf) TrackDeps(j *rmake.Job) []string {
+	var added []string
+	for _, dep := range j.Deps {
+		if rmc.FindJob(dep) != nil || rmc.HasFile(dep) || rmc.IsIgnored(dep) {
+			continue
+		}
+		if _, err := os.Stat(dep); err != nil {
+			continue
+		}
+		rmc.AddFile(dep)
+		added = append(added, dep)
+	}
+	return added
+}
+
+//Add a new job
+func (rmc *RMakeConf) AddJob(j *rmake.Job) error {
+	if j.Command == "" || j.Output == "" {
+		return fmt.Errorf("A job needs a command and an output")
+	}
+	for _, o := range j.OutputFiles() {
+		if oj := rmc.FindJob(o); oj != nil {
+			return fmt.Errorf("'%s' is already made by the job for '%s'", o, oj.Output)
+		}
+	}
+	rmc.Jobs = append(rmc.Jobs, j)
+	rmc.TrackDeps(j)
+	return nil
+}
+
+//Remove the job that produces output
+func (rmc *RMakeConf) RemoveJob(output string) error {
+	for i, j := range rmc.Jobs {
+		if j.Produces(output) {
+			rmc.Jobs = append(rmc.Jobs[:i], rmc.Jobs[i+1:]...)
+			delete(rmc.HeaderDeps, j.Output)
+			return nil
+		}
+	}
+	return fmt.Errorf("No job makes '%s'", output)
+}
+
+//Rename one of the outputs of a job
+//Dependencies on the old name, arguments that are exactly the old
+//name, and the requested outputs are all updated.
+func (rmc *RMakeConf) RenameOutput(from, to string) error {
+	j := rmc.FindJob(from)
+	if j == nil {
+		return fmt.Errorf("No job makes '%s'", from)
+	}
+	if to == "" {
+		return fmt.Errorf("A job needs an output")
+	}
+	if oj := rmc.FindJob(to); oj != nil {
+		return fmt.Errorf("'%s' is already made by the job for '%s'", to, oj.Output)
+	}
+
+	if j.Output == from {
+		j.Output = to
+		if scan, ok := rmc.HeaderDeps[from]; ok {
+			delete(rmc.HeaderDeps, from)
+			rmc.HeaderDeps[to] = scan
+		}
+	}
+	for i, o := range j.Outputs {
+		if o == from {
+			j.Outputs[i] = to
+		}
+	}
+	for _, oj := range rmc.Jobs {
+		for i, d := range oj.Deps {
+			if d == from {
+				oj.Deps[i] = to
+			}
+		}
+		for i, a := range oj.Args {
+			if a == from {
+				oj.Args[i] = to
+			}
+		}
+	}
+	if rmc.Output == from {
+		rmc.Output = to
+	}
+	for i, o := range rmc.Outputs {
+		if o == from {
+			rmc.Outputs[i] = to
+		}
+	}
+	return nil
+}
+
+//Look for problems with the configured jobs
+func (rmc *RMakeConf) JobProblems() []*JobProblem {
+	var probs []*JobProblem
+	add := func(out string, fatal bool, format string, args ...interface{}) {
+		probs = append(probs, &JobProblem{out, fmt.Sprintf(format, args...), fatal})
+	}
+
+	byout := make(map[string]*rmake.Job)
+	for _, j := range rmc.Jobs {
+		if j.Output == "" {
+			add("(no output)", true, "job '%s' has no output", CommandLine(j))
+			continue
+		}
+		if j.Command == "" {
+			add(j.Output, true, "job has no command")
+		}
+		for _, o := range j.OutputFiles() {
+			if prev, ok := byout[o]; ok {
+				add(o, true, "made by both the job for '%s' and the job for '%s'", prev.Output, j.Output)
+				continue
+			}
+			byout[o] = j
+			if rmc.HasFile(o) {
+				add(o, false, "is tracked as a source file but also made by a job")
+			}
+		}
+	}
+
+	for _, j := range rmc.Jobs {
+		for _, d := range j.Deps {
+			if _, ok := byout[d]; ok || rmc.HasFile(d) {
+				continue
+			}
+			add(j.Output, false, "depends on '%s', which is neither tracked nor made by a job", d)
+		}
+	}
+
+	//Dependencies nothing makes are reported above, here they can be
+	//taken as files to find the problems between jobs
+	files := make(map[string]bool)
+	for _, j := range rmc.Jobs {
+		for _, d := range j.Deps {
+			if _, ok := byout[d]; !ok {
+				files[d] = true
+			}
+		}
+	}
+	cyclic := false
+	g := rmake.NewDepGraph(rmc.Jobs, files)
+	for _, j := range rmc.Jobs {
+		if _, err := g.Resolve(j.Output); err != nil {
+			if c, ok := err.(*rmake.CycleError); ok {
+				add(c.Cycle[0], true, "dependency cycle %s", strings.Join(c.Cycle, " -> "))
+				cyclic = true
+				break
+			}
+		}
+	}
+
+	//Only jobs needed for the requested outputs are run
+	if !cyclic && rmc.Output != "" {
+		g = rmake.NewDepGraph(rmc.Jobs, files)
+		for _, j := range rmc.Jobs {
+			if rmc.wanted(j) {
+				g.Resolve(j.Output)
+			}
+		}
+		for _, j := range g.Unused() {
+			if j.Output == "" {
+				continue
+			}
+			add(j.Output, false, "nothing depends on this job and it isn't a requested output, so it won't run")
+		}
+	}
+
+	if rmc.Output != "" && byout[rmc.Output] == nil {
+		add(rmc.Output, false, "is the build output, but no job makes it")
+	}
+	for _, o := range rmc.Outputs {
+		found := false
+		for out := range byout {
+			found = found || rmake.InArtifact(out, o)
+		}
+		if !found {
+			add(o, false, "is requested, but no job makes it")
+		}
+	}
+	return probs
+}
+
+//Whether the client asked for any of the outputs of a job
+func (rmc *RMakeConf) wanted(j *rmake.Job) bool {
+	for _, o := range j.OutputFiles() {
+		if o == rmc.Output {
+			return true
+		}
+		for _, a := range rmc.Outputs {
+			if rmake.InArtifact(o, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Check the jobs, returning the first fatal problem
+func (rmc *RMakeConf) Validate() error {
+	for _, p := range rmc.JobProblems() {
+		if p.Fatal {
+			return p
+		}
+	}
+	return nil
+}
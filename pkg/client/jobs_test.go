@@ -0,0 +1,103 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func testConf() *RMakeConf {
+	rmc := NewRMakeConf()
+	rmc.AddFile("main.c")
+	rmc.AddFile("f.c")
+	rmc.Jobs = []*rmake.Job{
+		{Command: "gcc", Args: []string{"-c", "main.c"}, Output: "main.o", Deps: []string{"main.c"}},
+		{Command: "gcc", Args: []string{"-c", "f.c"}, Output: "f.o", Deps: []string{"f.c"}},
+		{Command: "gcc", Args: []string{"-o", "prog", "main.o", "f.o"}, Output: "prog", Deps: []string{"main.o", "f.o"}},
+	}
+	rmc.Output = "prog"
+	return rmc
+}
+
+func TestJobProblems(t *testing.T) {
+	rmc := testConf()
+	if probs := rmc.JobProblems(); len(probs) != 0 {
+		t.Fatalf("Expected no problems, got %v", probs)
+	}
+
+	rmc.FindJob("main.o").Deps = append(rmc.FindJob("main.o").Deps, "prog")
+	err := rmc.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("Expected a dependency cycle, got %v", err)
+	}
+
+	rmc = testConf()
+	err = rmc.AddJob(&rmake.Job{Command: "cp", Output: "f.o"})
+	if err == nil {
+		t.Fatal("Expected adding a second job for f.o to fail")
+	}
+	rmc.RemoveJob("f.o")
+	probs := rmc.JobProblems()
+	if len(probs) != 1 || probs[0].Fatal {
+		t.Fatalf("Expected a warning about f.o, got %v", probs)
+	}
+
+	rmc = testConf()
+	rmc.AddJob(&rmake.Job{Command: "gcc", Args: []string{"-E", "f.c"}, Output: "f.i", Deps: []string{"f.c"}})
+	probs = rmc.JobProblems()
+	if len(probs) != 1 || probs[0].Output != "f.i" || !strings.Contains(probs[0].Message, "nothing depends") {
+		t.Fatalf("Expected a warning that f.i is unused, got %v", probs)
+	}
+	rmc.Outputs = []string{"f.i"}
+	if probs = rmc.JobProblems(); len(probs) != 0 {
+		t.Fatalf("Expected no problems once f.i is requested, got %v", probs)
+	}
+}
+
+func TestRenameOutput(t *testing.T) {
+	rmc := testConf()
+	err := rmc.RenameOutput("main.o", "obj/main.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := rmc.FindJob("prog")
+	if got := strings.Join(link.Deps, " "); got != "obj/main.o f.o" {
+		t.Fatalf("Expected link deps to be renamed, got '%s'", got)
+	}
+	if got := CommandLine(link); got != "gcc -o prog obj/main.o f.o" {
+		t.Fatalf("Expected link command to be renamed, got '%s'", got)
+	}
+	if rmc.RenameOutput("f.o", "prog") == nil {
+		t.Fatal("Expected renaming onto another job's output to fail")
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	cases := []struct {
+		args []string
+		line string
+	}{
+		{[]string{"$(CFLAGS)", "-c", "a.c", "-o", "a.o"}, "gcc $(CFLAGS) -c a.c -o a.o"},
+		{[]string{"-DDIR=${PREFIX}/share", "a.c"}, "gcc -DDIR=${PREFIX}/share a.c"},
+		{[]string{"-DNAME=\"$(NAME) x\"", "$HOME"}, `gcc "-DNAME=\"$(NAME) x\"" '$HOME'`},
+		{[]string{"$$(CC) $HOME", "a b", ""}, `gcc "$$(CC) \$HOME" 'a b' ''`},
+	}
+	for _, c := range cases {
+		j := &rmake.Job{Command: "gcc", Args: c.args}
+		line := CommandLine(j)
+		if line != c.line {
+			t.Errorf("Expected %q, got %q", c.line, line)
+		}
+		//The command line reads back as the same job
+		cmd, args, err := ParseCommand(line, false)
+		if err != nil {
+			t.Errorf("%s: %s", line, err)
+			continue
+		}
+		if cmd != j.Command || !reflect.DeepEqual(args, j.Args) {
+			t.Errorf("%s: read back as %q %q", line, cmd, args)
+		}
+	}
+}
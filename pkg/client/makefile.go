@@ -0,0 +1,1216 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//A single rule as written in a Makefile
+type MakeRule struct {
+	Targets   []string
+	Deps      []string
+	OrderOnly []string
+	Recipe    []string
+	//Whether one run of the recipe makes all targets, as with '&:'
+	Grouped bool
+
+	//Set for rules instantiated from a static pattern rule
+	stem string
+}
+
+//A parsed Makefile
+//Only the parts of make that map onto rmake jobs are understood:
+//variables, conditionals, includes, explicit rules, static pattern
+//rules and pattern rules. Paths are relative to the Makefile's directory.
+type Makefile struct {
+	Rules    []*MakeRule
+	Patterns []*MakeRule
+	Phony    map[string]bool
+
+	//The first target in the file, what 'make' with no arguments builds
+	Goal string
+
+	vars map[string]*makeVar
+	dir  string
+	//The files being read, to catch includes that loop
+	reading map[string]bool
+}
+
+type makeVar struct {
+	value string
+	//Simply expanded variables (:=) are expanded on assignment
+	simple bool
+}
+
+//Variables make defines before reading any Makefile
+var makeDefaults = map[string]string{
+	"CC":  "cc",
+	"CXX": "g++",
+	"AR":  "ar",
+	"RM":  "rm -f",
+}
+
+//Targets with special meaning to make, never turned into jobs
+var makeSpecialTargets = map[string]bool{
+	".PHONY":                true,
+	".SUFFIXES":             true,
+	".DEFAULT":              true,
+	".PRECIOUS":             true,
+	".INTERMEDIATE":         true,
+	".SECONDARY":            true,
+	".SECONDEXPANSION":      true,
+	".DELETE_ON_ERROR":      true,
+	".IGNORE":               true,
+	".LOW_RESOLUTION_TIME":  true,
+	".SILENT":               true,
+	".EXPORT_ALL_VARIABLES": true,
+	".NOTPARALLEL":          true,
+	".ONESHELL":             true,
+	".POSIX":                true,
+}
+
+//Conventional names of targets that never produce a file, treated as
+//phony even when the Makefile forgets to declare them
+var makeConventionalPhony = []string{"all", "clean", "distclean", "install", "uninstall"}
+
+//Read and parse the given Makefile
+func ParseMakefile(file string) (*Makefile, error) {
+	m := new(Makefile)
+	m.Phony = make(map[string]bool)
+	m.vars = make(map[string]*makeVar)
+	m.dir = filepath.Dir(file)
+	m.reading = make(map[string]bool)
+	for _, t := range makeConventionalPhony {
+		m.Phony[t] = true
+	}
+	err := m.parseFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//A level of ifeq/ifdef nesting
+type makeCond struct {
+	active bool
+	taken  bool
+	parent bool
+}
+
+func (m *Makefile) parseFile(file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if m.reading[abs] {
+		return fmt.Errorf("%s includes itself", file)
+	}
+	m.reading[abs] = true
+	defer delete(m.reading, abs)
+
+	fi, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	lines, err := readMakeLines(fi)
+	if err != nil {
+		return err
+	}
+
+	var conds []*makeCond
+	active := func() bool {
+		return len(conds) == 0 || conds[len(conds)-1].active
+	}
+
+	//The rules that recipe lines currently belong to
+	var cur []*MakeRule
+	//The variable being filled in by a define block
+	var define string
+	var defining []string
+	inDefine := false
+
+	for n, line := range lines {
+		if inDefine {
+			if strings.TrimSpace(line) == "endef" {
+				inDefine = false
+				if active() {
+					m.vars[define] = &makeVar{value: strings.Join(defining, "\n")}
+				}
+				continue
+			}
+			defining = append(defining, line)
+			continue
+		}
+
+		if strings.HasPrefix(line, "\t") && cur != nil {
+			if active() {
+				for _, r := range cur {
+					r.Recipe = append(r.Recipe, line[1:])
+				}
+			}
+			continue
+		}
+
+		line = strings.TrimSpace(stripMakeComment(line))
+		if line == "" {
+			continue
+		}
+
+		word, rest := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			word, rest = line[:i], strings.TrimSpace(line[i:])
+		}
+
+		switch word {
+		case "ifdef", "ifndef", "ifeq", "ifneq":
+			c := &makeCond{parent: active()}
+			if c.parent {
+				c.active, err = m.evalCond(word, rest)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %s", file, n+1, err)
+				}
+				c.taken = c.active
+			}
+			conds = append(conds, c)
+			cur = nil
+			continue
+		case "else":
+			if len(conds) == 0 {
+				return fmt.Errorf("%s:%d: else without if", file, n+1)
+			}
+			c := conds[len(conds)-1]
+			if rest == "" {
+				c.active = c.parent && !c.taken
+				c.taken = true
+				continue
+			}
+			spl := strings.SplitN(rest, " ", 2)
+			if len(spl) < 2 {
+				return fmt.Errorf("%s:%d: malformed else", file, n+1)
+			}
+			c.active = false
+			if c.parent && !c.taken {
+				c.active, err = m.evalCond(spl[0], strings.TrimSpace(spl[1]))
+				if err != nil {
+					return fmt.Errorf("%s:%d: %s", file, n+1, err)
+				}
+				c.taken = c.active
+			}
+			continue
+		case "endif":
+			if len(conds) == 0 {
+				return fmt.Errorf("%s:%d: endif without if", file, n+1)
+			}
+			conds = conds[:len(conds)-1]
+			continue
+		}
+
+		if !active() {
+			continue
+		}
+		cur = nil
+
+		switch word {
+		case "define":
+			define = strings.TrimSpace(strings.TrimRight(rest, "=:+?"))
+			defining = nil
+			inDefine = true
+			continue
+		case "include", "-include", "sinclude":
+			names, err := m.expand(rest, nil, 0)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", file, n+1, err)
+			}
+			for _, inc := range strings.Fields(names) {
+				err := m.parseFile(filepath.Join(m.dir, inc))
+				if err != nil && word == "include" {
+					return err
+				}
+			}
+			continue
+		case "export", "override":
+			if rest == "" {
+				continue
+			}
+			line = rest
+		case "unexport", "vpath", "undefine":
+			continue
+		}
+
+		if name, op, value, ok := splitMakeAssignment(line); ok {
+			err := m.assign(name, op, value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", file, n+1, err)
+			}
+			continue
+		}
+
+		if word == "export" {
+			//'export VAR' with no assignment
+			continue
+		}
+
+		cur, err = m.parseRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", file, n+1, err)
+		}
+	}
+
+	if len(conds) > 0 {
+		return fmt.Errorf("%s: missing endif", file)
+	}
+	return nil
+}
+
+//Split a Makefile into logical lines, joining backslash continuations
+func readMakeLines(r io.Reader) ([]string, error) {
+	var out []string
+	var buf string
+	cont := false
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		l := scan.Text()
+		if cont {
+			buf += " " + strings.TrimLeft(l, " \t")
+		} else {
+			buf = l
+		}
+		cont = strings.HasSuffix(buf, "\\") && !strings.HasSuffix(buf, "\\\\")
+		if cont {
+			buf = strings.TrimRight(buf[:len(buf)-1], " \t")
+			continue
+		}
+		out = append(out, buf)
+	}
+	if cont {
+		out = append(out, buf)
+	}
+	return out, scan.Err()
+}
+
+//Remove a trailing comment, honoring '\#' escapes
+func stripMakeComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] != '#' {
+			continue
+		}
+		if i > 0 && line[i-1] == '\\' {
+			line = line[:i-1] + line[i:]
+			i--
+			continue
+		}
+		return line[:i]
+	}
+	return line
+}
+
+//Check whether a line is a variable assignment and split it up
+func splitMakeAssignment(line string) (name, op, value string, ok bool) {
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ':':
+			if depth > 0 {
+				continue
+			}
+			if strings.HasPrefix(line[i:], "::=") {
+				op = "::="
+			} else if strings.HasPrefix(line[i:], ":=") {
+				op = ":="
+			} else {
+				//A rule
+				return "", "", "", false
+			}
+			name = line[:i]
+			value = line[i+len(op):]
+		case '=':
+			if depth > 0 {
+				continue
+			}
+			op = "="
+			name = line[:i]
+			if i > 0 && strings.ContainsRune("?+!", rune(line[i-1])) {
+				op = line[i-1 : i+1]
+				name = line[:i-1]
+			}
+			value = line[i+1:]
+		default:
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return "", "", "", false
+		}
+		return name, op, strings.TrimSpace(value), true
+	}
+	return "", "", "", false
+}
+
+//Perform a variable assignment
+func (m *Makefile) assign(name, op, value string) error {
+	prev, defined := m.vars[name]
+	switch op {
+	case "=":
+		m.vars[name] = &makeVar{value: value}
+	case ":=", "::=":
+		v, err := m.expand(value, nil, 0)
+		if err != nil {
+			return err
+		}
+		m.vars[name] = &makeVar{value: v, simple: true}
+	case "?=":
+		if !defined {
+			m.vars[name] = &makeVar{value: value}
+		}
+	case "+=":
+		if !defined {
+			m.vars[name] = &makeVar{value: value}
+			return nil
+		}
+		if prev.simple {
+			v, err := m.expand(value, nil, 0)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		if prev.value != "" {
+			value = prev.value + " " + value
+		}
+		m.vars[name] = &makeVar{value: value, simple: prev.simple}
+	case "!=":
+		cmd, err := m.expand(value, nil, 0)
+		if err != nil {
+			return err
+		}
+		out, err := m.shell(cmd)
+		if err != nil {
+			return err
+		}
+		m.vars[name] = &makeVar{value: out, simple: true}
+	}
+	return nil
+}
+
+//Evaluate the condition of an ifeq/ifneq/ifdef/ifndef directive
+func (m *Makefile) evalCond(kind, arg string) (bool, error) {
+	switch kind {
+	case "ifdef", "ifndef":
+		name, err := m.expand(arg, nil, 0)
+		if err != nil {
+			return false, err
+		}
+		v, ok := m.vars[strings.TrimSpace(name)]
+		def := ok && v.value != ""
+		return def == (kind == "ifdef"), nil
+	case "ifeq", "ifneq":
+		var a, b string
+		if strings.HasPrefix(arg, "(") && strings.HasSuffix(arg, ")") {
+			args := splitMakeArgs(arg[1:len(arg)-1], 2)
+			if len(args) != 2 {
+				return false, fmt.Errorf("Malformed condition '%s'", arg)
+			}
+			a, b = args[0], args[1]
+		} else {
+			var quoted []string
+			for len(arg) > 0 {
+				q := arg[0]
+				if q != '"' && q != '\'' {
+					return false, fmt.Errorf("Malformed condition '%s'", arg)
+				}
+				end := strings.IndexByte(arg[1:], q)
+				if end < 0 {
+					return false, fmt.Errorf("Malformed condition '%s'", arg)
+				}
+				quoted = append(quoted, arg[1:end+1])
+				arg = strings.TrimSpace(arg[end+2:])
+			}
+			if len(quoted) != 2 {
+				return false, fmt.Errorf("Malformed condition '%s'", arg)
+			}
+			a, b = quoted[0], quoted[1]
+		}
+		ea, err := m.expand(a, nil, 0)
+		if err != nil {
+			return false, err
+		}
+		eb, err := m.expand(b, nil, 0)
+		if err != nil {
+			return false, err
+		}
+		eq := strings.TrimSpace(ea) == strings.TrimSpace(eb)
+		return eq == (kind == "ifeq"), nil
+	}
+	return false, fmt.Errorf("Unknown conditional '%s'", kind)
+}
+
+//Index of the first top level occurrence of c, skipping variable references
+func indexMakeTopLevel(s string, c byte) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case c:
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+//Parse a rule line, returning the rules recipe lines should be added to
+func (m *Makefile) parseRule(line string) ([]*MakeRule, error) {
+	colon := indexMakeTopLevel(line, ':')
+	if colon < 0 {
+		return nil, fmt.Errorf("Missing separator in '%s'", line)
+	}
+	tgts, err := m.expand(line[:colon], nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	tgts = strings.TrimSpace(tgts)
+	grouped := strings.HasSuffix(tgts, "&")
+	targets := strings.Fields(strings.TrimSuffix(tgts, "&"))
+	rest := strings.TrimPrefix(line[colon+1:], ":")
+
+	var inline string
+	if semi := indexMakeTopLevel(rest, ';'); semi >= 0 {
+		inline = strings.TrimSpace(rest[semi+1:])
+		rest = rest[:semi]
+	}
+
+	//Static pattern rules look like 'targets: target-pattern: prereq-patterns'
+	var targetPattern string
+	if second := indexMakeTopLevel(rest, ':'); second >= 0 {
+		tp, err := m.expand(rest[:second], nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		targetPattern = strings.TrimSpace(tp)
+		rest = rest[second+1:]
+	}
+
+	orderOnly := ""
+	if bar := indexMakeTopLevel(rest, '|'); bar >= 0 {
+		orderOnly = rest[bar+1:]
+		rest = rest[:bar]
+	}
+	deps, err := m.expand(rest, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	order, err := m.expand(orderOnly, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*MakeRule
+	for _, t := range targets {
+		if t == ".PHONY" {
+			for _, d := range strings.Fields(deps) {
+				m.Phony[d] = true
+			}
+		}
+	}
+
+	if len(targets) > 0 && makeSpecialTargets[targets[0]] {
+		//Collect recipe lines into a rule that is thrown away
+		rules = append(rules, new(MakeRule))
+	} else if targetPattern != "" {
+		for _, t := range targets {
+			stem, ok := matchMakePattern(targetPattern, t)
+			if !ok {
+				return nil, fmt.Errorf("Target '%s' does not match pattern '%s'", t, targetPattern)
+			}
+			r := new(MakeRule)
+			r.Targets = []string{t}
+			r.Deps = substMakePattern(strings.Fields(deps), stem)
+			r.OrderOnly = substMakePattern(strings.Fields(order), stem)
+			r.stem = stem
+			m.Rules = append(m.Rules, r)
+			rules = append(rules, r)
+		}
+	} else {
+		r := new(MakeRule)
+		r.Targets = targets
+		r.Deps = strings.Fields(deps)
+		r.OrderOnly = strings.Fields(order)
+		if len(targets) > 0 && strings.Contains(targets[0], "%") {
+			//Pattern rules with several targets are always grouped
+			r.Grouped = true
+			m.Patterns = append(m.Patterns, r)
+		} else {
+			r.Grouped = grouped && len(targets) > 1
+			m.Rules = append(m.Rules, r)
+		}
+		rules = append(rules, r)
+	}
+
+	if m.Goal == "" && targetPattern == "" {
+		for _, t := range targets {
+			if !strings.HasPrefix(t, ".") && !strings.Contains(t, "%") {
+				m.Goal = t
+				break
+			}
+		}
+	}
+	if m.Goal == "" && targetPattern != "" && len(targets) > 0 {
+		m.Goal = targets[0]
+	}
+
+	if inline != "" {
+		for _, r := range rules {
+			r.Recipe = append(r.Recipe, inline)
+		}
+	}
+	return rules, nil
+}
+
+//Match a string against a make pattern containing at most one '%'
+//and return the part matched by the '%'
+func matchMakePattern(pattern, s string) (string, bool) {
+	i := strings.IndexByte(pattern, '%')
+	if i < 0 {
+		return "", pattern == s
+	}
+	pre, suf := pattern[:i], pattern[i+1:]
+	if len(s) < len(pre)+len(suf) || !strings.HasPrefix(s, pre) || !strings.HasSuffix(s, suf) {
+		return "", false
+	}
+	return s[len(pre) : len(s)-len(suf)], true
+}
+
+//Replace the '%' in each pattern with stem
+func substMakePattern(patterns []string, stem string) []string {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		out = append(out, strings.Replace(p, "%", stem, 1))
+	}
+	return out
+}
+
+//Split function arguments on top level commas
+//The last of n arguments keeps any remaining commas
+func splitMakeArgs(s string, n int) []string {
+	var args []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(s) && len(args) < n-1; i++ {
+		switch s[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, s[start:])
+}
+
+//Expand all variable and function references in s
+//auto holds automatic variables such as '@' and '<', and may be nil
+func (m *Makefile) expand(s string, auto map[string]string, depth int) (string, error) {
+	if depth > 64 {
+		return "", fmt.Errorf("Recursive variable reference in '%s'", s)
+	}
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '$' || i+1 == len(s) {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		switch open := s[i]; open {
+		case '$':
+			out.WriteByte('$')
+		case '(', '{':
+			close := byte(')')
+			if open == '{' {
+				close = '}'
+			}
+			level := 1
+			end := i + 1
+			for ; end < len(s); end++ {
+				if s[end] == open {
+					level++
+				} else if s[end] == close {
+					level--
+					if level == 0 {
+						break
+					}
+				}
+			}
+			if end == len(s) {
+				return "", fmt.Errorf("Unterminated variable reference in '%s'", s)
+			}
+			v, err := m.reference(s[i+1:end], auto, depth)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(v)
+			i = end
+		default:
+			v, err := m.lookup(string(open), auto, depth)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(v)
+		}
+	}
+	return out.String(), nil
+}
+
+//Evaluate the inside of a $(...) reference
+func (m *Makefile) reference(ref string, auto map[string]string, depth int) (string, error) {
+	if sp := strings.IndexAny(ref, " \t"); sp > 0 {
+		if fn, ok := makeFuncs[ref[:sp]]; ok {
+			return fn(m, strings.TrimLeft(ref[sp:], " \t"), auto, depth)
+		}
+	}
+
+	//Substitution references, $(VAR:.c=.o)
+	if colon := indexMakeTopLevel(ref, ':'); colon >= 0 {
+		if eq := strings.IndexByte(ref[colon:], '='); eq >= 0 {
+			name, err := m.expand(ref[:colon], auto, depth+1)
+			if err != nil {
+				return "", err
+			}
+			v, err := m.lookup(name, auto, depth)
+			if err != nil {
+				return "", err
+			}
+			from := ref[colon+1 : colon+eq]
+			to := ref[colon+eq+1:]
+			if !strings.Contains(from, "%") {
+				from = "%" + from
+				to = "%" + to
+			}
+			return patsubst(from, to, v), nil
+		}
+	}
+
+	name, err := m.expand(ref, auto, depth+1)
+	if err != nil {
+		return "", err
+	}
+	return m.lookup(name, auto, depth)
+}
+
+//Look up the value of a variable
+func (m *Makefile) lookup(name string, auto map[string]string, depth int) (string, error) {
+	if auto != nil {
+		if v, ok := auto[name]; ok {
+			return v, nil
+		}
+		//$(@D) and $(@F) style directory and file parts
+		if len(name) == 2 && (name[1] == 'D' || name[1] == 'F') {
+			if v, ok := auto[name[:1]]; ok {
+				var parts []string
+				for _, w := range strings.Fields(v) {
+					if name[1] == 'D' {
+						parts = append(parts, filepath.Dir(w))
+					} else {
+						parts = append(parts, filepath.Base(w))
+					}
+				}
+				return strings.Join(parts, " "), nil
+			}
+		}
+	}
+	if v, ok := m.vars[name]; ok {
+		if v.simple {
+			return v.value, nil
+		}
+		return m.expand(v.value, auto, depth+1)
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, nil
+	}
+	return makeDefaults[name], nil
+}
+
+//Run a shell command in the Makefile's directory, as $(shell) does
+func (m *Makefile) shell(cmd string) (string, error) {
+	c := exec.Command("sh", "-c", cmd)
+	c.Dir = m.dir
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("Shell command '%s' failed: %s", cmd, err)
+	}
+	return strings.Join(strings.Fields(string(out)), " "), nil
+}
+
+//Apply patsubst to each word of text
+func patsubst(pattern, repl, text string) string {
+	var out []string
+	for _, w := range strings.Fields(text) {
+		if stem, ok := matchMakePattern(pattern, w); ok {
+			if strings.Contains(pattern, "%") {
+				w = strings.Replace(repl, "%", stem, 1)
+			} else {
+				w = repl
+			}
+		}
+		out = append(out, w)
+	}
+	return strings.Join(out, " ")
+}
+
+type makeFunc func(m *Makefile, args string, auto map[string]string, depth int) (string, error)
+
+//The make functions we know how to evaluate
+var makeFuncs map[string]makeFunc
+
+func init() {
+	makeFuncs = map[string]makeFunc{
+		"subst": makeFuncN(3, func(m *Makefile, a []string) (string, error) {
+			return strings.Replace(a[2], a[0], a[1], -1), nil
+		}),
+		"patsubst": makeFuncN(3, func(m *Makefile, a []string) (string, error) {
+			return patsubst(strings.TrimSpace(a[0]), strings.TrimSpace(a[1]), a[2]), nil
+		}),
+		"strip": makeFuncN(1, func(m *Makefile, a []string) (string, error) {
+			return strings.Join(strings.Fields(a[0]), " "), nil
+		}),
+		"firstword": makeFuncN(1, func(m *Makefile, a []string) (string, error) {
+			f := strings.Fields(a[0])
+			if len(f) == 0 {
+				return "", nil
+			}
+			return f[0], nil
+		}),
+		"sort": makeFuncN(1, func(m *Makefile, a []string) (string, error) {
+			words := uniqueStrings(strings.Fields(a[0]))
+			sort.Strings(words)
+			return strings.Join(words, " "), nil
+		}),
+		"filter": makeFuncN(2, func(m *Makefile, a []string) (string, error) {
+			return filterWords(a[0], a[1], true), nil
+		}),
+		"filter-out": makeFuncN(2, func(m *Makefile, a []string) (string, error) {
+			return filterWords(a[0], a[1], false), nil
+		}),
+		"dir": mapWords(func(w string) string {
+			return filepath.Dir(w) + "/"
+		}),
+		"notdir": mapWords(filepath.Base),
+		"basename": mapWords(func(w string) string {
+			return strings.TrimSuffix(w, filepath.Ext(w))
+		}),
+		"suffix": mapWords(filepath.Ext),
+		"addprefix": makeFuncN(2, func(m *Makefile, a []string) (string, error) {
+			var out []string
+			for _, w := range strings.Fields(a[1]) {
+				out = append(out, a[0]+w)
+			}
+			return strings.Join(out, " "), nil
+		}),
+		"addsuffix": makeFuncN(2, func(m *Makefile, a []string) (string, error) {
+			var out []string
+			for _, w := range strings.Fields(a[1]) {
+				out = append(out, w+a[0])
+			}
+			return strings.Join(out, " "), nil
+		}),
+		"wildcard": makeFuncN(1, func(m *Makefile, a []string) (string, error) {
+			var out []string
+			for _, pat := range strings.Fields(a[0]) {
+				matches, err := filepath.Glob(filepath.Join(m.dir, pat))
+				if err != nil {
+					return "", err
+				}
+				for _, f := range matches {
+					rel, err := filepath.Rel(m.dir, f)
+					if err != nil {
+						return "", err
+					}
+					out = append(out, rel)
+				}
+			}
+			return strings.Join(out, " "), nil
+		}),
+		"shell": makeFuncN(1, func(m *Makefile, a []string) (string, error) {
+			return m.shell(a[0])
+		}),
+	}
+}
+
+//Wrap a function taking n expanded arguments
+func makeFuncN(n int, fn func(*Makefile, []string) (string, error)) makeFunc {
+	return func(m *Makefile, args string, auto map[string]string, depth int) (string, error) {
+		spl := splitMakeArgs(args, n)
+		if len(spl) != n {
+			return "", fmt.Errorf("Wrong number of arguments in '%s'", args)
+		}
+		for i, a := range spl {
+			v, err := m.expand(a, auto, depth+1)
+			if err != nil {
+				return "", err
+			}
+			spl[i] = v
+		}
+		return fn(m, spl)
+	}
+}
+
+//Wrap a function applied to each word of its single argument
+func mapWords(fn func(string) string) makeFunc {
+	return makeFuncN(1, func(m *Makefile, a []string) (string, error) {
+		var out []string
+		for _, w := range strings.Fields(a[0]) {
+			out = append(out, fn(w))
+		}
+		return strings.Join(out, " "), nil
+	})
+}
+
+//Keep (or drop) the words of text matching any of the patterns
+func filterWords(patterns, text string, keep bool) string {
+	var out []string
+	for _, w := range strings.Fields(text) {
+		match := false
+		for _, p := range strings.Fields(patterns) {
+			if _, ok := matchMakePattern(p, w); ok {
+				match = true
+				break
+			}
+		}
+		if match == keep {
+			out = append(out, w)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+//Remove duplicates while keeping the original order
+func uniqueStrings(in []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+//A target along with everything the Makefile says about it
+type makeTarget struct {
+	deps      []string
+	orderOnly []string
+	recipe    []string
+	stem      string
+	//The other targets the recipe makes, for grouped rules
+	also []string
+}
+
+//Convert the Makefile's rules into rmake jobs
+//Every non phony explicit target with a recipe becomes a job, as does
+//every target or prerequisite that a pattern rule knows how to make.
+//Paths are rewritten to be relative to root, the directory rmake.json
+//lives in, and recipes run from the Makefile's directory.
+func (m *Makefile) Jobs(root string) ([]*rmake.Job, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	builddir := rootRelative(root, dir, ".")
+	if filepath.IsAbs(builddir) {
+		return nil, fmt.Errorf("Makefile directory '%s' is outside of '%s'", m.dir, root)
+	}
+
+	targets := make(map[string]*makeTarget)
+	var order []string
+	for _, r := range m.Rules {
+		for _, t := range r.Targets {
+			mt, ok := targets[t]
+			if !ok {
+				mt = new(makeTarget)
+				targets[t] = mt
+				order = append(order, t)
+			}
+			if len(r.Recipe) > 0 {
+				//The rule with the recipe provides $<
+				mt.deps = append(append([]string{}, r.Deps...), mt.deps...)
+				mt.recipe = r.Recipe
+				mt.stem = r.stem
+				if r.Grouped {
+					mt.also = otherTargets(r.Targets, t)
+				}
+			} else {
+				mt.deps = append(mt.deps, r.Deps...)
+			}
+			mt.orderOnly = append(mt.orderOnly, r.OrderOnly...)
+		}
+	}
+
+	var jobs []*rmake.Job
+	made := make(map[string]bool)
+	var pending []string
+
+	var makeTargetJob func(name string, mt *makeTarget) error
+	makeTargetJob = func(name string, mt *makeTarget) error {
+		made[name] = true
+		for _, o := range mt.also {
+			made[o] = true
+		}
+		j, err := m.makeJob(name, mt, builddir)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, j)
+		pending = append(pending, j.Deps...)
+		return nil
+	}
+
+	for _, t := range order {
+		mt := targets[t]
+		if made[t] {
+			//Made along with another target of a grouped rule
+			continue
+		}
+		if m.Phony[t] {
+			pending = append(pending, mt.deps...)
+			pending = append(pending, mt.orderOnly...)
+			continue
+		}
+		if len(mt.recipe) == 0 {
+			pat := m.findPattern(t, targets, 0)
+			if pat == nil {
+				//Nothing to run, probably a source file with extra deps
+				continue
+			}
+			pat.deps = append(pat.deps, mt.deps...)
+			pat.orderOnly = append(pat.orderOnly, mt.orderOnly...)
+			mt = pat
+		}
+		if err := makeTargetJob(t, mt); err != nil {
+			return nil, err
+		}
+	}
+
+	//Prerequisites nobody has an explicit rule for may still be
+	//buildable with a pattern rule
+	for len(pending) > 0 {
+		d := pending[0]
+		pending = pending[1:]
+		if made[d] || m.Phony[d] {
+			continue
+		}
+		made[d] = true
+		if mt, ok := targets[d]; ok && len(mt.recipe) > 0 {
+			continue
+		}
+		pat := m.findPattern(d, targets, 0)
+		if pat == nil {
+			continue
+		}
+		if err := makeTargetJob(d, pat); err != nil {
+			return nil, err
+		}
+	}
+
+	//Prerequisites were followed relative to the Makefile, only now
+	//can they be moved
+	for _, j := range jobs {
+		j.Output = rootRelative(root, dir, j.Output)
+		if filepath.IsAbs(j.Output) {
+			return nil, fmt.Errorf("Target '%s' is outside of '%s'", j.Output, root)
+		}
+		for i, o := range j.Outputs {
+			j.Outputs[i] = rootRelative(root, dir, o)
+			if filepath.IsAbs(j.Outputs[i]) {
+				return nil, fmt.Errorf("Target '%s' is outside of '%s'", o, root)
+			}
+		}
+		var deps []string
+		for _, d := range j.Deps {
+			p := rootRelative(root, dir, d)
+			if filepath.IsAbs(p) {
+				//Toolchain files outside the project must exist on builders
+				continue
+			}
+			deps = append(deps, p)
+		}
+		j.Deps = deps
+	}
+	return jobs, nil
+}
+
+//Find a pattern rule that can build name, if any
+//A pattern rule applies when each of its prerequisites exists on
+//disk or can itself be made.
+func (m *Makefile) findPattern(name string, targets map[string]*makeTarget, depth int) *makeTarget {
+	if depth > 8 {
+		return nil
+	}
+	for _, p := range m.Patterns {
+		if len(p.Recipe) == 0 {
+			continue
+		}
+		for _, tp := range p.Targets {
+			stem, ok := matchMakePattern(tp, name)
+			if !ok {
+				continue
+			}
+			deps := substMakePattern(p.Deps, stem)
+			usable := true
+			for _, d := range deps {
+				if !m.canMake(d, targets, depth) {
+					usable = false
+					break
+				}
+			}
+			if !usable {
+				continue
+			}
+			mt := new(makeTarget)
+			mt.deps = deps
+			mt.orderOnly = substMakePattern(p.OrderOnly, stem)
+			mt.recipe = p.Recipe
+			mt.stem = stem
+			mt.also = substMakePattern(otherTargets(p.Targets, tp), stem)
+			return mt
+		}
+	}
+	return nil
+}
+
+//Whether the file exists or is the target of some rule
+func (m *Makefile) canMake(name string, targets map[string]*makeTarget, depth int) bool {
+	if _, ok := targets[name]; ok {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(m.dir, name)); err == nil {
+		return true
+	}
+	return m.findPattern(name, targets, depth+1) != nil
+}
+
+//Build the job that produces target, running its recipe in dir
+func (m *Makefile) makeJob(target string, mt *makeTarget, dir string) (*rmake.Job, error) {
+	deps := uniqueStrings(mt.deps)
+	auto := map[string]string{
+		"@": target,
+		"*": mt.stem,
+		"^": strings.Join(deps, " "),
+		"+": strings.Join(mt.deps, " "),
+		"?": strings.Join(deps, " "),
+		"|": strings.Join(uniqueStrings(mt.orderOnly), " "),
+		"<": "",
+	}
+	if len(deps) > 0 {
+		auto["<"] = deps[0]
+	}
+
+	var lines []string
+	for _, l := range mt.recipe {
+		l, err := m.expand(l, auto, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Recipe for '%s': %s", target, err)
+		}
+		l = strings.TrimLeft(strings.TrimSpace(l), "@-+")
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("Target '%s' has an empty recipe", target)
+	}
+
+	j := new(rmake.Job)
+	j.Output = target
+	j.Outputs = mt.also
+	j.Deps = uniqueStrings(append(deps, mt.orderOnly...))
+	j.Command, j.Args = recipeCommand(lines, dir)
+	return j, nil
+}
+
+//The targets of a rule other than t
+func otherTargets(targets []string, t string) []string {
+	var out []string
+	for _, o := range targets {
+		if o != t {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+//Turn recipe lines into a command and its arguments, run from dir
+//A single simple command is run directly, anything else through sh -c.
+func recipeCommand(lines []string, dir string) (string, []string) {
+	cmd := strings.Join(lines, " && ")
+	if dir != "." {
+		return "sh", []string{"-c", "cd " + shellQuote(dir) + " && " + cmd}
+	}
+	if len(lines) == 1 {
+		return shellCommand(lines[0])
+	}
+	return "sh", []string{"-c", cmd}
+}
+
+//The output rmake should request by default: the Makefile's first
+//target, or when that is phony, the first job it leads to
+func (m *Makefile) DefaultOutput(root string, jobs []*rmake.Job) string {
+	root, _ = filepath.Abs(root)
+	dir, _ := filepath.Abs(m.dir)
+	byout := make(map[string]bool)
+	for _, j := range jobs {
+		for _, o := range j.OutputFiles() {
+			byout[o] = true
+		}
+	}
+	seen := make(map[string]bool)
+	queue := []string{m.Goal}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if p := rootRelative(root, dir, t); byout[p] {
+			return p
+		}
+		for _, r := range m.Rules {
+			for _, rt := range r.Targets {
+				if rt == t {
+					queue = append(queue, r.Deps...)
+				}
+			}
+		}
+	}
+	return ""
+}
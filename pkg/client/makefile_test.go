@@ -0,0 +1,172 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMakefile = `
+CC = gcc
+CFLAGS := -O2
+ifdef DEBUG
+CFLAGS += -g
+else
+CFLAGS += -DNDEBUG
+endif
+SRCS = main.c util.c
+OBJS = $(SRCS:.c=.o)
+
+.PHONY: all clean
+all: prog
+
+prog: $(OBJS)
+	$(CC) -o $@ $^
+
+main.o: util.h
+
+%.o: %.c
+	$(CC) $(CFLAGS) -c $< -o $@
+
+parse.c parse.h &: parse.y
+	bison -d -o parse.c $<
+
+gen.h: gen.sh | tools
+	./gen.sh > $@
+	touch $@
+
+clean:
+	rm -f prog $(OBJS)
+`
+
+func TestParseMakefile(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"Makefile", "main.c", "util.c", "util.h", "gen.sh"} {
+		cnt := ""
+		if f == "Makefile" {
+			cnt = testMakefile
+		}
+		err := os.WriteFile(filepath.Join(dir, f), []byte(cnt), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mk, err := ParseMakefile(filepath.Join(dir, "Makefile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := mk.Jobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := make(map[string]string)
+	deps := make(map[string]string)
+	outs := make(map[string]string)
+	for _, j := range jobs {
+		cmds[j.Output] = j.Command + " " + strings.Join(j.Args, " ")
+		deps[j.Output] = strings.Join(j.Deps, " ")
+		outs[j.Output] = strings.Join(j.Outputs, " ")
+	}
+
+	expect := map[string]string{
+		"prog":    "gcc -o prog main.o util.o",
+		"main.o":  "gcc -O2 -DNDEBUG -c main.c -o main.o",
+		"util.o":  "gcc -O2 -DNDEBUG -c util.c -o util.o",
+		"gen.h":   "sh -c ./gen.sh > gen.h && touch gen.h",
+		"parse.c": "bison -d -o parse.c parse.y",
+	}
+	if len(cmds) != len(expect) {
+		t.Fatalf("Expected %d jobs, got %d: %v", len(expect), len(cmds), cmds)
+	}
+	for out, cmd := range expect {
+		if cmds[out] != cmd {
+			t.Fatalf("Job for %s: expected '%s', got '%s'", out, cmd, cmds[out])
+		}
+	}
+	if deps["main.o"] != "main.c util.h" {
+		t.Fatalf("Bad deps for main.o: '%s'", deps["main.o"])
+	}
+	if outs["parse.c"] != "parse.h" {
+		t.Fatalf("Expected parse.c job to also make parse.h, got '%s'", outs["parse.c"])
+	}
+	if deps["gen.h"] != "gen.sh tools" {
+		t.Fatalf("Bad deps for gen.h: '%s'", deps["gen.h"])
+	}
+	if out := mk.DefaultOutput(dir, jobs); out != "prog" {
+		t.Fatalf("Expected default output prog, got '%s'", out)
+	}
+}
+
+func TestMakefileInSubdirectory(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	files := map[string]string{
+		"main.c":   "",
+		"common.h": "",
+		"Makefile": "prog: main.o\n\tcc -o prog main.o\n\nmain.o: main.c ../common.h /usr/include/stdio.h\n\tcc -c main.c\n",
+	}
+	os.Mkdir(sub, 0777)
+	for f, cnt := range files {
+		p := filepath.Join(sub, f)
+		if f == "common.h" {
+			p = filepath.Join(root, f)
+		}
+		err := os.WriteFile(p, []byte(cnt), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mk, err := ParseMakefile(filepath.Join(sub, "Makefile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := mk.Jobs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := make(map[string]string)
+	deps := make(map[string]string)
+	for _, j := range jobs {
+		cmds[j.Output] = j.Command + " " + strings.Join(j.Args, " ")
+		deps[j.Output] = strings.Join(j.Deps, " ")
+	}
+	if cmds["sub/prog"] != "sh -c cd 'sub' && cc -o prog main.o" {
+		t.Fatalf("Expected sub/prog to be linked in sub, got '%s'", cmds["sub/prog"])
+	}
+	if deps["sub/prog"] != "sub/main.o" {
+		t.Fatalf("Bad deps for sub/prog: '%s'", deps["sub/prog"])
+	}
+	//Files outside the project are left to the builders
+	if deps["sub/main.o"] != "sub/main.c common.h" {
+		t.Fatalf("Bad deps for sub/main.o: '%s'", deps["sub/main.o"])
+	}
+	if out := mk.DefaultOutput(root, jobs); out != "sub/prog" {
+		t.Fatalf("Expected default output sub/prog, got '%s'", out)
+	}
+
+	if _, err := mk.Jobs(sub + "/nested"); err == nil {
+		t.Fatal("Expected a Makefile outside the project to be refused")
+	}
+}
+
+func TestMakefileIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Makefile":  "include common.mk\nall: prog\n",
+		"common.mk": "CC = gcc\ninclude Makefile\n",
+	}
+	for f, cnt := range files {
+		err := os.WriteFile(filepath.Join(dir, f), []byte(cnt), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := ParseMakefile(filepath.Join(dir, "Makefile"))
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Fatalf("Expected an include loop error, got %v", err)
+	}
+}
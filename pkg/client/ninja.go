@@ -0,0 +1,530 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//A rule declared in a ninja file
+//Variables are kept unexpanded, they are evaluated per build edge.
+type NinjaRule struct {
+	Name string
+	Vars map[string]string
+}
+
+//A build statement in a ninja file
+type NinjaBuild struct {
+	Outputs         []string
+	ImplicitOutputs []string
+	Rule            string
+	Inputs          []string
+	Implicit        []string
+	OrderOnly       []string
+	//Edge level variable bindings, already expanded
+	Vars map[string]string
+
+	scope *ninjaScope
+}
+
+//A parsed ninja build file, along with any files it includes
+//Paths are relative to the directory of the top level file, which is
+//also where ninja runs every command.
+type NinjaFile struct {
+	Rules    map[string]*NinjaRule
+	Builds   []*NinjaBuild
+	Defaults []string
+
+	dir string
+}
+
+//Variables visible at some point of a ninja file
+type ninjaScope struct {
+	vars   map[string]string
+	parent *ninjaScope
+}
+
+func (s *ninjaScope) lookup(name string) string {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+//Read and parse a ninja build file
+func ParseNinja(file string) (*NinjaFile, error) {
+	n := new(NinjaFile)
+	n.Rules = map[string]*NinjaRule{
+		"phony": &NinjaRule{Name: "phony"},
+	}
+	n.dir = filepath.Dir(file)
+	scope := &ninjaScope{vars: make(map[string]string)}
+	err := n.parseFile(file, scope)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+//Split a ninja file into logical lines, joining '$' continuations and
+//dropping comments
+func readNinjaLines(file string) ([]string, error) {
+	fi, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	var out []string
+	var buf string
+	cont := false
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		l := scan.Text()
+		if cont {
+			buf += strings.TrimLeft(l, " ")
+		} else {
+			if strings.HasPrefix(strings.TrimLeft(l, " "), "#") {
+				continue
+			}
+			buf = l
+		}
+		//An odd number of trailing '$' escapes the newline
+		dollars := len(buf) - len(strings.TrimRight(buf, "$"))
+		cont = dollars%2 == 1
+		if cont {
+			buf = buf[:len(buf)-1]
+			continue
+		}
+		out = append(out, buf)
+	}
+	if cont {
+		out = append(out, buf)
+	}
+	return out, scan.Err()
+}
+
+func (n *NinjaFile) parseFile(file string, scope *ninjaScope) error {
+	lines, err := readNinjaLines(file)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		//Collect the indented variable bindings following this line
+		var bindings [][2]string
+		for i+1 < len(lines) && strings.HasPrefix(lines[i+1], " ") {
+			i++
+			if strings.TrimSpace(lines[i]) == "" {
+				continue
+			}
+			k, v, ok := splitNinjaBinding(lines[i])
+			if !ok {
+				return fmt.Errorf("%s:%d: expected variable binding", file, i+1)
+			}
+			bindings = append(bindings, [2]string{k, v})
+		}
+
+		word, rest := line, ""
+		if sp := strings.IndexByte(line, ' '); sp >= 0 {
+			word, rest = line[:sp], strings.TrimSpace(line[sp:])
+		}
+
+		switch word {
+		case "rule":
+			r := &NinjaRule{Name: rest, Vars: make(map[string]string)}
+			for _, b := range bindings {
+				r.Vars[b[0]] = b[1]
+			}
+			n.Rules[rest] = r
+		case "build":
+			b, err := n.parseBuild(rest, bindings, scope)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", file, i+1, err)
+			}
+			n.Builds = append(n.Builds, b)
+		case "default":
+			toks, err := splitNinjaPaths(rest)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", file, i+1, err)
+			}
+			for _, t := range toks {
+				n.Defaults = append(n.Defaults, expandNinja(t, scope.lookup))
+			}
+		case "include", "subninja":
+			path := filepath.Join(n.dir, expandNinja(rest, scope.lookup))
+			sub := scope
+			if word == "subninja" {
+				sub = &ninjaScope{vars: make(map[string]string), parent: scope}
+			}
+			if err := n.parseFile(path, sub); err != nil {
+				return err
+			}
+		case "pool":
+			//Pools limit local parallelism, builders have their own limits
+		default:
+			k, v, ok := splitNinjaBinding(line)
+			if !ok {
+				return fmt.Errorf("%s:%d: unexpected '%s'", file, i+1, word)
+			}
+			scope.vars[k] = expandNinja(v, scope.lookup)
+		}
+	}
+	return nil
+}
+
+//Split 'name = value'
+func splitNinjaBinding(line string) (string, string, bool) {
+	eq := strings.IndexByte(line, '=')
+	if eq < 0 {
+		return "", "", false
+	}
+	k := strings.TrimSpace(line[:eq])
+	if k == "" || strings.ContainsAny(k, " $") {
+		return "", "", false
+	}
+	return k, strings.TrimLeft(line[eq+1:], " "), true
+}
+
+//Split the paths of a build or default statement, leaving escapes in
+//place. The separators ':', '|', '||' and '|@' are returned as tokens.
+func splitNinjaPaths(s string) ([]string, error) {
+	var toks []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			toks = append(toks, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '$':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("Trailing '$' in '%s'", s)
+			}
+			cur.WriteByte(c)
+			i++
+			cur.WriteByte(s[i])
+			if s[i] == '{' {
+				end := strings.IndexByte(s[i:], '}')
+				if end < 0 {
+					return nil, fmt.Errorf("Unterminated variable in '%s'", s)
+				}
+				cur.WriteString(s[i+1 : i+end+1])
+				i += end
+			}
+		case ' ':
+			flush()
+		case ':':
+			flush()
+			toks = append(toks, ":")
+		case '|':
+			flush()
+			if strings.HasPrefix(s[i:], "||") || strings.HasPrefix(s[i:], "|@") {
+				toks = append(toks, s[i:i+2])
+				i++
+			} else {
+				toks = append(toks, "|")
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return toks, nil
+}
+
+//Whether c may appear in a $name variable reference
+func isNinjaVarChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+//Evaluate escapes and variable references
+func expandNinja(s string, lookup func(string) string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '$' || i+1 == len(s) {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case '$', ' ', ':':
+			out.WriteByte(s[i])
+		case '\n':
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				out.WriteString(s[i-1:])
+				return out.String()
+			}
+			out.WriteString(lookup(s[i+1 : i+end]))
+			i += end
+		default:
+			j := i
+			for j < len(s) && isNinjaVarChar(s[j]) {
+				j++
+			}
+			out.WriteString(lookup(s[i:j]))
+			i = j - 1
+		}
+	}
+	return out.String()
+}
+
+func (n *NinjaFile) parseBuild(line string, bindings [][2]string, scope *ninjaScope) (*NinjaBuild, error) {
+	toks, err := splitNinjaPaths(line)
+	if err != nil {
+		return nil, err
+	}
+	b := new(NinjaBuild)
+	b.scope = scope
+	b.Vars = make(map[string]string)
+
+	//Edge variables see the file scope and earlier edge variables
+	lookup := func(name string) string {
+		if v, ok := b.Vars[name]; ok {
+			return v
+		}
+		return scope.lookup(name)
+	}
+	for _, kv := range bindings {
+		b.Vars[kv[0]] = expandNinja(kv[1], lookup)
+	}
+
+	//outputs [| implicit outputs] : rule inputs [| implicit] [|| order only] [|@ validations]
+	section := &b.Outputs
+	sawColon := false
+	for _, t := range toks {
+		switch t {
+		case "|":
+			if !sawColon {
+				section = &b.ImplicitOutputs
+			} else {
+				section = &b.Implicit
+			}
+			continue
+		case "||":
+			section = &b.OrderOnly
+			continue
+		case "|@":
+			//Validations don't need to run for the build to succeed
+			section = nil
+			continue
+		case ":":
+			if sawColon {
+				return nil, fmt.Errorf("Unexpected ':' in build statement")
+			}
+			sawColon = true
+			section = nil
+			continue
+		}
+		if sawColon && b.Rule == "" {
+			b.Rule = t
+			section = &b.Inputs
+			continue
+		}
+		if section != nil {
+			*section = append(*section, expandNinja(t, lookup))
+		}
+	}
+	if !sawColon || b.Rule == "" {
+		return nil, fmt.Errorf("Build statement missing rule")
+	}
+	if len(b.Outputs) == 0 {
+		return nil, fmt.Errorf("Build statement has no outputs")
+	}
+	if _, ok := n.Rules[b.Rule]; !ok {
+		return nil, fmt.Errorf("Unknown rule '%s'", b.Rule)
+	}
+	return b, nil
+}
+
+//Look up a variable as seen by the command of a build edge
+func (n *NinjaFile) edgeVar(b *NinjaBuild, name string, depth int) string {
+	switch name {
+	case "in":
+		return strings.Join(b.Inputs, " ")
+	case "in_newline":
+		return strings.Join(b.Inputs, "\n")
+	case "out":
+		return strings.Join(b.Outputs, " ")
+	}
+	if v, ok := b.Vars[name]; ok {
+		return v
+	}
+	r := n.Rules[b.Rule]
+	if v, ok := r.Vars[name]; ok && depth < 32 {
+		return expandNinja(v, func(s string) string {
+			return n.edgeVar(b, s, depth+1)
+		})
+	}
+	return b.scope.lookup(name)
+}
+
+//Resolve phony outputs to the real files they stand for
+func (n *NinjaFile) resolvePhony(paths []string) []string {
+	phony := make(map[string]*NinjaBuild)
+	for _, b := range n.Builds {
+		if b.Rule == "phony" {
+			for _, o := range b.Outputs {
+				phony[o] = b
+			}
+		}
+	}
+	var out []string
+	seen := make(map[string]bool)
+	var resolve func(p string)
+	resolve = func(p string) {
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		pb, ok := phony[p]
+		if !ok {
+			out = append(out, p)
+			return
+		}
+		//A phony edge with no inputs is an alias for a plain file
+		if len(pb.Inputs)+len(pb.Implicit)+len(pb.OrderOnly) == 0 {
+			out = append(out, p)
+			return
+		}
+		for _, in := range pb.Inputs {
+			resolve(in)
+		}
+		for _, in := range pb.Implicit {
+			resolve(in)
+		}
+		for _, in := range pb.OrderOnly {
+			resolve(in)
+		}
+	}
+	for _, p := range paths {
+		resolve(p)
+	}
+	return out
+}
+
+//Quote a string for use in sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+//Convert the ninja file's build edges into jobs
+//Commands are rewritten to run from root, the directory rmake.json
+//lives in, rather than the ninja file's directory.
+func (n *NinjaFile) Jobs(root string) ([]*rmake.Job, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(n.dir)
+	if err != nil {
+		return nil, err
+	}
+	builddir := rootRelative(root, dir, ".")
+	if filepath.IsAbs(builddir) {
+		return nil, fmt.Errorf("Ninja file directory '%s' is outside of '%s'", n.dir, root)
+	}
+	//Absolute paths into the project have to be made relative, since
+	//builders keep the project somewhere else
+	toRoot, err := filepath.Rel(dir, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*rmake.Job
+	for _, b := range n.Builds {
+		r := n.Rules[b.Rule]
+		if b.Rule == "phony" || r.Vars["generator"] != "" {
+			//Generator edges rerun cmake or meson, not part of the build
+			continue
+		}
+		cmd := n.edgeVar(b, "command", 0)
+		if cmd == "" {
+			return nil, fmt.Errorf("Rule '%s' has no command", b.Rule)
+		}
+		if rsp := n.edgeVar(b, "rspfile", 0); rsp != "" {
+			content := n.edgeVar(b, "rspfile_content", 0)
+			cmd = fmt.Sprintf("printf '%%s' %s > %s && %s", shellQuote(content), shellQuote(rsp), cmd)
+		}
+		cmd = strings.Replace(cmd, root+"/", toRoot+"/", -1)
+
+		j := new(rmake.Job)
+		outs := append(append([]string{}, b.Outputs...), b.ImplicitOutputs...)
+		for i, o := range outs {
+			p := rootRelative(root, dir, o)
+			if filepath.IsAbs(p) {
+				return nil, fmt.Errorf("Output '%s' is outside of '%s'", o, root)
+			}
+			if i == 0 {
+				j.Output = p
+			} else {
+				j.Outputs = append(j.Outputs, p)
+			}
+		}
+		if builddir == "." {
+			j.Command, j.Args = shellCommand(cmd)
+		} else {
+			j.Command = "sh"
+			j.Args = []string{"-c", "cd " + shellQuote(builddir) + " && " + cmd}
+		}
+
+		deps := append(append(append([]string{}, b.Inputs...), b.Implicit...), b.OrderOnly...)
+		for _, d := range n.resolvePhony(deps) {
+			p := rootRelative(root, dir, d)
+			if filepath.IsAbs(p) {
+				//Toolchain files outside the project must exist on builders
+				continue
+			}
+			j.Deps = append(j.Deps, p)
+		}
+		j.Deps = uniqueStrings(j.Deps)
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+//The output rmake should request by default: the first default
+//target, or the output no other job depends on
+func (n *NinjaFile) DefaultOutput(root string, jobs []*rmake.Job) string {
+	root, _ = filepath.Abs(root)
+	dir, _ := filepath.Abs(n.dir)
+	byout := make(map[string]bool)
+	used := make(map[string]bool)
+	for _, j := range jobs {
+		for _, o := range j.OutputFiles() {
+			byout[o] = true
+		}
+		for _, d := range j.Deps {
+			used[d] = true
+		}
+	}
+	for _, d := range n.resolvePhony(n.Defaults) {
+		if p := rootRelative(root, dir, d); byout[p] {
+			return p
+		}
+	}
+	for _, j := range jobs {
+		if !used[j.Output] {
+			return j.Output
+		}
+	}
+	return ""
+}
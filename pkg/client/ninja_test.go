@@ -0,0 +1,66 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testNinja = `# generated
+cflags = -O2
+rule cc
+  command = gcc $cflags $extra -c $in -o $out
+  depfile = $out.d
+rule link
+  command = gcc -o $out @$out.rsp
+  rspfile = $out.rsp
+  rspfile_content = $in
+
+build gen.h: cc gen.c
+build main.o: cc main.c | util.h || gen.h
+  extra = -DNAME=$
+ 1
+build prog: link main.o
+build all: phony prog
+default all
+`
+
+func TestParseNinja(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "build.ninja"), []byte(testNinja), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf, err := ParseNinja(filepath.Join(dir, "build.ninja"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := nf.Jobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("Expected 3 jobs, got %d", len(jobs))
+	}
+
+	main := jobs[1]
+	if main.Output != "main.o" {
+		t.Fatalf("Expected main.o, got %s", main.Output)
+	}
+	cmd := main.Command + " " + strings.Join(main.Args, " ")
+	if cmd != "gcc -O2 -DNAME=1 -c main.c -o main.o" {
+		t.Fatalf("Bad command: '%s'", cmd)
+	}
+	if strings.Join(main.Deps, " ") != "main.c util.h gen.h" {
+		t.Fatalf("Bad deps: %v", main.Deps)
+	}
+
+	link := jobs[2]
+	if link.Command != "sh" || !strings.HasPrefix(link.Args[1], "printf '%s' 'main.o' > 'prog.rsp' && gcc") {
+		t.Fatalf("Bad link command: %v", link.Args)
+	}
+	if out := nf.DefaultOutput(dir, jobs); out != "prog" {
+		t.Fatalf("Expected default output prog, got '%s'", out)
+	}
+}
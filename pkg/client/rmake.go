@@ -1,13 +1,13 @@
 package client
 
 import (
-	"bufio"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"reflect"
@@ -16,23 +16,94 @@ import (
 	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
-func NewManagerRequest(conf *RMakeConf) *rmake.BuildPackage {
+//Create a build package for the manager
+//Files modified since they were last hashed get hashed again, every
+//other file is described by the digest remembered in the configuration.
+//The new digests are returned instead of remembered, files only count as
+//unchanged once a build made from them succeeds.
+func NewManagerRequest(conf *RMakeConf) (*rmake.BuildPackage, []*rmake.FileInfo) {
 	p := new(rmake.BuildPackage)
 	p.Jobs = conf.Jobs
 	p.Arch = "Arch" //lol
 	p.OS = "Arch (the OS)"
 	p.Output = conf.Output
+	p.Outputs = conf.Outputs
+	p.Session = conf.Session
+	p.Vars = conf.Vars
+	level, err := rmake.ParseCompressionLevel(conf.Compression)
+	if err != nil {
+		fmt.Println(err)
+	}
+	p.Compression = rmake.NewCompressionOffer(level)
 
-	p.Files = make(map[string]*rmake.File)
+	var hashed []*rmake.FileInfo
 	for _, v := range conf.Files {
-		f, err := rmake.LoadFile("", v.Path)
+		inf, err := os.Stat(v.Path)
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
-		p.Files[v.Path] = f
+		e := new(rmake.ManifestEntry)
+		e.Path = v.Path
+		e.Hash = v.Hash
+		e.Mode = inf.Mode()
+		if v.Hash == "" || inf.ModTime().After(v.LastTime) {
+			f, err := rmake.LoadFile("", v.Path)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			e.Hash = rmake.Hash(f.Contents)
+			hashed = append(hashed, &rmake.FileInfo{Path: v.Path, LastTime: inf.ModTime(), Hash: e.Hash})
+		}
+		p.Manifest = append(p.Manifest, e)
+	}
+	return p, hashed
+}
+
+//Remember the digests of the files a successful build was made from
+func (rmc *RMakeConf) Remember(hashed []*rmake.FileInfo) {
+	byPath := make(map[string]*rmake.FileInfo)
+	for _, h := range hashed {
+		byPath[h.Path] = h
+	}
+	for _, v := range rmc.Files {
+		if h, ok := byPath[v.Path]; ok {
+			v.LastTime = h.LastTime
+			v.Hash = h.Hash
+		}
 	}
-	return p
+}
+
+//Answer the manager's request for the contents of our files
+func (rmc *RMakeConf) SendBlobs(enc *gob.Encoder, req *rmake.BlobRequest, p *rmake.BuildPackage) error {
+	byhash := make(map[string]string)
+	for _, e := range p.Manifest {
+		byhash[e.Hash] = e.Path
+	}
+	data := new(rmake.BlobData)
+	for _, h := range req.Hashes {
+		path, ok := byhash[h]
+		if !ok {
+			return fmt.Errorf("Manager asked for unknown blob %s", h)
+		}
+		f, err := rmake.LoadFile("", path)
+		if err != nil {
+			return err
+		}
+		b := rmake.NewBlob(f.Contents)
+		if b.Hash != h {
+			return fmt.Errorf("'%s' changed during the build", path)
+		}
+		b.Compress(req.Compression)
+		data.Blobs = append(data.Blobs, b)
+	}
+	if rmc.Verbose {
+		fmt.Printf("Sending %d of %d files, compression %s\n", len(data.Blobs), len(p.Manifest), req.Compression)
+	}
+	var i interface{}
+	i = data
+	return enc.Encode(&i)
 }
 
 //The in memory representation of the configuration file
@@ -45,13 +116,50 @@ type RMakeConf struct {
 	Vars        map[string]string
 	Verbose     bool
 	Compression string
+	//Other files or directories to bring back after a build
+	Outputs []string `json:",omitempty"`
+	//Headers found for compile jobs, by job output
+	HeaderDeps map[string]*HeaderScan `json:",omitempty"`
+	//What happened to the jobs of the last build
+	LastBuild *BuildRecord `json:",omitempty"`
+
+	//Ignore rules by the directory their file is in
+	ignores map[string][]*IgnoreRule
+}
 
-	ignore []string `json:",omitempty"`
+//The outcome of each job of a build, by job output
+type BuildRecord struct {
+	Time      time.Time
+	Success   bool
+	Failed    []string                 `json:",omitempty"`
+	Durations map[string]time.Duration `json:",omitempty"`
 }
 
-//Perform dependency analysis
-func (rmc *RMakeConf) Validate() error {
-	return nil
+func NewBuildRecord() *BuildRecord {
+	br := new(BuildRecord)
+	br.Time = time.Now()
+	br.Durations = make(map[string]time.Duration)
+	return br
+}
+
+//Remember what a status update says about a job
+func (br *BuildRecord) Update(status *rmake.BuildStatus) {
+	switch status.State {
+	case rmake.JobFailed:
+		br.Failed = append(br.Failed, status.Job)
+	case rmake.JobDone:
+		br.Durations[status.Job] = status.Duration
+	}
+}
+
+//Whether the job making output failed
+func (br *BuildRecord) HasFailed(output string) bool {
+	for _, f := range br.Failed {
+		if f == output {
+			return true
+		}
+	}
+	return false
 }
 
 //Create a new empty configuration
@@ -61,19 +169,6 @@ func NewRMakeConf() *RMakeConf {
 	return rmc
 }
 
-//Load list of files to ignore
-//Not really used yet
-func (rmc *RMakeConf) LoadIgnores(igfile string) {
-	fi, err := os.Open(igfile)
-	if err != nil {
-		return
-	}
-	scan := bufio.NewScanner(fi)
-	for scan.Scan() {
-		rmc.ignore = append(rmc.ignore, scan.Text())
-	}
-}
-
 func (rmc *RMakeConf) AddFile(path string) {
 	fi := new(rmake.FileInfo)
 	fi.Path = path
@@ -86,42 +181,18 @@ func (rmc *RMakeConf) AddFile(path string) {
 func (rmc *RMakeConf) Clean() {
 	for _, v := range rmc.Files {
 		v.LastTime = time.Now().AddDate(-20, 0, 0)
+		v.Hash = ""
 	}
 	rmc.Session = ""
 }
 
 //For use on the client to ensure a complete build
 func (rmc *RMakeConf) MakeDepTree() (*rmake.DepTreeNode, error) {
-	jobbyout := make(map[string]*rmake.Job)
-	for _,j := range rmc.Jobs {
-		jobbyout[j.Output] = j
-	}
-
-	final,ok := jobbyout[rmc.Output]
-	if !ok {
-		return nil,fmt.Errorf("Could not find job for final output.")
-	}
-	delete(jobbyout, rmc.Output)
-
 	fi := make(map[string]bool)
 	for _,f := range rmc.Files {
 		fi[f.Path] = true
 	}
-	root := new(rmake.DepTreeNode)
-	root.Result = rmc.Output
-	root.Type = rmake.TBuild
-	err := root.Build(final.Deps, jobbyout, fi)
-	if err != nil {
-		return nil, err
-	}
-
-	return root,nil
-}
-
-//TODO: as part of the 'rmakeignore' file, check whether or not
-//a given file is ignored
-func (rmc *RMakeConf) IsIgnored(fi string) bool {
-	return false
+	return rmake.MakeDepTree(rmc.Jobs, rmc.Output, fi)
 }
 
 //Print a pretty status message
@@ -162,18 +233,10 @@ func (rmc *RMakeConf) Status() error {
 	fmt.Println("\x1b[0m# Untracked files:\x1b[0m")
 	fmt.Println("\x1b[0m#   (use \"rmake add <file>...\" to include in what will be transfered)\x1b[0m")
 	fmt.Println("#")
-	filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
-		if path[0] == '.' {
-			return nil
+	rmc.WalkFiles(".", func(path string) error {
+		if !rmc.HasFile(path) {
+			fmt.Printf("#       %s\n", path)
 		}
-
-		for _, v := range rmc.Files {
-			if path == v.Path {
-				return nil
-			}
-		}
-
-		fmt.Printf("#       %s\n", path)
 		return nil
 	})
 
@@ -181,19 +244,34 @@ func (rmc *RMakeConf) Status() error {
 }
 
 // Prints a build status
-func PrintBuildStatus(status *rmake.BuildStatus) {
-	fmt.Printf("%s\n", status.Message)
-	fmt.Printf("Percent Complete: %f%%\n", status.PercentComplete)
+// Jobs being queued or started are only shown when verbose.
+func PrintBuildStatus(status *rmake.BuildStatus, verbose bool) {
+	done := status.State == rmake.JobDone || status.State == rmake.JobFailed
+	if !done && !verbose {
+		return
+	}
+	width := len(fmt.Sprint(status.TotalJobs))
+	fmt.Printf("[%*d/%d %3.0f%%] %-8s %s", width, status.JobsDone, status.TotalJobs,
+		status.PercentComplete, status.State, status.Job)
+	if status.Builder != "" {
+		fmt.Printf(" on %s", status.Builder)
+	}
+	if done {
+		fmt.Printf(" (%s)", status.Duration.Round(time.Millisecond))
+	}
+	fmt.Println()
+	//The output of a failed job comes with the final result
+	if status.Message != "" && status.State != rmake.JobFailed {
+		fmt.Print(status.Message)
+	}
 }
 
-// Processes feed back as it comes in
+// Processes feed back as it comes in, noting it in record
 // Waits for final build result
-func AwaitResult(c net.Conn) (*rmake.FinalBuildResult, error) {
+func (rmc *RMakeConf) AwaitResult(dec *gob.Decoder, record *BuildRecord) (*rmake.FinalBuildResult, error) {
 	var gobint interface{}
 	var fbr *rmake.FinalBuildResult
 
-	dec := gob.NewDecoder(c)
-
 	// Wait till we have what we want
 	for fbr == nil {
 		// Decode some data
@@ -207,8 +285,8 @@ func AwaitResult(c net.Conn) (*rmake.FinalBuildResult, error) {
 		// Found some data, grab the type...
 		switch message := gobint.(type) {
 		case *rmake.BuildStatus:
-			fmt.Println("Build Status")
-			PrintBuildStatus(message) // Doesn't work for some reason
+			PrintBuildStatus(message, rmc.Verbose)
+			record.Update(message)
 		case *rmake.FinalBuildResult:
 			fmt.Println("Final Build Result")
 			fbr = message
@@ -230,9 +308,12 @@ func AwaitResult(c net.Conn) (*rmake.FinalBuildResult, error) {
 //Perform a build as specified by the rmake config file
 func (rmc *RMakeConf) DoBuild() error {
 	start := time.Now()
+	rmc.RefreshHeaderDeps()
+
 	//Create a package
 	var inter interface{}
-	inter = NewManagerRequest(rmc)
+	p, hashed := NewManagerRequest(rmc)
+	inter = p
 
 	con, err := net.Dial("tcp", rmc.Server)
 	if err != nil {
@@ -240,29 +321,73 @@ func (rmc *RMakeConf) DoBuild() error {
 	}
 	defer con.Close()
 	enc := gob.NewEncoder(con)
+	dec := gob.NewDecoder(con)
 	err = enc.Encode(&inter)
 	if err != nil {
 		return err
 	}
 
+	//The manager tells us which files it doesn't have yet
+	var reply interface{}
+	err = dec.Decode(&reply)
+	if err != nil {
+		return err
+	}
+	req, ok := reply.(*rmake.BlobRequest)
+	if !ok {
+		return fmt.Errorf("Expected blob request from manager, got %s", reflect.TypeOf(reply))
+	}
+	err = rmc.SendBlobs(enc, req, p)
+	if err != nil {
+		return err
+	}
+
+	//Ask the manager to stop the build on Ctrl-C, it answers with the
+	//final result like any other build
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go cancelOnSignal(enc, sigs, done)
+
 	// Wait for the result
-	var fbr *rmake.FinalBuildResult
-	fbr, err = AwaitResult(con)
+	record := NewBuildRecord()
+	fbr, err := rmc.AwaitResult(dec, record)
 	if err != nil {
 		return err
 	}
+	record.Success = fbr.Success
+	rmc.LastBuild = record
 
 	// What do we want to do with the FinalBuildResult?
 	if fbr.Success {
 		fmt.Printf("Success!\n")
 		for _, f := range fbr.Results {
-			err := f.Save("")
+			err := f.Decompress()
+			if err == nil {
+				err = f.Save("")
+			}
 			if err != nil {
 				fmt.Println(err)
+			} else if rmc.Verbose {
+				fmt.Printf("Got '%s'\n", f.Path)
 			}
 		}
+		//Builders keep the session's files around for next time
+		rmc.Session = fbr.Session
+		rmc.Remember(hashed)
 	} else {
 		fmt.Printf("Error!\n")
+		if fbr.Error != "" {
+			fmt.Println(fbr.Error)
+		}
+		if fbr.Command != "" {
+			fmt.Printf("Command: %s\n", fbr.Command)
+		}
+		if fbr.Stdout != "" {
+			fmt.Print(fbr.Stdout)
+		}
 	}
 
 	took := time.Now().Sub(start)
@@ -272,6 +397,28 @@ func (rmc *RMakeConf) DoBuild() error {
 	return nil
 }
 
+//Send a cancel message to the manager on the first interrupt, and give
+//up without waiting for it on the second
+func cancelOnSignal(enc *gob.Encoder, sigs <-chan os.Signal, done chan struct{}) {
+	select {
+	case <-sigs:
+	case <-done:
+		return
+	}
+	fmt.Println("Cancelling the build...")
+	var mes interface{} = &rmake.BuildCancelMessage{}
+	err := enc.Encode(&mes)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	select {
+	case <-sigs:
+		os.Exit(1)
+	case <-done:
+	}
+}
+
 func LoadRMakeConf(file string) (*RMakeConf, error) {
 	fi, err := os.Open(file)
 	if err != nil {
@@ -283,7 +430,7 @@ func LoadRMakeConf(file string) (*RMakeConf, error) {
 	if err != nil {
 		return nil, err
 	}
-	rmc.LoadIgnores(".rmakeignore")
+	rmc.LoadIgnores(IgnoreFile)
 	return rmc, nil
 }
 
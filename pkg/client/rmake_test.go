@@ -0,0 +1,138 @@
+package client
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestCancelOnSignal(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	sigs := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	returned := make(chan bool)
+	go func() {
+		cancelOnSignal(gob.NewEncoder(theirs), sigs, done)
+		returned <- true
+	}()
+
+	sigs <- os.Interrupt
+	var mes interface{}
+	ours.SetReadDeadline(time.Now().Add(time.Second))
+	if err := gob.NewDecoder(ours).Decode(&mes); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mes.(*rmake.BuildCancelMessage); !ok {
+		t.Fatalf("Expected the manager to be asked to cancel, got %v", mes)
+	}
+
+	//The manager's final result ends the build
+	close(done)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Expected waiting for signals to stop once the build is done")
+	}
+}
+
+func TestCancelOnSignalAfterBuild(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	sigs := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	close(done)
+	cancelOnSignal(gob.NewEncoder(theirs), sigs, done)
+
+	//Nothing is sent for a build that is already done
+	theirs.Close()
+	var mes interface{}
+	if err := gob.NewDecoder(ours).Decode(&mes); err == nil {
+		t.Fatalf("Expected nothing to be sent, got %v", mes)
+	}
+}
+
+//Answer a single build request, with a final result that succeeds or not
+func fakeManager(t *testing.T, l net.Listener, success bool) {
+	c, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	dec := gob.NewDecoder(c)
+	var mes interface{}
+	if err := dec.Decode(&mes); err != nil {
+		t.Error(err)
+		return
+	}
+	p := mes.(*rmake.BuildPackage)
+	var hashes []string
+	for _, e := range p.Manifest {
+		hashes = append(hashes, e.Hash)
+	}
+	mes = &rmake.BlobRequest{Hashes: hashes}
+	enc.Encode(&mes)
+	dec.Decode(&mes)
+	mes = &rmake.FinalBuildResult{Session: "s", Success: success}
+	enc.Encode(&mes)
+}
+
+func TestBuildRemembersFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	ioutil.WriteFile("main.c", []byte("int main;"), 0644)
+	rmc := NewRMakeConf()
+	rmc.AddFile("main.c")
+	before := rmc.Files[0].LastTime
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmc.Server = l.Addr().String()
+
+	//A failed build leaves the file changed
+	go fakeManager(t, l, false)
+	if err := rmc.DoBuild(); err != nil {
+		t.Fatal(err)
+	}
+	if !rmc.Files[0].LastTime.Equal(before) || rmc.Files[0].Hash != "" {
+		t.Fatal("Expected main.c to still count as changed after a failed build")
+	}
+
+	//So does a manager that isn't there
+	l.Close()
+	if rmc.DoBuild() == nil {
+		t.Fatal("Expected the build to fail without a manager")
+	}
+	if !rmc.Files[0].LastTime.Equal(before) {
+		t.Fatal("Expected main.c to still count as changed without a manager")
+	}
+
+	l, err = net.Listen("tcp", rmc.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeManager(t, l, true)
+	if err := rmc.DoBuild(); err != nil {
+		t.Fatal(err)
+	}
+	inf, _ := os.Stat("main.c")
+	if !rmc.Files[0].LastTime.Equal(inf.ModTime()) || rmc.Files[0].Hash != rmake.Hash([]byte("int main;")) {
+		t.Fatal("Expected main.c to be unchanged after a successful build")
+	}
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Split a command line into words the way a POSIX shell would,
+//honoring single quotes, double quotes and backslash escapes
+func SplitShellWords(s string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				if s[i] != '\n' {
+					cur.WriteByte(s[i])
+				}
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated single quote in '%s'", s)
+			}
+			cur.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				cur.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("Unterminated double quote in '%s'", s)
+			}
+		default:
+			inWord = true
+			cur.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+//Characters that need a real shell to be interpreted
+const shellMeta = "|&;<>()$`*?[]~{}#\n"
+
+//Turn a shell command line into a command and its arguments
+//Simple commands are split into words and run directly, anything
+//using pipes, redirection, globs or variables is run through sh -c.
+func shellCommand(line string) (string, []string) {
+	if !strings.ContainsAny(line, shellMeta) {
+		words, err := SplitShellWords(line)
+		//A leading VAR=value sets the environment, which needs a shell too
+		if err == nil && len(words) > 0 && !strings.Contains(words[0], "=") {
+			return words[0], words[1:]
+		}
+	}
+	return "sh", []string{"-c", line}
+}
+
+//Characters that only mean something to a shell when unquoted
+const shellOperators = "|&;<>()`*?["
+
+//Find shell syntax outside of quotes, other than variable references
+//Returns the offending text, or "" when the line is a plain command.
+//Double quotes don't stop a shell from expanding $NAME, so those are
+//looked for inside of them too.
+func shellSyntax(line string) string {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			i++
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return ""
+			}
+			i += end + 1
+		case c == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				} else if line[i] == '$' {
+					n, bad := dollarSyntax(line[i:])
+					if bad != "" {
+						return bad
+					}
+					i += n - 1
+				}
+			}
+		case c == '$':
+			n, bad := dollarSyntax(line[i:])
+			if bad != "" {
+				return bad
+			}
+			i += n - 1
+		case strings.IndexByte(shellOperators, c) >= 0:
+			return string(c)
+		}
+	}
+	return ""
+}
+
+//Check the text starting at a $ for references only a shell expands
+//$(NAME) and ${NAME} are expanded by rmake, and $$(NAME) is kept as a
+//literal $(NAME). Returns how long the reference is, and the reference
+//when a shell is needed for it.
+func dollarSyntax(s string) (int, string) {
+	start := 0
+	if strings.HasPrefix(s, "$$(") || strings.HasPrefix(s, "$${") {
+		start = 1
+	}
+	if len(s) > start+1 && (s[start+1] == '(' || s[start+1] == '{') {
+		close := strings.IndexAny(s[start+2:], ")}")
+		if close < 0 {
+			return len(s), s
+		}
+		return start + close + 3, ""
+	}
+	if len(s) < 2 {
+		return 1, ""
+	}
+	c := s[1]
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		end := 2
+		for end < len(s) && (s[end] == '_' || s[end] >= 'a' && s[end] <= 'z' ||
+			s[end] >= 'A' && s[end] <= 'Z' || s[end] >= '0' && s[end] <= '9') {
+			end++
+		}
+		return end, s[:end]
+	case c >= '0' && c <= '9' || strings.IndexByte("?@*#!$-", c) >= 0:
+		return 2, s[:2]
+	}
+	return 1, ""
+}
+
+//Escape $(NAME) and ${NAME} inside single quotes, where a shell leaves
+//them alone, so that rmake doesn't expand them either
+func escapeQuotedVars(line string) string {
+	var out strings.Builder
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else if c == '$' && i+1 < len(line) && (line[i+1] == '(' || line[i+1] == '{') {
+				out.WriteByte('$')
+			}
+		case c == '\\':
+			if i+1 < len(line) {
+				out.WriteByte(c)
+				i++
+				c = line[i]
+			}
+		case c == '"':
+			if quote == '"' {
+				quote = 0
+			} else {
+				quote = '"'
+			}
+		case c == '\'' && quote == 0:
+			quote = '\''
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+//Parse a job command given by the user
+//The line is split into words like a shell would, honoring quotes and
+//escapes, and $(NAME) references are kept for rmake to expand, unless
+//they are in single quotes. With shell set the line is instead run as
+//it is with sh -c, which is what pipes, redirection, globs and $NAME
+//need.
+func ParseCommand(line string, shell bool) (string, []string, error) {
+	line = escapeQuotedVars(line)
+	if shell {
+		if strings.TrimSpace(line) == "" {
+			return "", nil, fmt.Errorf("Empty command")
+		}
+		return "sh", []string{"-c", line}, nil
+	}
+	words, err := SplitShellWords(line)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(words) == 0 {
+		return "", nil, fmt.Errorf("Empty command")
+	}
+	if op := shellSyntax(line); strings.HasPrefix(op, "$") {
+		return "", nil, fmt.Errorf("'%s' needs a shell to expand, use --shell to run it with sh -c, or $(NAME) for rmake variables", op)
+	} else if op != "" {
+		return "", nil, fmt.Errorf("'%s' needs a shell to run, use --shell to run it with sh -c", op)
+	}
+	if strings.Contains(words[0], "=") {
+		return "", nil, fmt.Errorf("Setting variables with '%s' needs a shell, use --shell or 'rmake var'", words[0])
+	}
+	return words[0], words[1:], nil
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		line string
+		cmd  string
+		args []string
+	}{
+		{`gcc -c main.c`, "gcc", []string{"-c", "main.c"}},
+		{`gcc -c -DNAME="\"a b\"" main.c`, "gcc", []string{"-c", `-DNAME="a b"`, "main.c"}},
+		{`echo '' "x  y"`, "echo", []string{"", "x  y"}},
+		{`gcc $(CFLAGS) -c ${SRC}`, "gcc", []string{"$(CFLAGS)", "-c", "${SRC}"}},
+		{`printf 'a|b' "c > d" e\;f`, "printf", []string{"a|b", "c > d", "e;f"}},
+		{`echo '$HOME' \$HOME "a$" $`, "echo", []string{"$HOME", "$HOME", "a$", "$"}},
+		{`echo '$(CC) ${CC}' "$(CC)" '"$(CC)"'`, "echo", []string{"$$(CC) $${CC}", "$(CC)", `"$$(CC)"`}},
+	}
+	for _, c := range cases {
+		cmd, args, err := ParseCommand(c.line, false)
+		if err != nil {
+			t.Errorf("%s: %s", c.line, err)
+			continue
+		}
+		if cmd != c.cmd || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: got %q %q", c.line, cmd, args)
+		}
+	}
+
+	//Single quoted references stay as they are
+	cmd, args, err := ParseCommand(`echo '$(CC)' $(CC)`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := (&rmake.Job{Command: cmd, Args: args}).Expand(map[string]string{"CC": "gcc"})
+	if !reflect.DeepEqual(j.Args, []string{"$(CC)", "gcc"}) {
+		t.Fatalf("Expected only the unquoted $(CC) to be expanded, got %q", j.Args)
+	}
+
+	refused := []string{`cat a | sort`, `gcc -c *.c`, `cc x.c > log`, `CC=gcc make`, `echo "open`, ``,
+		`gcc $CFLAGS -c main.c`, `echo "$HOME"`, `echo ${HOME`, `echo $$`, `echo $1`}
+	for _, line := range refused {
+		if _, _, err := ParseCommand(line, false); err == nil {
+			t.Errorf("Expected '%s' to be refused", line)
+		}
+	}
+
+	cmd, args, err = ParseCommand(`cat a | sort > b`, true)
+	if err != nil || cmd != "sh" || !reflect.DeepEqual(args, []string{"-c", "cat a | sort > b"}) {
+		t.Fatalf("Got %q %q %v for a shell command", cmd, args, err)
+	}
+	cmd, args, err = ParseCommand(`echo $HOME '$(CC)'`, true)
+	if err != nil || cmd != "sh" || !reflect.DeepEqual(args, []string{"-c", "echo $HOME '$$(CC)'"}) {
+		t.Fatalf("Got %q %q %v for a shell command", cmd, args, err)
+	}
+}
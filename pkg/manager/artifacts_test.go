@@ -0,0 +1,35 @@
+package manager
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestArtifactJobs(t *testing.T) {
+	link := &rmake.Job{Output: "prog", Deps: []string{"main.o"}}
+	cc := &rmake.Job{Output: "main.o", Outputs: []string{"main.d"}}
+	gen := &rmake.Job{Output: "gen/a.h", Outputs: []string{"gen/sub/b.h", "genlog"}}
+	jobs := []*rmake.Job{link, cc, gen}
+
+	bp := &rmake.BuildPackage{Output: "prog", Outputs: []string{"gen/", "main.d", "prog"}}
+	returns, err := artifactJobs(jobs, bp.Artifacts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(returns) != 3 {
+		t.Fatalf("Expected 3 jobs to return artifacts, got %d", len(returns))
+	}
+	if r := strings.Join(returns[gen], " "); r != "gen/a.h gen/sub/b.h" {
+		t.Fatalf("Expected the generated directory back, got '%s'", r)
+	}
+	if r := strings.Join(returns[cc], " "); r != "main.d" {
+		t.Fatalf("Expected only main.d from the compile job, got '%s'", r)
+	}
+
+	_, err = artifactJobs(jobs, []string{"prog", "gen/a"})
+	if err == nil {
+		t.Fatal("Expected an error for an artifact nothing makes")
+	}
+}
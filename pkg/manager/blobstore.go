@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"sync"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+// BlobStore holds file contents by digest, shared by every session so
+// identical files are only ever uploaded once.
+type BlobStore struct {
+	blobs map[string][]byte
+	lock  sync.Mutex
+}
+
+// Make a new empty blob store
+func NewBlobStore() *BlobStore {
+	s := new(BlobStore)
+	s.blobs = make(map[string][]byte)
+	return s
+}
+
+// Returns the hashes we have no contents for
+func (s *BlobStore) Missing(hashes []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	s.lock.Lock()
+	for _, h := range hashes {
+		if _, ok := s.blobs[h]; !ok && !seen[h] {
+			seen[h] = true
+			out = append(out, h)
+		}
+	}
+	s.lock.Unlock()
+	return out
+}
+
+// Store a blob after checking its contents match its hash
+func (s *BlobStore) Put(b *rmake.Blob) error {
+	err := b.Decompress()
+	if err != nil {
+		return err
+	}
+	err = b.Verify()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.blobs[b.Hash] = b.Contents
+	s.lock.Unlock()
+	return nil
+}
+
+// The size of a blob's contents, zero if we don't have it
+func (s *BlobStore) Size(hash string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return int64(len(s.blobs[hash]))
+}
+
+// Collect the requested blobs, listing the ones we don't have
+func (s *BlobStore) Data(hashes []string) *rmake.BlobData {
+	bd := new(rmake.BlobData)
+	s.lock.Lock()
+	for _, h := range hashes {
+		if c, ok := s.blobs[h]; ok {
+			bd.Blobs = append(bd.Blobs, &rmake.Blob{Hash: h, Contents: c})
+		} else {
+			bd.Missing = append(bd.Missing, h)
+		}
+	}
+	s.lock.Unlock()
+	return bd
+}
+
+// Drop every blob not in the live set
+func (s *BlobStore) Retain(live map[string]bool) {
+	s.lock.Lock()
+	for h := range s.blobs {
+		if !live[h] {
+			delete(s.blobs, h)
+		}
+	}
+	s.lock.Unlock()
+}
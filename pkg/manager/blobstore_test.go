@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"encoding/gob"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestBlobStore(t *testing.T) {
+	s := NewBlobStore()
+	a := rmake.NewBlob([]byte("int a;"))
+	b := rmake.NewBlob([]byte("int b;"))
+
+	if missing := s.Missing([]string{a.Hash, b.Hash, a.Hash}); len(missing) != 2 {
+		t.Fatalf("Expected 2 missing blobs, got %d", len(missing))
+	}
+	if err := s.Put(&rmake.Blob{Hash: a.Hash, Contents: []byte("int c;")}); err == nil {
+		t.Fatal("Expected contents that don't match their hash to be rejected")
+	}
+	if err := s.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	if missing := s.Missing([]string{a.Hash, b.Hash}); !reflect.DeepEqual(missing, []string{b.Hash}) {
+		t.Fatalf("Expected only b to be missing, got %v", missing)
+	}
+
+	bd := s.Data([]string{a.Hash, b.Hash})
+	if len(bd.Blobs) != 1 || bd.Blobs[0].Hash != a.Hash || !reflect.DeepEqual(bd.Missing, []string{b.Hash}) {
+		t.Fatalf("Expected a's contents and b to be missing, got %d blobs and %v", len(bd.Blobs), bd.Missing)
+	}
+
+	s.Retain(map[string]bool{})
+	if s.Size(a.Hash) != 0 {
+		t.Fatal("Expected a blob no session uses to be dropped")
+	}
+}
+
+func TestBuilderBlobRequest(t *testing.T) {
+	m := testManager(t)
+	have := rmake.NewBlob([]byte("int main;"))
+	gone := rmake.Hash([]byte("int f;"))
+	if err := m.blobs.Put(have); err != nil {
+		t.Fatal(err)
+	}
+
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	bc := NewBuilderConnection(theirs, gob.NewDecoder(theirs), "", 1, "b1", m)
+	go bc.Sender()
+	go bc.Listener()
+
+	var mes interface{} = &rmake.BlobRequest{Hashes: []string{have.Hash, gone}}
+	if err := gob.NewEncoder(ours).Encode(&mes); err != nil {
+		t.Fatal(err)
+	}
+	var reply interface{}
+	ours.SetReadDeadline(time.Now().Add(time.Second))
+	if err := gob.NewDecoder(ours).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	data, ok := reply.(*rmake.BlobData)
+	if !ok {
+		t.Fatalf("Expected blob data, got %s", reflect.TypeOf(reply))
+	}
+	if len(data.Blobs) != 1 || data.Blobs[0].Hash != have.Hash || string(data.Blobs[0].Contents) != "int main;" {
+		t.Fatalf("Expected the contents of main.c, got %d blobs", len(data.Blobs))
+	}
+	if !reflect.DeepEqual(data.Missing, []string{gone}) {
+		t.Fatalf("Expected to be told f.c is missing, got %v", data.Missing)
+	}
+	if !bc.HasBlob(have.Hash) || bc.HasBlob(gone) {
+		t.Fatal("Expected only main.c to be remembered as sent")
+	}
+}
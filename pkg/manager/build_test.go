@@ -0,0 +1,221 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+//Start a build of the package in the session, the way the manager does
+//for a client's request
+func testBuild(t *testing.T, s *Session, bp *rmake.BuildPackage) *Build {
+	returns, err := artifactJobs(bp.Jobs, bp.Artifacts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := jobGraph(bp, returns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuild(s)
+	b.SetGraph(roots)
+	b.Returns = returns
+	b.Returning = len(returns)
+	return b
+}
+
+func TestBuildReadyJobs(t *testing.T) {
+	gen := &rmake.Job{Output: "gen.h", Deps: []string{"gen.py"}}
+	a := &rmake.Job{Output: "a.o", Deps: []string{"a.c", "gen.h"}}
+	b := &rmake.Job{Output: "b.o", Deps: []string{"b.c", "gen.h"}}
+	other := &rmake.Job{Output: "c.o", Deps: []string{"c.c"}}
+	link := &rmake.Job{Output: "prog", Deps: []string{"a.o", "b.o", "c.c"}}
+	bp := &rmake.BuildPackage{
+		Output:   "prog",
+		Jobs:     []*rmake.Job{link, a, b, gen, other},
+		Manifest: []*rmake.ManifestEntry{{Path: "gen.py"}, {Path: "a.c"}, {Path: "b.c"}, {Path: "c.c"}},
+	}
+	build := testBuild(t, NewSession(), bp)
+	if build.TotalJobs != 4 {
+		t.Fatalf("Expected the 4 jobs prog needs, got %d", build.TotalJobs)
+	}
+	bc := new(BuilderConnection)
+	expect := func(outputs ...string) {
+		ready := build.TakeReady()
+		if len(ready) != len(outputs) {
+			t.Fatalf("Expected %v to be ready, got %d jobs", outputs, len(ready))
+		}
+		for i, j := range ready {
+			if j.Output != outputs[i] {
+				t.Fatalf("Expected %v to be ready, got %s", outputs, j.Output)
+			}
+			build.Assign(j, bc)
+		}
+	}
+
+	expect("gen.h")
+	expect()
+	build.Finish("gen.h", time.Second)
+	if build.Location("gen.h") != bc {
+		t.Fatal("Expected gen.h to be on the builder that made it")
+	}
+	expect("a.o", "b.o")
+	build.Finish("a.o", time.Second)
+	expect()
+	build.Start("b.o")
+	if bs := build.Status(b); bs.State != rmake.JobRunning || bs.JobsDone != 2 || bs.PercentComplete != 50 {
+		t.Fatalf("Expected b.o to be running at 50%%, got %s at %f%%", bs.State, bs.PercentComplete)
+	}
+	build.Finish("b.o", time.Second)
+	expect("prog")
+	build.Fail("prog", time.Second)
+	if bs := build.Status(link); bs.State != rmake.JobFailed || bs.JobsDone != 3 {
+		t.Fatalf("Expected prog to have failed after 3 jobs, got %s after %d", bs.State, bs.JobsDone)
+	}
+}
+
+func TestBuildLoseBuilder(t *testing.T) {
+	gen := &rmake.Job{Output: "gen.h", Deps: []string{"gen.py"}}
+	a := &rmake.Job{Output: "a.o", Deps: []string{"a.c", "gen.h"}}
+	b := &rmake.Job{Output: "b.o", Deps: []string{"b.c", "gen.h"}}
+	link := &rmake.Job{Output: "prog", Deps: []string{"a.o", "b.o"}}
+	bp := &rmake.BuildPackage{
+		Output:   "prog",
+		Jobs:     []*rmake.Job{link, a, b, gen},
+		Manifest: []*rmake.ManifestEntry{{Path: "gen.py"}, {Path: "a.c"}, {Path: "b.c"}},
+	}
+	build := testBuild(t, NewSession(), bp)
+
+	lost, kept := new(BuilderConnection), new(BuilderConnection)
+	run := func(bc *BuilderConnection, outputs ...string) {
+		ready := build.TakeReady()
+		if len(ready) != len(outputs) {
+			t.Fatalf("Expected %v to be ready, got %d jobs", outputs, len(ready))
+		}
+		for i, j := range ready {
+			if j.Output != outputs[i] {
+				t.Fatalf("Expected %v to be ready, got %s", outputs, j.Output)
+			}
+			build.Assign(j, bc)
+		}
+	}
+	run(lost, "gen.h")
+	build.Finish("gen.h", time.Second)
+	build.TakeReady()
+	build.Assign(a, lost)
+	build.Assign(b, kept)
+	build.Finish("a.o", time.Second)
+	build.Finish("b.o", time.Second)
+	run(kept, "prog")
+
+	//prog still needs a.o, which needs gen.h again, b.o is done with it
+	again := build.Lose(lost)
+	if len(again) != 2 || again[0] != gen || again[1] != a {
+		t.Fatalf("Expected gen.h and a.o to run again, got %d jobs", len(again))
+	}
+	if build.JobsDone != 1 || build.Location("a.o") != nil {
+		t.Fatalf("Expected only b.o to be done, got %d jobs", build.JobsDone)
+	}
+	run(kept, "gen.h")
+	if r := build.Record("gen.h"); r.Attempts != 2 {
+		t.Fatalf("Expected gen.h to have been sent twice, got %d", r.Attempts)
+	}
+	build.Finish("gen.h", time.Second)
+	run(kept, "a.o")
+	build.Finish("a.o", time.Second)
+	if sent := build.SentDependents(a); len(sent) != 1 || sent[0] != link {
+		t.Fatal("Expected prog to be waiting for a.o on its builder")
+	}
+	if build.AddResults("prog", nil) != true || build.AddResults("prog", nil) != false {
+		t.Fatal("Expected the results of prog to be kept once")
+	}
+}
+
+func TestBuildLoseForwarded(t *testing.T) {
+	gen := &rmake.Job{Output: "gen.h", Deps: []string{"gen.py"}}
+	a := &rmake.Job{Output: "a.o", Deps: []string{"a.c", "gen.h"}}
+	b := &rmake.Job{Output: "b.o", Deps: []string{"b.c", "gen.h"}}
+	link := &rmake.Job{Output: "prog", Deps: []string{"a.o", "b.o"}}
+	bp := &rmake.BuildPackage{
+		Output:   "prog",
+		Jobs:     []*rmake.Job{link, a, b, gen},
+		Manifest: []*rmake.ManifestEntry{{Path: "gen.py"}, {Path: "a.c"}, {Path: "b.c"}},
+	}
+	build := testBuild(t, NewSession(), bp)
+
+	lost, kept := new(BuilderConnection), new(BuilderConnection)
+	build.TakeReady()
+	build.Assign(gen, lost)
+	build.Finish("gen.h", time.Second)
+	build.TakeReady()
+	build.Assign(a, lost)
+	build.Assign(b, kept)
+	build.Forwarded([]string{"gen.h"}, kept)
+
+	//kept has gen.h already, so only a.o runs again
+	again := build.Lose(lost)
+	if len(again) != 1 || again[0] != a {
+		t.Fatalf("Expected only a.o to run again, got %d jobs", len(again))
+	}
+	if build.JobsDone != 1 || build.Location("gen.h") != kept {
+		t.Fatal("Expected gen.h to stay done, sent on from the builder that has it")
+	}
+	if ready := build.TakeReady(); len(ready) != 1 || ready[0] != a {
+		t.Fatal("Expected a.o to be ready again right away")
+	}
+}
+
+func TestBuildCriticalPath(t *testing.T) {
+	gen := &rmake.Job{Output: "gen.h", Command: "python", Args: []string{"gen.py"}, Deps: []string{"gen.py"}}
+	a := &rmake.Job{Output: "a.o", Command: "gcc", Args: []string{"-c", "a.c"}, Deps: []string{"a.c", "gen.h"}}
+	b := &rmake.Job{Output: "b.o", Command: "gcc", Args: []string{"-c", "b.c"}, Deps: []string{"b.c"}}
+	slow := &rmake.Job{Output: "slow.o", Command: "gcc", Args: []string{"-c", "slow.c"}, Deps: []string{"slow.c"}}
+	link := &rmake.Job{Output: "prog", Command: "gcc", Args: []string{"a.o", "b.o", "slow.o"}, Deps: []string{"a.o", "b.o", "slow.o"}}
+	bp := &rmake.BuildPackage{
+		Output:   "prog",
+		Jobs:     []*rmake.Job{link, gen, a, b, slow},
+		Manifest: []*rmake.ManifestEntry{{Path: "gen.py"}, {Path: "a.c"}, {Path: "b.c"}, {Path: "slow.c"}},
+	}
+	h := NewJobHistory()
+	h.Add(link, time.Second)
+	h.Add(slow, 10*time.Second)
+	h.Add(a, time.Second)
+	h.Add(gen, 3*time.Second)
+	h.Add(gen, time.Second)
+	if d, _ := h.Get(gen); d != 2*time.Second {
+		t.Fatalf("Expected the runs of gen.h to average 2s, got %s", d)
+	}
+	changed := &rmake.Job{Output: "b.o", Command: "gcc", Args: []string{"-O2", "-c", "b.c"}}
+	h.Add(changed, time.Hour)
+	if _, ok := h.Get(b); ok {
+		t.Fatal("Expected b.o to be unknown with its old command")
+	}
+
+	build := testBuild(t, NewSession(), bp)
+	build.Prioritize(h.Get)
+	//b.o never ran, so it is guessed to take the average 3.5s
+	expect := map[*rmake.Job]time.Duration{
+		link: time.Second,
+		slow: 11 * time.Second,
+		a:    2 * time.Second,
+		gen:  4 * time.Second,
+		b:    4500 * time.Millisecond,
+	}
+	for j, p := range expect {
+		if got := build.Priority(j); got != p {
+			t.Fatalf("Expected %s to have priority %s, got %s", j.Output, p, got)
+		}
+	}
+
+	order := []string{"slow.o", "b.o", "gen.h"}
+	ready := build.TakeReady()
+	if len(ready) != len(order) {
+		t.Fatalf("Expected %v to be ready, got %d jobs", order, len(ready))
+	}
+	for i, j := range ready {
+		if j.Output != order[i] {
+			t.Fatalf("Expected the jobs in the order %v, got %s at %d", order, j.Output, i)
+		}
+	}
+}
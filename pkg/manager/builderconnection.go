@@ -3,8 +3,11 @@ package manager
 import (
 	"encoding/gob"
 	"net"
+	"sync"
+	"time"
 
 	slog "github.com/cihub/seelog"
+	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
 // BuilderConnection handles communications with a certain rmake builder node.
@@ -17,8 +20,10 @@ type BuilderConnection struct {
 	ListenerAddr string
 	// The backing network connection
 	conn net.Conn
-	// The current number of jobs
+	// The number of jobs sent to the builder that haven't finished
 	NumJobs int
+	// How many jobs the builder runs at once
+	Procs int
 	// The managing manager
 	Manager *Manager
 	// The gob encoder
@@ -27,14 +32,77 @@ type BuilderConnection struct {
 	dec *gob.Decoder
 	//Channel for messages coming from the builder to the manager
 	Incoming chan interface{}
-	//Channel for messages going to the builder
-	Outgoing chan interface{}
+	// Messages waiting to be sent to the builder, so whoever sends one
+	// never waits on the network
+	outgoing []interface{}
+	// Signalled when a message is queued or the connection is closed
+	wake chan struct{}
+	// Set once nothing more is sent to the builder
+	closed bool
 	// Index in the priority queue
 	Index int
+	// The compression agreed on with the builder
+	Compression *rmake.Compression
+	// How often the builder sends heartbeats
+	Heartbeat time.Duration
+	// When anything was last heard from the builder
+	lastBeat time.Time
+	// Whether the builder is missing heartbeats, or was lost
+	health BuilderHealth
+	// The builder's latest status update
+	status rmake.BuilderStatusUpdate
+	// Moving averages of the ping round trip and of how long jobs take
+	latency time.Duration
+	jobTime time.Duration
+	// Blobs sent to the builder, which it keeps in its cache
+	blobs map[string]bool
+	lock  sync.Mutex
+}
+
+// What schedulers know about how busy a builder is
+type BuilderLoad struct {
+	// Jobs sent to the builder that haven't finished
+	Jobs  int
+	Procs int
+	// As of the builder's latest status update
+	Queued  int
+	Running int
+	// Whether the builder's queue is at its capacity
+	Full    bool
+	CPULoad float32
+	MemUse  float32
+	// The time for a message to get to the builder and back
+	Latency time.Duration
+	// How long the builder's jobs took, on average, zero before any
+	// finished
+	JobTime time.Duration
+}
+
+// How a builder is doing, judging by its heartbeats
+type BuilderHealth int
+
+const (
+	BuilderAlive BuilderHealth = iota
+	// Missed a heartbeat, no jobs are sent to it until it is heard from
+	BuilderSuspect
+	// Missed too many heartbeats, or the connection to it was lost
+	BuilderDead
+)
+
+func (h BuilderHealth) String() string {
+	switch h {
+	case BuilderAlive:
+		return "alive"
+	case BuilderSuspect:
+		return "suspect"
+	case BuilderDead:
+		return "dead"
+	}
+	return "unknown"
 }
 
 // Sets up a new builder connection
-func NewBuilderConnection(c net.Conn, la string, uuid int, hn string, m *Manager) *BuilderConnection {
+func NewBuilderConnection(c net.Conn, dec *gob.Decoder, la string, uuid int, hn string, m *Manager) *BuilderConnection {
 	// Build bulder connection
 	bc := new(BuilderConnection)
 	bc.UUID = uuid
@@ -44,9 +112,10 @@ func NewBuilderConnection(c net.Conn, la string, uuid int, hn string, m *Manager
 	bc.NumJobs = 0
 	bc.Manager = m
 	bc.enc = gob.NewEncoder(c)
-	bc.dec = gob.NewDecoder(c)
-	bc.Outgoing = make(chan interface{})
+	bc.dec = dec
+	bc.wake = make(chan struct{}, 1)
 	bc.Incoming = m.Incoming
+	bc.lastBeat = time.Now()
 	return bc
 }
 
@@ -58,31 +127,251 @@ func (b *BuilderConnection) Listener() {
 		if err != nil {
 			slog.Critical(err)
 
-			//TODO: remove this builder from the managers queue
-			b.conn.Close()
-			b.Incoming <- b
+			//The manager takes the builder out of its queue and
+			//gives its jobs to other builders
+			b.Kill()
+			select {
+			case b.Incoming <- b:
+			case <-b.Manager.stopped:
+			}
 			return
 		}
 		slog.Info("Recieved message from builder.")
-		b.Incoming <- i
+		//Anything the builder sends shows it is still there
+		b.Beat()
+		if p, ok := i.(*rmake.Ping); ok {
+			b.observe(&b.latency, time.Since(p.Sent))
+			continue
+		}
+		//Blob requests are answered straight from the store
+		if req, ok := i.(*rmake.BlobRequest); ok {
+			go func() {
+				data := b.Manager.blobs.Data(req.Hashes)
+				if len(data.Missing) > 0 {
+					slog.Warnf("'%s' asked for %d blobs we don't have", b.Hostname, len(data.Missing))
+				}
+				for _, blob := range data.Blobs {
+					b.SentBlob(blob.Hash)
+					blob.Compress(b.Compression)
+				}
+				b.Send(data)
+			}()
+			continue
+		}
+		select {
+		case b.Incoming <- &builderMessage{b, i}:
+		case <-b.Manager.stopped:
+			return
+		}
 	}
 }
 
+// A message from a builder, passed on to the manager along with who
+// sent it
+type builderMessage struct {
+	from    *BuilderConnection
+	message interface{}
+}
+
 // waits for messages from the manager and sends them off to the builder
+// Once the builder is lost, messages are dropped so nobody sending one
+// gets stuck.
 func (b *BuilderConnection) Sender() {
 	for {
-		i,ok := <-b.Outgoing
+		queued, ok := b.next()
 		if !ok {
 			return
 		}
-		err := b.enc.Encode(&i)
-		if err != nil {
-			panic(err)
+		for _, i := range queued {
+			if b.Dead() {
+				break
+			}
+			err := b.enc.Encode(&i)
+			if err != nil {
+				slog.Error(err)
+				b.Kill()
+			}
+		}
+	}
+}
+
+// Queue a message for the builder
+// Never waits, the Sender writes it out. Messages queued after Close are
+// dropped.
+func (b *BuilderConnection) Send(mes interface{}) {
+	b.lock.Lock()
+	if !b.closed {
+		b.outgoing = append(b.outgoing, mes)
+	}
+	b.lock.Unlock()
+	b.signal()
+}
+
+// Stop sending to the builder once the queued messages are out
+func (b *BuilderConnection) Close() {
+	b.lock.Lock()
+	b.closed = true
+	b.lock.Unlock()
+	b.signal()
+}
+
+func (b *BuilderConnection) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for messages to send to the builder
+// Returns false once the connection is closed and nothing is left.
+func (b *BuilderConnection) next() ([]interface{}, bool) {
+	for {
+		b.lock.Lock()
+		queued, closed := b.outgoing, b.closed
+		b.outgoing = nil
+		b.lock.Unlock()
+		if len(queued) > 0 {
+			return queued, true
 		}
+		if closed {
+			return nil, false
+		}
+		<-b.wake
+	}
+}
+
+// Ping the builder every interval, until it is lost
+func (b *BuilderConnection) Pinger(interval time.Duration) {
+	for !b.Dead() {
+		b.Send(&rmake.Ping{Sent: time.Now()})
+		time.Sleep(interval)
+	}
+}
+
+// Add to the average of a measurement, weighing recent ones more
+func (b *BuilderConnection) observe(avg *time.Duration, d time.Duration) {
+	b.lock.Lock()
+	if *avg == 0 {
+		*avg = d
+	} else {
+		*avg = (*avg*3 + d) / 4
+	}
+	b.lock.Unlock()
+}
+
+// Note how long a job of the builder took
+func (b *BuilderConnection) JobDone(took time.Duration) {
+	b.observe(&b.jobTime, took)
+}
+
+// Note that the builder has a blob in its cache
+func (b *BuilderConnection) SentBlob(hash string) {
+	b.lock.Lock()
+	if b.blobs == nil {
+		b.blobs = make(map[string]bool)
+	}
+	b.blobs[hash] = true
+	b.lock.Unlock()
+}
+
+// Whether the builder was sent a blob since it connected
+func (b *BuilderConnection) HasBlob(hash string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.blobs[hash]
+}
+
+// Count jobs sent to the builder, or finished with a negative n
+func (b *BuilderConnection) AddJobs(n int) {
+	b.lock.Lock()
+	b.NumJobs += n
+	b.lock.Unlock()
+}
+
+// Keep the builder's latest status update
+func (b *BuilderConnection) SetStatus(bsu *rmake.BuilderStatusUpdate) {
+	b.lock.Lock()
+	b.status = *bsu
+	b.lock.Unlock()
+}
+
+// How busy the builder is
+func (b *BuilderConnection) Load() BuilderLoad {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return BuilderLoad{
+		Jobs:    b.NumJobs,
+		Procs:   b.Procs,
+		Queued:  b.status.QueuedJobs,
+		Running: b.status.RunningJobs,
+		Full:    b.status.QueueFull,
+		CPULoad: b.status.CPULoad,
+		MemUse:  b.status.MemUse,
+		Latency: b.latency,
+		JobTime: b.jobTime,
+	}
+}
+
+// Close the connection to the builder
+// The listener notices and tells the manager the builder is gone.
+func (b *BuilderConnection) Kill() {
+	b.lock.Lock()
+	b.health = BuilderDead
+	b.lock.Unlock()
+	b.conn.Close()
+}
+
+// Whether the connection to the builder was lost
+func (b *BuilderConnection) Dead() bool {
+	return b.Health() == BuilderDead
+}
+
+func (b *BuilderConnection) Health() BuilderHealth {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.health
+}
+
+// Note that the builder was heard from
+func (b *BuilderConnection) Beat() {
+	b.lock.Lock()
+	b.lastBeat = time.Now()
+	b.lock.Unlock()
+}
+
+// Judge the builder by how many heartbeats it missed
+// A builder that missed one is suspect, one that missed maxMissed is
+// killed. Returns the number of heartbeats missed and whether the
+// builder's health changed.
+func (b *BuilderConnection) CheckHealth(maxMissed int) (int, bool) {
+	b.lock.Lock()
+	if b.health == BuilderDead || b.Heartbeat <= 0 {
+		b.lock.Unlock()
+		return 0, false
+	}
+	//The next heartbeat is only late once a whole interval has passed
+	missed := int(time.Since(b.lastBeat)/b.Heartbeat) - 1
+	if missed < 0 {
+		missed = 0
+	}
+	health := BuilderAlive
+	if missed > 0 {
+		health = BuilderSuspect
+	}
+	changed := health != b.health
+	b.health = health
+	b.lock.Unlock()
+
+	if missed >= maxMissed {
+		b.Kill()
+		changed = true
 	}
+	return missed, changed
 }
 
 //Sorting Heuristic
 func (b *BuilderConnection) H() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	return b.NumJobs
 }
@@ -58,6 +58,16 @@ func (q *BuilderQueue) Peek() *BuilderConnection {
 	return p
 }
 
+// Every builder connection in the queue, in no particular order
+// Locks the mutex
+func (q *BuilderQueue) Builders() []*BuilderConnection {
+	q.mut.Lock()
+	out := make([]*BuilderConnection, len(q.arr)-1)
+	copy(out, q.arr[1:])
+	q.mut.Unlock()
+	return out
+}
+
 // Get the length of the queue
 // Locks the mutex
 func (q *BuilderQueue) Len() int {
@@ -152,10 +162,25 @@ func (q *BuilderQueue) Remove(i int) {
 	q.mut.Unlock()
 }
 
+// Remove a builder connection from the queue, if it is in it
+// Locks the mutex
+func (q *BuilderQueue) RemoveBuilder(bc *BuilderConnection) {
+	q.mut.Lock()
+	if bc.Index > 0 && bc.Index < len(q.arr) && q.arr[bc.Index] == bc {
+		q.removeUnsafe(bc.Index)
+	}
+	q.mut.Unlock()
+}
+
 // Remove the item at i from the queue
 // This method will not lock the mutex
 func (q *BuilderQueue) removeUnsafe(i int) {
-	q.arr[i] = q.arr[len(q.arr)-1]
-	q.arr = q.arr[:len(q.arr)-1]
-	q.percDownUnsafe(i)
+	last := len(q.arr) - 1
+	q.arr[i] = q.arr[last]
+	q.arr[i].Index = i
+	q.arr = q.arr[:last]
+	if i < last {
+		q.percDownUnsafe(i)
+		q.percUpUnsafe(i)
+	}
 }
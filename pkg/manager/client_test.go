@@ -0,0 +1,240 @@
+package manager
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func expectResult(t *testing.T, b *Build, reason string) {
+	select {
+	case mes := <-b.Client:
+		fbr, ok := mes.(*rmake.FinalBuildResult)
+		if !ok || fbr.Success || fbr.Error != reason {
+			t.Fatalf("Expected the build to fail with '%s', got %v", reason, mes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the build to fail with '%s'", reason)
+	}
+	if !b.Over() {
+		t.Fatal("Expected the build to be over")
+	}
+}
+
+func TestWatchClient(t *testing.T) {
+	m := testManager(t)
+	s := m.GetNewSession()
+
+	//The client asks to cancel
+	b := NewBuild(s)
+	ours, theirs := net.Pipe()
+	go m.watchClient(s, b, gob.NewDecoder(theirs))
+	var mes interface{} = &rmake.BuildCancelMessage{}
+	if err := gob.NewEncoder(ours).Encode(&mes); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, b, "The build was cancelled")
+	ours.Close()
+
+	//The client's connection drops
+	b = NewBuild(s)
+	ours, theirs = net.Pipe()
+	go m.watchClient(s, b, gob.NewDecoder(theirs))
+	ours.Close()
+	expectResult(t, b, "The client went away")
+
+	//The build ends before the client says anything
+	b = NewBuild(s)
+	ours, theirs = net.Pipe()
+	watched := make(chan bool)
+	go func() {
+		m.watchClient(s, b, gob.NewDecoder(theirs))
+		watched <- true
+	}()
+	s.EndBuild(b.ID)
+	ours.Close()
+	select {
+	case <-watched:
+	case <-time.After(time.Second):
+		t.Fatal("Expected watching the client to stop")
+	}
+	select {
+	case mes := <-b.Client:
+		t.Fatalf("Expected nothing to be sent for a build that is over, got %s", reflect.TypeOf(mes))
+	default:
+	}
+}
+
+//A connection whose writes fail once it is broken
+type breakingConn struct {
+	net.Conn
+	lock   sync.Mutex
+	broken bool
+}
+
+func (c *breakingConn) Break() {
+	c.lock.Lock()
+	c.broken = true
+	c.lock.Unlock()
+}
+
+func (c *breakingConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	broken := c.broken
+	c.lock.Unlock()
+	if broken {
+		return 0, errors.New("broken")
+	}
+	return c.Conn.Write(b)
+}
+
+func TestClientWriteFails(t *testing.T) {
+	m := testManager(t)
+
+	//A builder that takes the job and is told to cancel it
+	bours, btheirs := net.Pipe()
+	defer bours.Close()
+	bc := NewBuilderConnection(btheirs, gob.NewDecoder(btheirs), "", 1, "b1", m)
+	go bc.Sender()
+	m.queue.Push(bc)
+	cancelled := make(chan bool)
+	go func() {
+		dec := gob.NewDecoder(bours)
+		for {
+			var mes interface{}
+			if dec.Decode(&mes) != nil {
+				return
+			}
+			if _, ok := mes.(*rmake.BuildCancelMessage); ok {
+				cancelled <- true
+			}
+		}
+	}()
+
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	conn := &breakingConn{Conn: theirs}
+	handled := make(chan bool)
+	go func() {
+		m.HandleConnection(conn)
+		handled <- true
+	}()
+
+	src := rmake.NewBlob([]byte("int main;"))
+	var mes interface{} = &rmake.BuildPackage{
+		Output:   "main.o",
+		Jobs:     []*rmake.Job{{Command: "cc", Args: []string{"-c", "main.c"}, Output: "main.o", Deps: []string{"main.c"}}},
+		Manifest: []*rmake.ManifestEntry{{Path: "main.c", Hash: src.Hash}},
+	}
+	enc := gob.NewEncoder(ours)
+	dec := gob.NewDecoder(ours)
+	if err := enc.Encode(&mes); err != nil {
+		t.Fatal(err)
+	}
+	var reply interface{}
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	//Progress on the job can't be written to the client anymore
+	conn.Break()
+	mes = &rmake.BlobData{Blobs: []*rmake.Blob{src}}
+	if err := enc.Encode(&mes); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the builder to be told to cancel the build")
+	}
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the manager to be done with the client")
+	}
+	if len(m.activeBuilds()) != 0 {
+		t.Fatal("Expected the build to be over")
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	m := testManager(t)
+	s := m.GetNewSession()
+	b := NewBuild(s)
+	a := &rmake.Job{Output: "a.o"}
+	c := &rmake.Job{Output: "c.o"}
+
+	//Nobody reads the build's messages, progress still doesn't wait
+	sent := make(chan bool)
+	go func() {
+		m.sendProgress(s, b, a, "first\n")
+		m.sendProgress(s, b, c, "")
+		m.sendProgress(s, b, a, "second\n")
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Expected progress not to wait on the client")
+	}
+
+	//The updates for a are merged into the latest one
+	progress := b.TakeProgress()
+	if len(progress) != 2 || progress[0].Job != "c.o" || progress[1].Job != "a.o" {
+		t.Fatalf("Expected an update for c.o then one for a.o, got %d updates", len(progress))
+	}
+	if progress[1].Message != "first\nsecond\n" {
+		t.Fatalf("Expected the messages for a.o to be kept, got '%s'", progress[1].Message)
+	}
+	if len(b.TakeProgress()) != 0 {
+		t.Fatal("Expected no more updates")
+	}
+
+	s.EndBuild(b.ID)
+	m.sendProgress(s, b, a, "")
+	if len(b.TakeProgress()) != 0 {
+		t.Fatal("Expected no updates for a build that is over")
+	}
+}
+
+func TestSlowBuilder(t *testing.T) {
+	m := testManager(t)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	bc := NewBuilderConnection(theirs, gob.NewDecoder(theirs), "", 1, "b1", m)
+	go bc.Sender()
+
+	//The builder doesn't read, sending to it still doesn't wait
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			bc.Send(&rmake.BuildCancelMessage{Build: i})
+		}
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Expected sending to the builder not to wait")
+	}
+
+	//Everything arrives in order once it reads
+	dec := gob.NewDecoder(ours)
+	for i := 0; i < 10; i++ {
+		var mes interface{}
+		if err := dec.Decode(&mes); err != nil {
+			t.Fatal(err)
+		}
+		if bcm, ok := mes.(*rmake.BuildCancelMessage); !ok || bcm.Build != i {
+			t.Fatalf("Expected the cancel message for build %d, got %v", i, mes)
+		}
+	}
+	bc.Close()
+	bc.Send(&rmake.BuildCancelMessage{})
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestBuilderHealth(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	bc := &BuilderConnection{conn: ours, Heartbeat: time.Second}
+
+	bc.Beat()
+	if _, changed := bc.CheckHealth(3); changed || bc.Health() != BuilderAlive {
+		t.Fatalf("Expected a builder that was just heard from to be alive, it is %s", bc.Health())
+	}
+
+	bc.lastBeat = time.Now().Add(-time.Second * 2)
+	missed, changed := bc.CheckHealth(3)
+	if missed != 1 || !changed || bc.Health() != BuilderSuspect {
+		t.Fatalf("Expected one missed heartbeat to make the builder suspect, got %d missed and %s", missed, bc.Health())
+	}
+
+	bc.Beat()
+	if _, changed := bc.CheckHealth(3); !changed || bc.Health() != BuilderAlive {
+		t.Fatalf("Expected the builder to be alive once heard from, it is %s", bc.Health())
+	}
+
+	bc.lastBeat = time.Now().Add(-time.Second * 4)
+	if missed, _ := bc.CheckHealth(3); missed != 3 || !bc.Dead() {
+		t.Fatalf("Expected 3 missed heartbeats to kill the builder, got %d missed and %s", missed, bc.Health())
+	}
+	if _, err := ours.Write([]byte{0}); err == nil {
+		t.Fatal("Expected the connection to a dead builder to be closed")
+	}
+}
+
+func TestPickBuilderSkipsSuspects(t *testing.T) {
+	m := &Manager{queue: NewBuilderQueue(), blobs: NewBlobStore(), Scheduler: new(JobCountScheduler)}
+	s := NewSession()
+	b := NewBuild(s)
+	j := &rmake.Job{Output: "a.o"}
+	idle := &BuilderConnection{Hostname: "idle", health: BuilderSuspect}
+	busy := &BuilderConnection{Hostname: "busy", NumJobs: 4}
+	gone := &BuilderConnection{Hostname: "gone", health: BuilderDead}
+	m.queue.Push(idle)
+	m.queue.Push(busy)
+	m.queue.Push(gone)
+
+	if bc := m.pickBuilder(s, b, j); bc != busy {
+		t.Fatalf("Expected the only healthy builder, got %v", bc)
+	}
+	m.queue.RemoveBuilder(busy)
+	if bc := m.pickBuilder(s, b, j); bc != nil {
+		t.Fatalf("Expected no builder to be picked, got '%s'", bc.Hostname)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	m := testManager(t)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	bc := NewBuilderConnection(theirs, gob.NewDecoder(theirs), "", 1, "b1", m)
+	m.bcLock.Lock()
+	m.bcMap[bc.UUID] = bc
+	m.bcLock.Unlock()
+	m.queue.Push(bc)
+	go bc.Sender()
+	go bc.Listener()
+	go bc.Pinger(time.Millisecond)
+
+	pinged := make(chan bool, 1)
+	go func() {
+		dec := gob.NewDecoder(ours)
+		for {
+			var mes interface{}
+			if dec.Decode(&mes) != nil {
+				return
+			}
+			select {
+			case pinged <- true:
+			default:
+			}
+		}
+	}()
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the builder to be pinged")
+	}
+
+	m.Shutdown()
+	if !bc.Dead() {
+		t.Fatal("Expected the connection to the builder to be closed")
+	}
+	//Give the pinger and listener time to notice, neither may panic
+	time.Sleep(time.Millisecond * 20)
+}
@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+// How long jobs took in earlier builds
+// Jobs are known by their output and expanded command line, so a job
+// whose command changed, like one given new flags, starts over.
+type JobHistory struct {
+	durations map[string]time.Duration
+	lock      sync.Mutex
+}
+
+func NewJobHistory() *JobHistory {
+	h := new(JobHistory)
+	h.durations = make(map[string]time.Duration)
+	return h
+}
+
+func historyKey(j *rmake.Job) string {
+	return j.Output + "\x00" + commandLine(j)
+}
+
+// Record how long a job ran for
+// Earlier runs are blended in, so a single slow run doesn't throw the
+// estimate off.
+func (h *JobHistory) Add(j *rmake.Job, d time.Duration) {
+	k := historyKey(j)
+	h.lock.Lock()
+	if old, ok := h.durations[k]; ok {
+		d = (old + d) / 2
+	}
+	h.durations[k] = d
+	h.lock.Unlock()
+}
+
+// How long a job is expected to run for, false if it never ran
+func (h *JobHistory) Get(j *rmake.Job) (time.Duration, bool) {
+	h.lock.Lock()
+	d, ok := h.durations[historyKey(j)]
+	h.lock.Unlock()
+	return d, ok
+}
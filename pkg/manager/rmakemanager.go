@@ -1,10 +1,12 @@
 package manager
 
 import (
-	"crypto/rand"
 	"encoding/gob"
-	"encoding/hex"
+	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"reflect"
 
@@ -17,12 +19,39 @@ type Manager struct {
 	getUuid  chan int
 	putUuid  chan int
 	bcMap    map[int]*BuilderConnection
+	bcLock   sync.Mutex
 	list     net.Listener
 	queue    *BuilderQueue
-	sessions map[string]chan interface{}
+	sessions map[string]*Session
+	sessLock sync.Mutex
+	blobs    *BlobStore
+	history  *JobHistory
+
+	//How long a session is kept after its last build
+	SessionTimeout time.Duration
+
+	//The highest compression level we will agree to
+	Compression int
+
+	//How many builders a job can be sent to, when the ones it was
+	//sent to are lost, before its build fails
+	MaxAttempts int
+
+	//The longest interval builders may send heartbeats at
+	HeartbeatInterval time.Duration
+	//How many heartbeats in a row a builder can miss before it is
+	//considered lost
+	MaxMissedBeats int
+
+	//Decides which builder each job goes to
+	Scheduler Scheduler
+	//The bytes per second files are assumed to cross the network at
+	Bandwidth int64
 
 	//Messages coming in to the manager
 	Incoming chan interface{}
+	//Closed once the manager is shut down
+	stopped chan struct{}
 }
 
 // Make a new manager
@@ -38,60 +67,68 @@ func NewManager(listname string) *Manager {
 	m.getUuid = make(chan int)
 	m.putUuid = make(chan int)
 	m.bcMap = make(map[int]*BuilderConnection)
-	m.sessions = make(map[string]chan interface{})
+	m.sessions = make(map[string]*Session)
+	m.blobs = NewBlobStore()
+	m.history = NewJobHistory()
 	m.queue = NewBuilderQueue()
 	m.list = list
 	m.Incoming = make(chan interface{})
+	m.stopped = make(chan struct{})
+	m.SessionTimeout = time.Hour * 24
+	m.Compression = rmake.CompressDefault
+	m.MaxAttempts = 3
+	m.HeartbeatInterval = rmake.DefaultHeartbeatInterval
+	m.MaxMissedBeats = 3
+	m.Scheduler = new(LoadScheduler)
+	m.Bandwidth = DefaultBandwidth
 	go m.UUIDGenerator()
 	go m.MessageListener()
+	go m.SessionReaper()
 	return m
 }
 
+//Stop handling messages and drop every builder
+//Incoming is left open, the listeners of the builders still send on it
+//when they notice their connection closing.
 func (m *Manager) Shutdown() {
-	close(m.Incoming)
-	for _,b := range m.queue.arr {
-		close(b.Outgoing)
+	close(m.stopped)
+	for _, b := range m.builders() {
+		//Killing the connection first stops its pinger
+		b.Kill()
+		b.Close()
 	}
 }
 
-func (m *Manager) SendToClient(session string, mes interface{}) {
-	ch, ok := m.sessions[session]
-	if ok {
-		ch <- mes
-	} else {
+func (m *Manager) SendToClient(session string, build int, mes interface{}) {
+	s := m.GetSession(session)
+	if s == nil {
 		log.Critical("Tried to send message to nonexistant client session!")
+		return
 	}
+	b := s.GetBuild(build)
+	if b == nil {
+		log.Critical("Tried to send message to nonexistant build!")
+		return
+	}
+	b.Client <- mes
 }
 
 //All incoming messages are synchronized here
 func (m *Manager) MessageListener() {
 	for {
-		mes := <-m.Incoming
+		var mes interface{}
+		select {
+		case mes = <-m.Incoming:
+		case <-m.stopped:
+			return
+		}
 		switch mes := mes.(type) {
-		case *rmake.BuildStatus:
-			log.Info("Build Status Update.")
-			log.Infof("Session: %d Completion: %f", mes.Session, mes.PercentComplete)
-		case *rmake.BuilderResult:
-			fbr := new(rmake.FinalBuildResult)
-			fbr.Results = mes.Results
-			fbr.Session = mes.Session
-			fbr.Success = true
-			m.SendToClient(mes.Session, fbr)
-
-		case *rmake.JobFinishedMessage:
-			log.Infof("Job finished for session: %s", mes.Session)
-			//TODO, update build info
-			bs := new(rmake.BuildStatus)
-			bs.Message = mes.Stdout
-			bs.Session = mes.Session
-			bs.PercentComplete = 0.5 //TODO: actually calculate this
-
-			m.SendToClient(mes.Session, bs)
-
-		case *rmake.BuilderStatusUpdate:
-			log.Info("Builder updated load")
+		case *builderMessage:
+			m.HandleBuilderMessage(mes.from, mes.message)
 		case *BuilderConnection:
-			m.queue.Remove(mes.Index)
+			m.HandleBuilderLost(mes)
+		case *buildStart:
+			m.dispatchReady(mes.session, mes.build)
 		default:
 			log.Warn("Unrecognized message type")
 			log.Warn(reflect.TypeOf(mes))
@@ -99,6 +136,52 @@ func (m *Manager) MessageListener() {
 	}
 }
 
+//Handle a message from a builder
+func (m *Manager) HandleBuilderMessage(from *BuilderConnection, mes interface{}) {
+	switch mes := mes.(type) {
+	case *rmake.BuildStatus:
+		log.Info("Build Status Update.")
+		log.Infof("Session: %d Completion: %f", mes.Session, mes.PercentComplete)
+	case *rmake.BuilderResult:
+		m.HandleBuilderResult(from, mes)
+
+	case *rmake.JobStartedMessage:
+		m.HandleJobStarted(from, mes)
+	case *rmake.JobFinishedMessage:
+		m.HandleJobFinished(from, mes)
+
+	case *rmake.BuilderStatusUpdate:
+		log.Info("Builder updated load")
+		m.HandleBuilderStatusUpdate(from, mes)
+	default:
+		log.Warn("Unrecognized message type")
+		log.Warn(reflect.TypeOf(mes))
+	}
+}
+
+//Periodically check every builder is still sending heartbeats
+//Builders that missed one are not sent jobs, and ones that missed
+//MaxMissedBeats are disconnected, which hands their jobs to others.
+func (m *Manager) HeartbeatMonitor() {
+	for {
+		time.Sleep(m.HeartbeatInterval / 2)
+		for _, bc := range m.queue.Builders() {
+			missed, changed := bc.CheckHealth(m.MaxMissedBeats)
+			if !changed {
+				continue
+			}
+			switch bc.Health() {
+			case BuilderAlive:
+				log.Infof("Heard from '%s' again", bc.Hostname)
+			case BuilderSuspect:
+				log.Warnf("'%s' missed %d heartbeats, not sending it jobs", bc.Hostname, missed)
+			case BuilderDead:
+				log.Warnf("'%s' missed %d heartbeats, dropping it", bc.Hostname, missed)
+			}
+		}
+	}
+}
+
 func (m *Manager) UUIDGenerator() {
 	var free []int
 	nextUuid := 0
@@ -120,144 +203,698 @@ func (m *Manager) UUIDGenerator() {
 	}
 }
 
-//Generates a random session string and registers it in the session map
-func (m *Manager) GetNewSession() string {
-	bytes := make([]byte, 16)
-	rand.Read(bytes)
-	session := hex.EncodeToString(bytes)
-	log.Infof("Made new session: %s\n", session)
-	m.sessions[session] = make(chan interface{})
-	return session
+//Creates a new session and registers it in the session map
+func (m *Manager) GetNewSession() *Session {
+	s := NewSession()
+	log.Infof("Made new session: %s\n", s.ID)
+	m.sessLock.Lock()
+	m.sessions[s.ID] = s
+	m.sessLock.Unlock()
+	return s
 }
 
-//When a session isstring complete, remove it from the session map
+//Look up an existing session, returns nil if there is no such session
+func (m *Manager) GetSession(id string) *Session {
+	m.sessLock.Lock()
+	s := m.sessions[id]
+	m.sessLock.Unlock()
+	return s
+}
+
+//When a session is no longer needed, remove it from the session map
+//and let the builders clean up its files
 func (m *Manager) ReleaseSession(session string) {
+	m.sessLock.Lock()
+	delete(m.sessions, session)
+	//Keep only the blobs some other session still refers to
+	live := make(map[string]bool)
+	for _, s := range m.sessions {
+		s.liveBlobs(live)
+	}
+	m.sessLock.Unlock()
+	m.blobs.Retain(live)
 
+	log.Infof("Releasing session: %s", session)
+	for _, b := range m.builders() {
+		b.Send(&rmake.SessionReleaseMessage{Session: session})
+	}
+}
+
+//Every builder that announced itself and hasn't been lost
+func (m *Manager) builders() []*BuilderConnection {
+	m.bcLock.Lock()
+	defer m.bcLock.Unlock()
+	var out []*BuilderConnection
+	for _, b := range m.bcMap {
+		out = append(out, b)
+	}
+	return out
+}
+
+//Periodically release sessions that haven't been used for a while
+func (m *Manager) SessionReaper() {
+	tick := time.NewTicker(time.Minute)
+	for range tick.C {
+		var expired []string
+		m.sessLock.Lock()
+		for id, s := range m.sessions {
+			s.lock.Lock()
+			if time.Since(s.LastUsed) > m.SessionTimeout {
+				expired = append(expired, id)
+			}
+			s.lock.Unlock()
+		}
+		m.sessLock.Unlock()
+
+		for _, id := range expired {
+			m.ReleaseSession(id)
+		}
+	}
 }
 
 // Allocate resources to the request
+// Jobs are sent to builders as soon as everything they depend on has
+// been built, see dispatchReady.
 //TODO: time this and other handlers for performance analytics
-/*Pseudocode for future implementation
-
-...
-//Start with
-assignJobs(finaljob)
-...
-
-func assignJobs(j job) {
-	j.sendTo(builders.GetNext())
-	j.assigned = true
-	for dep in j.deps {
-		if dep in filesfromclient {
-			continue
+func (m *Manager) HandleManagerRequest(request *rmake.BuildPackage, c net.Conn, dec *gob.Decoder) {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+
+	// Reuse the client's session if we still have it
+	var session *Session
+	if request.Session != "" {
+		session = m.GetSession(request.Session)
+	}
+	if session == nil {
+		session = m.GetNewSession()
+	}
+	session.SetManifest(request.Manifest)
+
+	comp, err := m.ReceiveBlobs(request, enc, dec)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	build := NewBuild(session)
+
+	//Work out which jobs make what the client asked for, and what
+	//those jobs need
+	returns, err := artifactJobs(request.Jobs, request.Artifacts())
+	if err == nil {
+		var roots []*rmake.DepTreeNode
+		roots, err = jobGraph(request, returns)
+		build.SetGraph(roots)
+	}
+	if err != nil {
+		log.Error(err)
+		session.EndBuild(build.ID)
+		var mes interface{}
+		mes = &rmake.FinalBuildResult{Session: session.ID, Error: err.Error()}
+		enc.Encode(&mes)
+		return
+	}
+	build.Artifacts = request.Artifacts()
+	build.Returning = len(returns)
+	build.Returns = returns
+	build.Vars = request.Vars
+	build.Prioritize(func(j *rmake.Job) (time.Duration, bool) {
+		return m.history.Get(j.Expand(request.Vars))
+	})
+
+	//Jobs are sent from here on as they become ready, including the
+	//ones that are ready right away
+	select {
+	case m.Incoming <- &buildStart{session, build}:
+	case <-m.stopped:
+		m.abortBuild(session, build, "The manager is shutting down")
+	}
+	go m.watchClient(session, build, dec)
+
+	// Reply to client until the build is over
+	for {
+		var mes interface{}
+		select {
+		case <-build.progressReady:
+		case mes = <-build.Client:
 		}
-		sub = jobsByOutput[dep]
-		if sub == nil {
-			panic("no such thing!")
+		//Progress goes out before the final result
+		err := m.sendQueuedProgress(build, enc)
+		if err == nil && mes != nil {
+			if fbr, ok := mes.(*rmake.FinalBuildResult); ok {
+				for _, f := range fbr.Results {
+					f.Compress(comp)
+				}
+			}
+			err = enc.Encode(&mes)
 		}
-		if !sub.assigned {
-			assignJobs(sub)
+		if err != nil {
+			log.Warn(err)
+			//Nobody reads the build's messages from here on, so the
+			//final result of aborting it must not wait for that
+			close(build.gone)
+			m.abortBuild(session, build, "The client went away")
+			return
+		}
+		if _, done := mes.(*rmake.FinalBuildResult); done {
+			close(build.gone)
+			return
+		}
+	}
+}
+
+//Write out the status updates queued for the client of a build
+func (m *Manager) sendQueuedProgress(b *Build, enc *gob.Encoder) error {
+	for _, bs := range b.TakeProgress() {
+		var mes interface{} = bs
+		if err := enc.Encode(&mes); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-This will ensure that the build dependency heirarchy is satisfied
-*/
-func (m *Manager) HandleManagerRequest(request *rmake.BuildPackage, c net.Conn) {
-	// handle the request
-	session := m.GetNewSession()
+//Cancel the build when the client asks to, or its connection drops
+func (m *Manager) watchClient(s *Session, b *Build, dec *gob.Decoder) {
+	var mes interface{}
+	err := dec.Decode(&mes)
+	if b.Over() {
+		return
+	}
+	reason := "The build was cancelled"
+	if err != nil {
+		log.Warnf("Lost the client of build %d of session '%s': %s", b.ID, s.ID, err)
+		reason = "The client went away"
+	} else if _, ok := mes.(*rmake.BuildCancelMessage); !ok {
+		log.Warnf("Unexpected message from client: %s", reflect.TypeOf(mes))
+	}
+	m.abortBuild(s, b, reason)
+}
 
-	//Take the freest node as the final node
-	final := m.queue.Pop()
-	final.NumJobs++
-	m.queue.Push(final)
+//Find the jobs making each of the requested artifacts
+//Returns the outputs each of those jobs has to send back. An artifact
+//is either an output of some job, or a directory that outputs are in.
+func artifactJobs(jobs []*rmake.Job, artifacts []string) (map[*rmake.Job][]string, error) {
+	returns := make(map[*rmake.Job][]string)
+	for _, a := range artifacts {
+		found := false
+		for _, j := range jobs {
+			for _, o := range j.OutputFiles() {
+				if !rmake.InArtifact(o, a) {
+					continue
+				}
+				found = true
+				dup := false
+				for _, r := range returns[j] {
+					dup = dup || r == o
+				}
+				if !dup {
+					returns[j] = append(returns[j], o)
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No job makes '%s'", a)
+		}
+	}
+	return returns, nil
+}
 
-	//Find the 'final' job in our list
-	var finaljob *rmake.Job
+//Resolve the jobs making the artifacts, and everything they depend on
+func jobGraph(request *rmake.BuildPackage, returns map[*rmake.Job][]string) ([]*rmake.DepTreeNode, error) {
+	files := make(map[string]bool)
+	for _, e := range request.Manifest {
+		files[e.Path] = true
+	}
+	g := rmake.NewDepGraph(request.Jobs, files)
+	var roots []*rmake.DepTreeNode
 	for _, j := range request.Jobs {
-		if request.Output == j.Output {
-			finaljob = j
+		if _, ok := returns[j]; !ok {
+			continue
 		}
+		n, err := g.Resolve(j.Output)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, n)
 	}
-	if finaljob == nil {
-		log.Error("I have no idea what to do.")
-		//TODO: Determine how to handle this case
-		panic("confusion?!")
+	return roots, nil
+}
+
+//Asks the message listener to send out the first jobs of a build
+//Jobs are only ever handed to builders from the message listener, so
+//that a builder can't be given a job after it was found to be lost.
+type buildStart struct {
+	session *Session
+	build   *Build
+}
+
+//Send every job of a build that can run now to a builder
+func (m *Manager) dispatchReady(s *Session, b *Build) {
+	for _, j := range b.TakeReady() {
+		err := m.dispatch(s, b, j)
+		if err != nil {
+			log.Error(err)
+			m.failBuild(s, b, err.Error(), nil, "")
+			return
+		}
+	}
+}
+
+//Send a job to the least busy builder
+//The outputs of other jobs it needs are forwarded to that builder by
+//the builders that made them.
+func (m *Manager) dispatch(s *Session, b *Build, j *rmake.Job) error {
+	builder := m.pickBuilder(s, b, j)
+	if builder == nil {
+		return fmt.Errorf("No builders are available to run the job for '%s'", j.Output)
 	}
+	b.Assign(j, builder)
+
 	br := new(rmake.BuilderRequest)
-	br.BuildJob = finaljob
-	br.Session = session         //TODO: method of creating and tracking sessions?
-	br.ResultAddress = "manager" //Key string, recognized by builder
-
-	for _, dep := range finaljob.Deps {
-		depfi, ok := request.Files[dep]
-		if !ok {
-			log.Infof("final builder will need to wait on %s\n", dep)
-			br.Wait = append(br.Wait, dep)
-		} else {
-			br.Input = append(br.Input, depfi)
+	br.BuildJob = j
+	br.Session = s.ID
+	br.Build = b.ID
+	br.Vars = b.Vars
+	br.Return = b.Returns[j]
+	br.Priority = b.Priority(j)
+	br.Input, br.Wait = m.jobInputs(s, j)
+
+	forwards := make(map[*BuilderConnection][]string)
+	for _, w := range br.Wait {
+		from := b.Location(w)
+		if from == nil {
+			return fmt.Errorf("Nothing made '%s', needed by the job for '%s'", w, j.Output)
+		}
+		if from != builder {
+			forwards[from] = append(forwards[from], w)
 		}
 	}
 
-	log.Infof("Sending job to '%s'\n", final.ListenerAddr)
-	final.Outgoing <- br
+	log.Infof("Sending job for '%s' to '%s'", j.Output, builder.Hostname)
+	builder.Send(br)
+	for from, files := range forwards {
+		b.Forwarded(files, builder)
+		log.Infof("'%s' forwards %v to '%s'", from.Hostname, files, builder.Hostname)
+		from.Send(&rmake.FileForwardMessage{
+			Session: s.ID,
+			Build:   b.ID,
+			Files:   files,
+			Address: builder.ListenerAddr,
+		})
+	}
+	m.sendProgress(s, b, j, "")
+	return nil
+}
 
-	//assign each job to a builder
-	for _, j := range request.Jobs {
-		if j == finaljob {
+//Have the scheduler pick a builder for a job, out of the builders that
+//are keeping up their heartbeats
+//Builders whose queue is full are left out, unless they all are, then
+//the job waits on a builder until there is room. Returns nil when there
+//is none.
+func (m *Manager) pickBuilder(s *Session, b *Build, j *rmake.Job) *BuilderConnection {
+	p := &Placement{Job: j, Build: b, Bandwidth: m.Bandwidth}
+	var full []*BuilderConnection
+	for _, bc := range m.queue.Builders() {
+		if bc.Health() != BuilderAlive {
 			continue
 		}
-		br := new(rmake.BuilderRequest)
-		br.BuildJob = j
+		if bc.Load().Full {
+			full = append(full, bc)
+		} else {
+			p.Builders = append(p.Builders, bc)
+		}
+	}
+	if len(p.Builders) == 0 {
+		p.Builders = full
+	}
+	if len(p.Builders) == 0 {
+		return nil
+	}
+	p.Transfer = m.transferSizes(s, b, j, p.Builders)
+	return m.Scheduler.Pick(p)
+}
 
-		br.Session = session
-		br.ResultAddress = final.ListenerAddr
-		log.Infof("job gets sent to: %s", br.ResultAddress)
+//How many bytes of its inputs each builder would have to be sent to
+//run a job
+//Sources count unless the builder was already sent their contents, and
+//outputs of other jobs unless it made them or was sent them.
+func (m *Manager) transferSizes(s *Session, b *Build, j *rmake.Job, builders []*BuilderConnection) map[*BuilderConnection]int64 {
+	inputs, wait := m.jobInputs(s, j)
+	out := make(map[*BuilderConnection]int64)
+	for _, bc := range builders {
+		var n int64
+		for _, e := range inputs {
+			if !bc.HasBlob(e.Hash) {
+				n += m.blobs.Size(e.Hash)
+			}
+		}
+		for _, w := range wait {
+			if !b.Holds(w, bc) {
+				n += b.Size(w)
+			}
+		}
+		out[bc] = n
+	}
+	return out
+}
 
-		for _, dep := range j.Deps {
-			depfi, ok := request.Files[dep]
-			if !ok {
-				log.Infof("Builder will need to wait on %s\n", dep)
-				br.Wait = append(br.Wait, dep)
-			} else {
-				br.Input = append(br.Input, depfi)
+//Handle a builder finishing a job
+//Jobs waiting on it are dispatched, or the build fails with it.
+func (m *Manager) HandleJobFinished(from *BuilderConnection, mes *rmake.JobFinishedMessage) {
+	log.Infof("Job finished for session: %s", mes.Session)
+	s, b := m.findBuild(mes.Session, mes.Build)
+	if b == nil || !m.sentBy(from, b, mes.Output) {
+		return
+	}
+
+	var j *rmake.Job
+	if mes.Success {
+		b.AddSizes(mes.OutputSizes)
+		j = b.Finish(mes.Output, mes.Duration)
+		if j != nil {
+			m.history.Add(j.Expand(b.Vars), mes.Duration)
+		}
+	} else {
+		j = b.Fail(mes.Output, mes.Duration)
+	}
+	if j == nil {
+		log.Warnf("Unexpected job '%s' finished", mes.Output)
+		return
+	}
+	from.JobDone(mes.Duration)
+	if r := b.Record(mes.Output); r != nil && !r.Started.IsZero() {
+		log.Infof("'%s' waited %s and ran for %s", mes.Output, r.Started.Sub(r.Queued), mes.Duration)
+	}
+	m.sendProgress(s, b, j, mes.Stdout)
+
+	if !mes.Success {
+		m.failBuild(s, b, fmt.Sprintf("The job for '%s' failed: %s", mes.Output, mes.Error), j, mes.Stdout)
+		return
+	}
+	m.forwardToSent(s, b, j)
+	m.dispatchReady(s, b)
+}
+
+//Send the outputs of a job that ran again to the jobs that were
+//already waiting for them on other builders
+func (m *Manager) forwardToSent(s *Session, b *Build, j *rmake.Job) {
+	from := b.AssignedTo(j)
+	for _, d := range b.SentDependents(j) {
+		to := b.AssignedTo(d)
+		if to == from {
+			continue
+		}
+		var files []string
+		for _, o := range j.OutputFiles() {
+			for _, dep := range d.Deps {
+				if dep == o {
+					files = append(files, o)
+				}
+			}
+		}
+		log.Infof("'%s' forwards %v to '%s'", from.Hostname, files, to.Hostname)
+		b.Forwarded(files, to)
+		from.Send(&rmake.FileForwardMessage{
+			Session: s.ID,
+			Build:   b.ID,
+			Files:   files,
+			Address: to.ListenerAddr,
+		})
+	}
+}
+
+//Handle the connection to a builder being lost
+//Its jobs, and the jobs whose outputs only it had, are sent to other
+//builders. A build fails once one of its jobs was lost MaxAttempts times.
+func (m *Manager) HandleBuilderLost(bc *BuilderConnection) {
+	log.Warnf("Lost builder '%s'", bc.Hostname)
+	m.queue.RemoveBuilder(bc)
+	m.bcLock.Lock()
+	delete(m.bcMap, bc.UUID)
+	m.bcLock.Unlock()
+
+	for _, sb := range m.activeBuilds() {
+		s, b := sb.session, sb.build
+		lost := b.Lose(bc)
+		if len(lost) == 0 {
+			continue
+		}
+		log.Infof("Build %d of session '%s' lost %d jobs", b.ID, s.ID, len(lost))
+		failed := false
+		for _, j := range lost {
+			r := b.Record(j.Output)
+			if r.Attempts >= m.MaxAttempts {
+				reason := fmt.Sprintf("The job for '%s' was lost on %d builders", j.Output, r.Attempts)
+				m.failBuild(s, b, reason, nil, "")
+				failed = true
+				break
 			}
+			m.sendProgress(s, b, j, fmt.Sprintf("Lost the builder '%s', the job will be sent to another\n", bc.Hostname))
+		}
+		if !failed {
+			m.dispatchReady(s, b)
 		}
+	}
+}
 
-		builder := m.queue.Pop()
-		if builder == final {
-			br.ResultAddress = ""
+//Every build that is still running, in every session
+func (m *Manager) activeBuilds() []*buildStart {
+	var out []*buildStart
+	m.sessLock.Lock()
+	for _, s := range m.sessions {
+		s.lock.Lock()
+		for _, b := range s.Builds {
+			out = append(out, &buildStart{s, b})
 		}
-		log.Infof("Sending job to '%s'\n", builder.Hostname)
-		builder.Outgoing <- br
-		builder.NumJobs++
-		m.queue.Push(builder)
+		s.lock.Unlock()
 	}
+	m.sessLock.Unlock()
+	return out
+}
 
-	// Reply to client
-	enc := gob.NewEncoder(c)
-	for {
-		mes := <-m.sessions[session]
-		err := enc.Encode(&mes)
+//Handle a builder starting on a job
+func (m *Manager) HandleJobStarted(from *BuilderConnection, mes *rmake.JobStartedMessage) {
+	s, b := m.findBuild(mes.Session, mes.Build)
+	if b == nil || !m.sentBy(from, b, mes.Output) {
+		return
+	}
+	if j := b.Start(mes.Output); j != nil {
+		m.sendProgress(s, b, j, "")
+	}
+}
+
+//Whether a message about the job making output comes from the builder
+//the job was sent to
+//A builder that was dropped for missing heartbeats may still report
+//on jobs that have since been sent to another.
+func (m *Manager) sentBy(from *BuilderConnection, b *Build, output string) bool {
+	j := b.Job(output)
+	if j != nil && b.AssignedTo(j) != from {
+		log.Warnf("Ignoring '%s' reporting on the job for '%s', it was sent elsewhere", from.Hostname, output)
+		return false
+	}
+	return true
+}
+
+//Look up the build a message from a builder is about
+//Returns a nil build for builds that are already over.
+func (m *Manager) findBuild(session string, build int) (*Session, *Build) {
+	s := m.GetSession(session)
+	if s == nil {
+		return nil, nil
+	}
+	b := s.GetBuild(build)
+	if b == nil {
+		log.Warnf("Message for finished build %d of session '%s'", build, session)
+	}
+	return s, b
+}
+
+//Tell the client about a job of a build
+//The update is queued, so a slow client never holds up the manager.
+//Updates for a build that is over are dropped, nobody is waiting for
+//them anymore.
+func (m *Manager) sendProgress(s *Session, b *Build, j *rmake.Job, message string) {
+	if b.Over() {
+		return
+	}
+	bs := b.Status(j)
+	bs.Message = message
+	b.QueueProgress(bs)
+}
+
+//End a build, telling the client why it failed
+//Builders with jobs of the build are told to stop working on it. The
+//failed job is nil when the build didn't fail because of a job.
+func (m *Manager) failBuild(s *Session, b *Build, reason string, failed *rmake.Job, stdout string) {
+	if !s.EndBuild(b.ID) {
+		return
+	}
+	m.cancelBuild(s, b, false)
+
+	fbr := new(rmake.FinalBuildResult)
+	fbr.Session = s.ID
+	fbr.Success = false
+	fbr.Error = reason
+	fbr.Stdout = stdout
+	if failed != nil {
+		fbr.FailedJob = failed.Output
+		fbr.Command = commandLine(failed.Expand(b.Vars))
+	}
+	m.sendResult(s, b, fbr)
+}
+
+//Stop a build the client doesn't want anymore
+//Builders also remove the work directory of the session.
+func (m *Manager) abortBuild(s *Session, b *Build, reason string) {
+	if !s.EndBuild(b.ID) {
+		return
+	}
+	log.Infof("Aborting build %d of session '%s': %s", b.ID, s.ID, reason)
+	m.cancelBuild(s, b, true)
+	m.sendResult(s, b, &rmake.FinalBuildResult{Session: s.ID, Error: reason})
+}
+
+//Tell every builder that was given a job of the build to drop it
+func (m *Manager) cancelBuild(s *Session, b *Build, clean bool) {
+	for _, bc := range b.Builders() {
+		log.Infof("Cancelling build %d of session '%s' on '%s'", b.ID, s.ID, bc.Hostname)
+		bc.Send(&rmake.BuildCancelMessage{Session: s.ID, Build: b.ID, Clean: clean})
+	}
+}
+
+//Send the final result of a build to its client, if it is still there
+func (m *Manager) sendResult(s *Session, b *Build, fbr *rmake.FinalBuildResult) {
+	select {
+	case b.Client <- fbr:
+	case <-b.gone:
+		log.Warnf("No client to send the result of build %d of session '%s' to", b.ID, s.ID)
+	}
+}
+
+//A job's command line, quoted for a shell where needed
+func commandLine(j *rmake.Job) string {
+	words := []string{j.Command}
+	for _, a := range j.Args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`|&;<>()*?[]#~") {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		words = append(words, a)
+	}
+	return strings.Join(words, " ")
+}
+
+//Collect artifacts sent back by a builder
+//Once every job with artifacts has reported, the client gets them all.
+func (m *Manager) HandleBuilderResult(from *BuilderConnection, mes *rmake.BuilderResult) {
+	for _, f := range mes.Results {
+		err := f.Decompress()
 		if err != nil {
-			log.Warn(err)
-			return
+			log.Error(err)
 		}
 	}
+	s := m.GetSession(mes.Session)
+	if s == nil {
+		log.Warnf("Result for unknown session '%s'", mes.Session)
+		return
+	}
+	b := s.GetBuild(mes.Build)
+	if b == nil {
+		log.Warnf("Result for unknown build %d of session '%s'", mes.Build, mes.Session)
+		return
+	}
+	if !m.sentBy(from, b, mes.Output) {
+		return
+	}
+	if !b.AddResults(mes.Output, mes.Results) || !s.EndBuild(b.ID) {
+		return
+	}
+
+	fbr := new(rmake.FinalBuildResult)
+	fbr.Results = b.Results
+	fbr.Session = mes.Session
+	fbr.Success = true
+	if missing := b.MissingArtifacts(); len(missing) > 0 {
+		fbr.Success = false
+		fbr.Error = fmt.Sprintf("Nothing was built for %s", strings.Join(missing, ", "))
+	}
+	m.sendResult(s, b, fbr)
+}
+
+//Ask the client for the contents of every file we don't have yet
+//Returns the compression agreed on for the rest of the connection.
+func (m *Manager) ReceiveBlobs(request *rmake.BuildPackage, enc *gob.Encoder, dec *gob.Decoder) (*rmake.Compression, error) {
+	var hashes []string
+	for _, e := range request.Manifest {
+		hashes = append(hashes, e.Hash)
+	}
+	comp := request.Compression.Negotiate(m.Compression)
+	log.Infof("Using compression %s with client", comp)
+	var mes interface{}
+	mes = &rmake.BlobRequest{Hashes: m.blobs.Missing(hashes), Compression: comp}
+	err := enc.Encode(&mes)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply interface{}
+	err = dec.Decode(&reply)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(*rmake.BlobData)
+	if !ok {
+		return nil, fmt.Errorf("Expected blob data from client, got %s", reflect.TypeOf(reply))
+	}
+	log.Infof("Received %d of %d files from client", len(data.Blobs), len(hashes))
+	for _, b := range data.Blobs {
+		err := m.blobs.Put(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return comp, nil
+}
+
+//Work out which of a job's dependencies are source files and which it
+//has to wait on another job for
+func (m *Manager) jobInputs(s *Session, j *rmake.Job) ([]*rmake.ManifestEntry, []string) {
+	var srcs []*rmake.ManifestEntry
+	var wait []string
+	for _, dep := range j.Deps {
+		if e, ok := s.GetEntry(dep); ok {
+			srcs = append(srcs, e)
+		} else {
+			log.Infof("Builder will need to wait on %s\n", dep)
+			wait = append(wait, dep)
+		}
+	}
+	return srcs, wait
 }
 
 // Handles a builder announcement
-func (m *Manager) HandleBuilderAnnouncement(bldr *rmake.BuilderAnnouncement, con net.Conn) {
+// The decoder that read the announcement has to be kept, it knows the
+// types the builder has already described.
+func (m *Manager) HandleBuilderAnnouncement(bldr *rmake.BuilderAnnouncement, con net.Conn, dec *gob.Decoder) {
 	log.Info("Handling announcement")
 	var ack *rmake.ManagerAcknowledge
 	// Make the new builder connection
 	errored := false
 	uuid := <-m.getUuid
-	bc := NewBuilderConnection(con, bldr.ListenerAddr, uuid, bldr.Hostname, m)
+	bc := NewBuilderConnection(con, dec, bldr.ListenerAddr, uuid, bldr.Hostname, m)
 	if bldr.ProtocolVersion == rmake.ProtocolVersion {
 		// Looks good, add to map and send back success
 		ack = rmake.NewManagerAcknowledgeSuccess(uuid)
+		bc.Compression = bldr.Compression.Negotiate(m.Compression)
+		ack.Compression = bc.Compression
+		log.Infof("Using compression %s with '%s'", bc.Compression, bldr.Hostname)
+		bc.Procs = bldr.Procs
+		bc.Heartbeat = rmake.NegotiateHeartbeat(bldr.HeartbeatInterval, m.HeartbeatInterval)
+		ack.HeartbeatInterval = bc.Heartbeat
+		log.Infof("'%s' sends heartbeats every %s", bldr.Hostname, bc.Heartbeat)
+		m.bcLock.Lock()
 		m.bcMap[uuid] = bc
+		m.bcLock.Unlock()
 	} else {
 		// Mismatch send failure
 		ack = rmake.NewManagerAcknowledgeFailure("Error, protocol version mismatch")
@@ -279,24 +916,15 @@ func (m *Manager) HandleBuilderAnnouncement(bldr *rmake.BuilderAnnouncement, con
 	}
 	go bc.Sender()
 	go bc.Listener()
+	go bc.Pinger(bc.Heartbeat)
 
 	//TODO: potential race condition here
 	m.queue.Push(bc)
 }
 
 func (m *Manager) HandleBuilderStatusUpdate(b *BuilderConnection, bsu *rmake.BuilderStatusUpdate) {
-	//Get current heuristic
-	cur := b.H()
-
-	//Update values
-	b.NumJobs = bsu.QueuedJobs
-	//...
-
-	if b.H() > cur {
-		m.queue.PercDown(b.Index)
-	} else if b.H() < cur {
-		m.queue.PercUp(b.Index)
-	}
+	//The scheduler looks at it next time a job is sent out
+	b.SetStatus(bsu)
 }
 
 // goroutine to handle a new connection from a client.
@@ -316,9 +944,9 @@ func (m *Manager) HandleConnection(c net.Conn) {
 	switch message := gobint.(type) {
 	case *rmake.BuildPackage:
 		log.Info("Manager Request")
-		m.HandleManagerRequest(message, c)
+		m.HandleManagerRequest(message, c, dec)
 	case *rmake.BuilderAnnouncement:
-		m.HandleBuilderAnnouncement(message, c)
+		m.HandleBuilderAnnouncement(message, c, dec)
 		//return
 	default:
 		log.Info(reflect.TypeOf(message))
@@ -327,6 +955,7 @@ func (m *Manager) HandleConnection(c net.Conn) {
 }
 
 func (m *Manager) Start() {
+	go m.HeartbeatMonitor()
 	//Accept and handle new client connections
 	for {
 		con, err := m.list.Accept()
@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+// Decides which builder runs a job
+type Scheduler interface {
+	// Pick the builder to send a job to, out of builders that are all
+	// keeping up their heartbeats
+	// Returns nil to leave the job unsent.
+	Pick(p *Placement) *BuilderConnection
+}
+
+// A job looking for a builder
+type Placement struct {
+	Job   *rmake.Job
+	Build *Build
+	// The builders the job can go to, never empty
+	Builders []*BuilderConnection
+	// The bytes of its inputs each builder would have to be sent
+	Transfer map[*BuilderConnection]int64
+	// The bytes per second they are assumed to be sent at
+	Bandwidth int64
+}
+
+// The bytes per second files are assumed to cross the network at,
+// about what a 100Mbit link manages
+const DefaultBandwidth = 12 * 1000 * 1000
+
+// How long sending a builder the inputs it lacks would take
+func (p *Placement) TransferTime(bc *BuilderConnection) time.Duration {
+	if p.Bandwidth <= 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Transfer[bc]) / float64(p.Bandwidth) * float64(time.Second))
+}
+
+// Schedulers by the name rmakemanager's -scheduler flag takes
+var Schedulers = map[string]func() Scheduler{
+	"jobs": func() Scheduler { return new(JobCountScheduler) },
+	"load": func() Scheduler { return new(LoadScheduler) },
+}
+
+// Make the scheduler with the given name
+func NewScheduler(name string) (Scheduler, error) {
+	mk, ok := Schedulers[name]
+	if !ok {
+		var names []string
+		for n := range Schedulers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown scheduler '%s', use one of %s", name, strings.Join(names, ", "))
+	}
+	return mk(), nil
+}
+
+// Sends jobs to the builder with the fewest unfinished jobs
+type JobCountScheduler struct{}
+
+func (s *JobCountScheduler) Pick(p *Placement) *BuilderConnection {
+	var best *BuilderConnection
+	min := 0
+	for _, bc := range p.Builders {
+		if n := bc.Load().Jobs; best == nil || n < min {
+			best, min = bc, n
+		}
+	}
+	return best
+}
+
+// How long a job is assumed to take on a builder that hasn't finished
+// one yet
+const DefaultJobTime = time.Second
+
+// Sends jobs to the builder expected to finish them first
+// The estimate weighs the jobs already waiting against how many the
+// builder runs at once and how fast it got through earlier ones, slowed
+// down by other work on the machine and by the time to reach it. The
+// time to send it the inputs it doesn't have is added, so jobs that need
+// the outputs of many others, like a link, go where most of them are
+// unless that builder is much busier.
+type LoadScheduler struct{}
+
+func (s *LoadScheduler) Pick(p *Placement) *BuilderConnection {
+	var best *BuilderConnection
+	var bestLoad BuilderLoad
+	var min time.Duration
+	for _, bc := range p.Builders {
+		l := bc.Load()
+		est := l.Estimate() + p.TransferTime(bc)
+		if best == nil || est < min || (est == min && l.Jobs < bestLoad.Jobs) {
+			best, bestLoad, min = bc, l, est
+		}
+	}
+	return best
+}
+
+// How long until a job sent now would be done
+func (l BuilderLoad) Estimate() time.Duration {
+	procs := l.Procs
+	if procs < 1 {
+		procs = 1
+	}
+	jobTime := l.JobTime
+	if jobTime <= 0 {
+		jobTime = DefaultJobTime
+	}
+	//Every thread works through its share of the jobs ahead, by our
+	//count or the builder's own if it is further behind
+	ahead := l.Jobs
+	if l.Queued+l.Running > ahead {
+		ahead = l.Queued + l.Running
+	}
+	rounds := ahead/procs + 1
+	est := float64(jobTime) * float64(rounds)
+
+	//Other work on the machine slows the job down, and running out of
+	//memory even more so
+	est *= 1 + float64(l.CPULoad)
+	if l.MemUse > 0.9 {
+		est *= 2
+	}
+	//The job has to be sent, and its outputs come back
+	return time.Duration(est) + 2*l.Latency
+}
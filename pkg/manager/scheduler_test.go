@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func TestLoadScheduler(t *testing.T) {
+	pick := func(builders ...*BuilderConnection) string {
+		return new(LoadScheduler).Pick(&Placement{Builders: builders}).Hostname
+	}
+
+	small := &BuilderConnection{Hostname: "small", Procs: 1, NumJobs: 2}
+	big := &BuilderConnection{Hostname: "big", Procs: 8, NumJobs: 4}
+	if got := pick(small, big); got != "big" {
+		t.Fatalf("Expected the builder with threads to spare, got '%s'", got)
+	}
+
+	fast := &BuilderConnection{Hostname: "fast", Procs: 2, NumJobs: 2, jobTime: time.Second}
+	slow := &BuilderConnection{Hostname: "slow", Procs: 2, jobTime: time.Second * 10}
+	if got := pick(slow, fast); got != "fast" {
+		t.Fatalf("Expected the builder that gets through jobs quicker, got '%s'", got)
+	}
+
+	near := &BuilderConnection{Hostname: "near", Procs: 2}
+	far := &BuilderConnection{Hostname: "far", Procs: 2, latency: time.Second}
+	if got := pick(far, near); got != "near" {
+		t.Fatalf("Expected the builder closer by, got '%s'", got)
+	}
+
+	swapping := &BuilderConnection{Hostname: "swapping", Procs: 4}
+	swapping.status.MemUse = 0.95
+	busy := &BuilderConnection{Hostname: "busy", Procs: 4}
+	busy.status.CPULoad = 0.5
+	if got := pick(swapping, busy); got != "busy" {
+		t.Fatalf("Expected the builder that has memory left, got '%s'", got)
+	}
+}
+
+func TestBuilderJobCount(t *testing.T) {
+	a := &rmake.Job{Output: "a.o", Deps: []string{"a.c"}}
+	c := &rmake.Job{Output: "c.o", Deps: []string{"c.c"}}
+	bp := &rmake.BuildPackage{
+		Output:   "a.o",
+		Outputs:  []string{"c.o"},
+		Jobs:     []*rmake.Job{a, c},
+		Manifest: []*rmake.ManifestEntry{{Path: "a.c"}, {Path: "c.c"}},
+	}
+	s := NewSession()
+	b := testBuild(t, s, bp)
+
+	bc := new(BuilderConnection)
+	for _, j := range b.TakeReady() {
+		b.Assign(j, bc)
+	}
+	if bc.Load().Jobs != 2 {
+		t.Fatalf("Expected 2 jobs on the builder, got %d", bc.Load().Jobs)
+	}
+	b.Finish("a.o", time.Second)
+	if bc.Load().Jobs != 1 {
+		t.Fatalf("Expected a finished job to be taken off the builder, got %d", bc.Load().Jobs)
+	}
+	s.EndBuild(b.ID)
+	if bc.Load().Jobs != 0 {
+		t.Fatalf("Expected the jobs of a build that ended to be taken off the builder, got %d", bc.Load().Jobs)
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	if _, err := NewScheduler("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewScheduler("random"); err == nil {
+		t.Fatal("Expected an unknown scheduler to be refused")
+	}
+}
+
+func TestLoadSchedulerLocality(t *testing.T) {
+	m := &Manager{blobs: NewBlobStore()}
+	s := NewSession()
+	s.SetManifest([]*rmake.ManifestEntry{{Path: "main.c", Hash: "c0ffee"}})
+	m.blobs.blobs["c0ffee"] = make([]byte, 1000)
+
+	b := NewBuild(s)
+	b.AddSizes(map[string]int64{"a.o": 40 * 1000 * 1000, "b.o": 2 * 1000 * 1000})
+	link := &rmake.Job{Output: "prog", Deps: []string{"a.o", "b.o", "main.c"}}
+
+	holder := &BuilderConnection{Hostname: "holder", Procs: 2, NumJobs: 1}
+	other := &BuilderConnection{Hostname: "other", Procs: 2}
+	other.SentBlob("c0ffee")
+	b.Forwarded([]string{"a.o"}, holder)
+	b.Forwarded([]string{"b.o"}, other)
+
+	builders := []*BuilderConnection{other, holder}
+	sizes := m.transferSizes(s, b, link, builders)
+	if sizes[holder] != 2*1000*1000+1000 || sizes[other] != 40*1000*1000 {
+		t.Fatalf("Expected holder to need b.o and main.c and other a.o, got %d and %d", sizes[holder], sizes[other])
+	}
+
+	p := &Placement{Job: link, Build: b, Builders: builders, Transfer: sizes, Bandwidth: DefaultBandwidth}
+	if got := new(LoadScheduler).Pick(p); got != holder {
+		t.Fatalf("Expected the link to go where most of its inputs are, got '%s'", got.Hostname)
+	}
+	//Unless that builder is much busier
+	holder.AddJobs(20)
+	if got := new(LoadScheduler).Pick(p); got != other {
+		t.Fatalf("Expected the link to go to the idle builder, got '%s'", got.Hostname)
+	}
+}
+
+func TestPickBuilderAvoidsFullQueues(t *testing.T) {
+	m := &Manager{queue: NewBuilderQueue(), blobs: NewBlobStore(), Scheduler: new(JobCountScheduler)}
+	s := NewSession()
+	b := NewBuild(s)
+	j := &rmake.Job{Output: "a.o"}
+	full := &BuilderConnection{Hostname: "full"}
+	full.SetStatus(&rmake.BuilderStatusUpdate{QueuedJobs: 8, QueueFull: true})
+	busy := &BuilderConnection{Hostname: "busy", NumJobs: 4}
+	m.queue.Push(full)
+	m.queue.Push(busy)
+
+	if bc := m.pickBuilder(s, b, j); bc != busy {
+		t.Fatalf("Expected the builder with room, got %v", bc)
+	}
+	//With nowhere else to go the job waits on a full builder
+	m.queue.RemoveBuilder(busy)
+	if bc := m.pickBuilder(s, b, j); bc != full {
+		t.Fatalf("Expected the full builder, got %v", bc)
+	}
+}
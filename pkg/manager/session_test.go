@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"encoding/gob"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/rmake/pkg/types"
+)
+
+func testManager(t *testing.T) *Manager {
+	m := NewManager("127.0.0.1:0")
+	t.Cleanup(func() { m.list.Close() })
+	return m
+}
+
+//Run a client's side of a build request, sending the contents of the
+//files the manager asks for
+//Nothing makes the requested output, so the build fails right after
+//the upload, telling the client its session.
+func requestBuild(t *testing.T, m *Manager, session string, files map[string]string) (*rmake.BlobRequest, *rmake.FinalBuildResult) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go m.HandleConnection(theirs)
+	enc := gob.NewEncoder(ours)
+	dec := gob.NewDecoder(ours)
+
+	byHash := make(map[string][]byte)
+	pkg := &rmake.BuildPackage{Output: "prog", Session: session}
+	for p, cnt := range files {
+		h := rmake.Hash([]byte(cnt))
+		byHash[h] = []byte(cnt)
+		pkg.Manifest = append(pkg.Manifest, &rmake.ManifestEntry{Path: p, Hash: h})
+	}
+	var mes interface{} = pkg
+	if err := enc.Encode(&mes); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply interface{}
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	req, ok := reply.(*rmake.BlobRequest)
+	if !ok {
+		t.Fatalf("Expected a blob request, got %s", reflect.TypeOf(reply))
+	}
+	data := new(rmake.BlobData)
+	for _, h := range req.Hashes {
+		data.Blobs = append(data.Blobs, rmake.NewBlob(byHash[h]))
+	}
+	mes = data
+	if err := enc.Encode(&mes); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	fbr, ok := reply.(*rmake.FinalBuildResult)
+	if !ok {
+		t.Fatalf("Expected the final build result, got %s", reflect.TypeOf(reply))
+	}
+	return req, fbr
+}
+
+func TestSessionReuse(t *testing.T) {
+	m := testManager(t)
+	files := map[string]string{"main.c": "int main;", "f.c": "int f;"}
+
+	req, fbr := requestBuild(t, m, "", files)
+	if len(req.Hashes) != 2 {
+		t.Fatalf("Expected a new session to upload both files, %d were asked for", len(req.Hashes))
+	}
+	if fbr.Session == "" || m.GetSession(fbr.Session) == nil {
+		t.Fatal("Expected the build to start a session")
+	}
+	session := fbr.Session
+
+	//Only the file that changed is uploaded again
+	files["f.c"] = "int f = 1;"
+	req, fbr = requestBuild(t, m, session, files)
+	if exp := []string{rmake.Hash([]byte("int f = 1;"))}; !reflect.DeepEqual(req.Hashes, exp) {
+		t.Fatalf("Expected only the changed file to be asked for, got %v", req.Hashes)
+	}
+	if fbr.Session != session {
+		t.Fatalf("Expected session '%s' to be reused, got '%s'", session, fbr.Session)
+	}
+	s := m.GetSession(session)
+	if e, ok := s.GetEntry("f.c"); !ok || e.Hash != req.Hashes[0] {
+		t.Fatal("Expected the session's manifest to have the new f.c")
+	}
+
+	//Contents no session refers to anymore are dropped with the session
+	old := rmake.Hash([]byte("int f;"))
+	if m.blobs.Size(old) == 0 {
+		t.Fatal("Expected the old f.c to be kept until the session goes")
+	}
+	m.ReleaseSession(session)
+	if m.GetSession(session) != nil {
+		t.Fatal("Expected the session to be gone")
+	}
+	if m.blobs.Size(old) != 0 || m.blobs.Size(req.Hashes[0]) != 0 {
+		t.Fatal("Expected the blobs of the released session to be dropped")
+	}
+
+	//A session the manager doesn't know is replaced with a new one
+	req, fbr = requestBuild(t, m, session, files)
+	if len(req.Hashes) != 2 || fbr.Session == session {
+		t.Fatalf("Expected a new session with both files uploaded, got '%s' and %d files", fbr.Session, len(req.Hashes))
+	}
+}
+
+func TestBuildClients(t *testing.T) {
+	m := testManager(t)
+	s := m.GetNewSession()
+	first := NewBuild(s)
+	second := NewBuild(s)
+
+	done := make(chan bool)
+	go func() {
+		m.SendToClient(s.ID, second.ID, &rmake.BuildStatus{Session: s.ID})
+		done <- true
+	}()
+	select {
+	case <-first.Client:
+		t.Fatal("Expected the first build's client not to get messages of the second")
+	case mes := <-second.Client:
+		if _, ok := mes.(*rmake.BuildStatus); !ok {
+			t.Fatalf("Expected a build status, got %s", reflect.TypeOf(mes))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second build's client to get the message")
+	}
+	<-done
+}
@@ -3,6 +3,10 @@ package manager
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
@@ -13,6 +17,13 @@ type Session struct {
 	Builds map[int]*Build
 	//
 	getNewBuildID chan int
+
+	// The session's source tree as of the latest build, by path
+	Manifest map[string]*rmake.ManifestEntry
+	// When the session was last used by a build
+	LastUsed time.Time
+
+	lock sync.Mutex
 }
 
 func NewSession() *Session {
@@ -22,6 +33,8 @@ func NewSession() *Session {
 	s.ID = hex.EncodeToString(bytes)
 	s.Builds = make(map[int]*Build)
 	s.getNewBuildID = make(chan int)
+	s.Manifest = make(map[string]*rmake.ManifestEntry)
+	s.LastUsed = time.Now()
 	go s.buildIDGenerator()
 	return s
 }
@@ -36,6 +49,34 @@ func (s *Session) buildIDGenerator() {
 	}
 }
 
+// Replace the session's source tree with the one sent by the client
+func (s *Session) SetManifest(entries []*rmake.ManifestEntry) {
+	s.lock.Lock()
+	s.Manifest = make(map[string]*rmake.ManifestEntry)
+	for _, e := range entries {
+		s.Manifest[e.Path] = e
+	}
+	s.LastUsed = time.Now()
+	s.lock.Unlock()
+}
+
+// Look up a file in the session's source tree
+func (s *Session) GetEntry(path string) (*rmake.ManifestEntry, bool) {
+	s.lock.Lock()
+	e, ok := s.Manifest[path]
+	s.lock.Unlock()
+	return e, ok
+}
+
+// Add the hashes of the session's files to a set
+func (s *Session) liveBlobs(live map[string]bool) {
+	s.lock.Lock()
+	for _, e := range s.Manifest {
+		live[e.Hash] = true
+	}
+	s.lock.Unlock()
+}
+
 type Build struct {
 	SessionID        string
 	TotalJobs        int
@@ -44,19 +85,620 @@ type Build struct {
 	getNewJobID      chan int
 	Jobs             map[int]*rmake.Job
 	AssignedBuilders map[*rmake.Job]*BuilderConnection
+
+	// The files and directories the client asked for
+	Artifacts []string
+	// How many jobs still have to send back artifacts
+	Returning int
+	// The artifacts received so far
+	Results []*rmake.File
+	// Jobs whose artifacts have been received
+	returned map[*rmake.Job]bool
+
+	// Variables given to every job of the build
+	Vars map[string]string
+	// The outputs each job has to send back to the manager
+	Returns map[*rmake.Job][]string
+
+	// The node of every job that has to run, by job
+	nodes map[*rmake.Job]*rmake.DepTreeNode
+	// The same jobs, dependencies first
+	order []*rmake.Job
+	// Jobs by each of their outputs
+	byOutput map[string]*rmake.Job
+	// Jobs that have finished
+	finished map[*rmake.Job]bool
+	// The builder holding each output made so far
+	located map[string]*BuilderConnection
+	// Every builder with a copy of each output, the one that made it
+	// and the ones it was forwarded to
+	holders map[string]map[*BuilderConnection]bool
+	// The size of each output made so far
+	sizes map[string]int64
+	// The state and timings of every job
+	records map[*rmake.Job]*JobRecord
+	// Jobs counted in the NumJobs of the builder they were sent to
+	counted map[*rmake.Job]*BuilderConnection
+	// The expected time from each job starting to the build being done,
+	// the length of the longest chain of jobs through it
+	priority map[*rmake.Job]time.Duration
+	// Messages for the client waiting on the build
+	Client chan interface{}
+	// Status updates waiting to be passed on to the client, at most one
+	// per job so a slow client never holds up the manager
+	progress       []*rmake.BuildStatus
+	queuedProgress map[string]int
+	// Signalled when a status update is queued
+	progressReady chan struct{}
+	// Closed once the build is over
+	over chan struct{}
+	// Closed once nobody is passing messages on to the client
+	gone chan struct{}
+
+	lock sync.Mutex
 }
 
+// The progress of a single job of a build
+type JobRecord struct {
+	State rmake.JobState
+	// When the job was sent to a builder, started and finished
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+	// How long the job's command ran for, as measured by its builder
+	Duration time.Duration
+	// How many times the job was sent to a builder
+	Attempts int
+}
+
+// Start a new build in the session
 func NewBuild(s *Session) *Build {
 	b := new(Build)
 	b.SessionID = s.ID
 	b.TotalJobs = 0
 	b.JobsDone = 0
 	b.getNewJobID = make(chan int)
+	b.AssignedBuilders = make(map[*rmake.Job]*BuilderConnection)
+	b.nodes = make(map[*rmake.Job]*rmake.DepTreeNode)
+	b.byOutput = make(map[string]*rmake.Job)
+	b.finished = make(map[*rmake.Job]bool)
+	b.located = make(map[string]*BuilderConnection)
+	b.holders = make(map[string]map[*BuilderConnection]bool)
+	b.sizes = make(map[string]int64)
+	b.records = make(map[*rmake.Job]*JobRecord)
+	b.returned = make(map[*rmake.Job]bool)
+	b.counted = make(map[*rmake.Job]*BuilderConnection)
+	b.priority = make(map[*rmake.Job]time.Duration)
+	// Room for the final result, which is only sent once
+	b.Client = make(chan interface{}, 1)
+	b.queuedProgress = make(map[string]int)
+	b.progressReady = make(chan struct{}, 1)
+	b.over = make(chan struct{})
+	b.gone = make(chan struct{})
 	b.ID = <-s.getNewBuildID
 	go b.jobIDGenerator()
+	s.lock.Lock()
+	s.Builds[b.ID] = b
+	s.lock.Unlock()
 	return b
 }
 
+// Look up a build of the session
+func (s *Session) GetBuild(id int) *Build {
+	s.lock.Lock()
+	b := s.Builds[id]
+	s.lock.Unlock()
+	return b
+}
+
+// Forget a build that is over
+// Returns false if the build was already over.
+func (s *Session) EndBuild(id int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.Builds[id]
+	if ok {
+		close(b.over)
+		delete(s.Builds, id)
+		b.uncountAll()
+	}
+	return ok
+}
+
+// Whether the build has ended
+func (b *Build) Over() bool {
+	select {
+	case <-b.over:
+		return true
+	default:
+		return false
+	}
+}
+
+// Collect the artifacts the job making output sent back
+// Returns true once every job that has artifacts to return has. Jobs
+// that ran again after their builder was lost may send theirs twice,
+// only the first are kept.
+func (b *Build) AddResults(output string, files []*rmake.File) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if j, ok := b.byOutput[output]; ok {
+		if b.returned[j] {
+			return false
+		}
+		b.returned[j] = true
+	}
+	b.Results = append(b.Results, files...)
+	b.Returning--
+	return b.Returning <= 0
+}
+
+// Requested artifacts that no file was received for
+func (b *Build) MissingArtifacts() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var missing []string
+	for _, a := range b.Artifacts {
+		found := false
+		for _, f := range b.Results {
+			if rmake.InArtifact(f.Path, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, a)
+		}
+	}
+	return missing
+}
+
+// Set the jobs to run, every job the given nodes depend on
+func (b *Build) SetGraph(roots []*rmake.DepTreeNode) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, r := range roots {
+		for _, n := range r.Nodes() {
+			if n.Job == nil || b.nodes[n.Job] != nil {
+				continue
+			}
+			b.nodes[n.Job] = n
+			b.order = append(b.order, n.Job)
+			b.records[n.Job] = &JobRecord{State: rmake.JobWaiting}
+			for _, o := range n.Job.OutputFiles() {
+				b.byOutput[o] = n.Job
+			}
+		}
+	}
+	b.TotalJobs = len(b.nodes)
+}
+
+// Take the jobs that can run now, all of whose dependencies are done
+// The jobs are marked as assigned, to a builder set with Assign.
+func (b *Build) TakeReady() []*rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Over() {
+		return nil
+	}
+	var ready []*rmake.Job
+	for _, j := range b.order {
+		if _, ok := b.AssignedBuilders[j]; ok {
+			continue
+		}
+		n := b.nodes[j]
+		runnable := true
+		for _, d := range n.DependsOn {
+			if d.Job != nil && !b.finished[d.Job] {
+				runnable = false
+				break
+			}
+		}
+		if runnable {
+			ready = append(ready, j)
+			b.AssignedBuilders[j] = nil
+		}
+	}
+	//Jobs on the longest chains go out first, the rest of the build is
+	//waiting on them
+	sort.SliceStable(ready, func(x, y int) bool {
+		return b.priority[ready[x]] > b.priority[ready[y]]
+	})
+	return ready
+}
+
+// Work out the critical path of the build
+// Every job gets the expected time of the longest chain of jobs from it
+// to the end of the build, from how long each job is known to take. Jobs
+// that never ran before are assumed to take as long as the known ones do
+// on average, or DefaultJobTime when none are known.
+func (b *Build) Prioritize(known func(*rmake.Job) (time.Duration, bool)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	est := make(map[*rmake.Job]time.Duration)
+	var sum time.Duration
+	for _, j := range b.order {
+		if d, ok := known(j); ok {
+			est[j] = d
+			sum += d
+		}
+	}
+	guess := DefaultJobTime
+	if len(est) > 0 {
+		guess = sum / time.Duration(len(est))
+	}
+
+	//Dependents come after what they depend on, so going backwards
+	//every job's dependents are done before it
+	after := make(map[*rmake.Job]time.Duration)
+	for i := len(b.order) - 1; i >= 0; i-- {
+		j := b.order[i]
+		d, ok := est[j]
+		if !ok {
+			d = guess
+		}
+		p := d + after[j]
+		b.priority[j] = p
+		for _, dep := range b.nodes[j].DependsOn {
+			if dep.Job != nil && p > after[dep.Job] {
+				after[dep.Job] = p
+			}
+		}
+	}
+}
+
+// The length of the longest chain of jobs from a job to the end of the
+// build, as worked out by Prioritize
+func (b *Build) Priority(j *rmake.Job) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.priority[j]
+}
+
+// Record the builder a job was sent to
+func (b *Build) Assign(j *rmake.Job, bc *BuilderConnection) {
+	b.lock.Lock()
+	b.AssignedBuilders[j] = bc
+	b.uncount(j)
+	if bc != nil {
+		b.counted[j] = bc
+		bc.AddJobs(1)
+	}
+	if r, ok := b.records[j]; ok {
+		r.State = rmake.JobQueued
+		r.Queued = time.Now()
+		r.Attempts++
+	}
+	b.lock.Unlock()
+}
+
+// Mark the job making output as started by its builder
+func (b *Build) Start(output string) *rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	j := b.byOutput[output]
+	if j == nil || b.finished[j] {
+		return nil
+	}
+	r := b.records[j]
+	r.State = rmake.JobRunning
+	r.Started = time.Now()
+	return j
+}
+
+// Mark the job making output as done, its outputs are now on the
+// builder it was assigned to
+func (b *Build) Finish(output string, took time.Duration) *rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	j := b.byOutput[output]
+	if j == nil || b.finished[j] {
+		return nil
+	}
+	b.finished[j] = true
+	b.JobsDone++
+	b.uncount(j)
+	r := b.records[j]
+	r.State = rmake.JobDone
+	r.Finished = time.Now()
+	r.Duration = took
+	for _, o := range j.OutputFiles() {
+		b.located[o] = b.AssignedBuilders[j]
+		b.holdUnsafe(o, b.AssignedBuilders[j])
+	}
+	return j
+}
+
+// Note the size of outputs that were made
+func (b *Build) AddSizes(sizes map[string]int64) {
+	b.lock.Lock()
+	for f, n := range sizes {
+		b.sizes[f] = n
+	}
+	b.lock.Unlock()
+}
+
+// The size of an output, zero if it isn't known
+func (b *Build) Size(file string) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.sizes[file]
+}
+
+// Note that outputs were sent to a builder
+func (b *Build) Forwarded(files []string, to *BuilderConnection) {
+	b.lock.Lock()
+	for _, f := range files {
+		b.holdUnsafe(f, to)
+	}
+	b.lock.Unlock()
+}
+
+func (b *Build) holdUnsafe(file string, bc *BuilderConnection) {
+	if b.holders[file] == nil {
+		b.holders[file] = make(map[*BuilderConnection]bool)
+	}
+	b.holders[file][bc] = true
+}
+
+// Whether a builder has a copy of an output, or is about to
+func (b *Build) Holds(file string, bc *BuilderConnection) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.holders[file][bc]
+}
+
+// Mark the job making output as failed
+func (b *Build) Fail(output string, took time.Duration) *rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	j := b.byOutput[output]
+	if j == nil || b.finished[j] {
+		return nil
+	}
+	b.uncount(j)
+	r := b.records[j]
+	r.State = rmake.JobFailed
+	r.Finished = time.Now()
+	r.Duration = took
+	return j
+}
+
+// Describe where a job is at, for the client
+func (b *Build) Status(j *rmake.Job) *rmake.BuildStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bs := new(rmake.BuildStatus)
+	bs.Session = b.SessionID
+	bs.Job = j.Output
+	bs.JobsDone = b.JobsDone
+	bs.TotalJobs = b.TotalJobs
+	if b.TotalJobs > 0 {
+		bs.PercentComplete = 100 * float32(b.JobsDone) / float32(b.TotalJobs)
+	}
+	if bc := b.AssignedBuilders[j]; bc != nil {
+		bs.Builder = bc.Hostname
+	}
+	if r, ok := b.records[j]; ok {
+		bs.State = r.State
+		bs.Duration = r.Duration
+	}
+	return bs
+}
+
+// Queue a status update for the client
+// An update for a job whose previous one wasn't passed on yet replaces
+// it, keeping its message.
+func (b *Build) QueueProgress(bs *rmake.BuildStatus) {
+	b.lock.Lock()
+	if i, ok := b.queuedProgress[bs.Job]; ok {
+		bs.Message = b.progress[i].Message + bs.Message
+		b.progress[i] = nil
+	}
+	b.queuedProgress[bs.Job] = len(b.progress)
+	b.progress = append(b.progress, bs)
+	b.lock.Unlock()
+	select {
+	case b.progressReady <- struct{}{}:
+	default:
+	}
+}
+
+// Take the status updates queued for the client, oldest first
+func (b *Build) TakeProgress() []*rmake.BuildStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var out []*rmake.BuildStatus
+	for _, bs := range b.progress {
+		if bs != nil {
+			out = append(out, bs)
+		}
+	}
+	b.progress = nil
+	b.queuedProgress = make(map[string]int)
+	return out
+}
+
+// The record of the job making output
+func (b *Build) Record(output string) *JobRecord {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if j, ok := b.byOutput[output]; ok {
+		r := *b.records[j]
+		return &r
+	}
+	return nil
+}
+
+// Take back the jobs a lost builder had not finished, and the finished
+// ones whose outputs were only kept there and are still needed
+// The jobs are waiting again, TakeReady hands them out once their
+// dependencies are done. Outputs another builder has a copy of are sent
+// on from there instead.
+func (b *Build) Lose(bc *BuilderConnection) []*rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, h := range b.holders {
+		delete(h, bc)
+	}
+	lost := make(map[*rmake.Job]bool)
+	for _, j := range b.order {
+		if b.AssignedBuilders[j] == bc && !b.finished[j] {
+			lost[j] = true
+		}
+	}
+	//Losing a job can make the outputs of the jobs it needs wanted
+	//again, go on until nothing changes
+	for changed := true; changed; {
+		changed = false
+		for _, j := range b.order {
+			if lost[j] || !b.finished[j] || !b.locatedOnUnsafe(j, bc) {
+				continue
+			}
+			needed := len(b.Returns[j]) > 0 && !b.returned[j]
+			for _, d := range b.nodes[j].Dependents {
+				if d.Job != nil && b.nodes[d.Job] != nil && (lost[d.Job] || !b.finished[d.Job]) && !b.heldUnsafe(j) {
+					needed = true
+				}
+			}
+			if needed {
+				lost[j] = true
+				changed = true
+			}
+		}
+	}
+
+	var out []*rmake.Job
+	for _, j := range b.order {
+		if !lost[j] {
+			for _, o := range j.OutputFiles() {
+				if b.located[o] == bc {
+					b.located[o] = b.liveHolderUnsafe(o)
+				}
+			}
+			continue
+		}
+		if b.finished[j] {
+			delete(b.finished, j)
+			b.JobsDone--
+			for _, o := range j.OutputFiles() {
+				delete(b.located, o)
+			}
+		}
+		delete(b.AssignedBuilders, j)
+		b.uncount(j)
+		r := b.records[j]
+		r.State = rmake.JobWaiting
+		r.Queued = time.Time{}
+		r.Started = time.Time{}
+		out = append(out, j)
+	}
+	return out
+}
+
+// Whether an output of the job is to be sent on from the builder
+func (b *Build) locatedOnUnsafe(j *rmake.Job, bc *BuilderConnection) bool {
+	for _, o := range j.OutputFiles() {
+		if b.located[o] == bc {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether every output of the job has a copy on a builder still there
+func (b *Build) heldUnsafe(j *rmake.Job) bool {
+	for _, o := range j.OutputFiles() {
+		if b.liveHolderUnsafe(o) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// A builder still there that has a copy of the file, or is about to
+func (b *Build) liveHolderUnsafe(file string) *BuilderConnection {
+	for h := range b.holders[file] {
+		if !h.Dead() {
+			return h
+		}
+	}
+	return nil
+}
+
+// Jobs already sent to a builder that need outputs of j
+// This only happens when j ran again, after the builder that first ran
+// it was lost.
+func (b *Build) SentDependents(j *rmake.Job) []*rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var out []*rmake.Job
+	n, ok := b.nodes[j]
+	if !ok {
+		return nil
+	}
+	for _, d := range n.Dependents {
+		if d.Job != nil && b.AssignedBuilders[d.Job] != nil && !b.finished[d.Job] {
+			out = append(out, d.Job)
+		}
+	}
+	return out
+}
+
+// Stop counting a job as one its builder is working on
+// Only call with the lock held.
+func (b *Build) uncount(j *rmake.Job) {
+	if bc, ok := b.counted[j]; ok {
+		bc.AddJobs(-1)
+		delete(b.counted, j)
+	}
+}
+
+// Stop counting every job of a build that is over
+func (b *Build) uncountAll() {
+	b.lock.Lock()
+	for j := range b.counted {
+		b.uncount(j)
+	}
+	b.lock.Unlock()
+}
+
+// The job making output
+func (b *Build) Job(output string) *rmake.Job {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.byOutput[output]
+}
+
+// The builder a job was sent to
+func (b *Build) AssignedTo(j *rmake.Job) *BuilderConnection {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.AssignedBuilders[j]
+}
+
+// Every builder that was given a job of the build
+func (b *Build) Builders() []*BuilderConnection {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	seen := make(map[*BuilderConnection]bool)
+	var out []*BuilderConnection
+	for _, j := range b.order {
+		if bc := b.AssignedBuilders[j]; bc != nil && !seen[bc] {
+			seen[bc] = true
+			out = append(out, bc)
+		}
+	}
+	return out
+}
+
+// The builder that has an output of the build
+func (b *Build) Location(file string) *BuilderConnection {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.located[file]
+}
+
 func (b *Build) jobIDGenerator() {
 	nextID := 0
 	for {
@@ -0,0 +1,64 @@
+package rmake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+//Describes a file by the digest of its contents
+type ManifestEntry struct {
+	Path string
+	Hash string
+	Mode os.FileMode
+}
+
+//The contents of a file, identified by their digest
+type Blob struct {
+	Hash     string
+	Contents []byte
+	//How Contents is compressed, empty for not at all
+	Encoding string
+}
+
+//Compute the digest identifying some contents
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//Make a blob from some contents
+func NewBlob(data []byte) *Blob {
+	b := new(Blob)
+	b.Hash = Hash(data)
+	b.Contents = data
+	return b
+}
+
+//Make sure the contents actually match the digest
+//Compressed blobs have to be decompressed first.
+func (b *Blob) Verify() error {
+	if h := Hash(b.Contents); h != b.Hash {
+		return fmt.Errorf("Blob contents do not match hash %s", b.Hash)
+	}
+	return nil
+}
+
+//Whether a string looks like a digest, and is safe to use as a file name
+func ValidHash(h string) bool {
+	if len(h) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+//Describe a file for a manifest
+func (f *File) Entry() *ManifestEntry {
+	e := new(ManifestEntry)
+	e.Path = f.Path
+	e.Hash = Hash(f.Contents)
+	e.Mode = f.Mode
+	return e
+}
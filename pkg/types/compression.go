@@ -0,0 +1,192 @@
+package rmake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+//Compression levels, from none to the smallest output
+const (
+	CompressNone    = 0
+	CompressFast    = gzip.BestSpeed
+	CompressDefault = 6
+	CompressBest    = gzip.BestCompression
+)
+
+//Algorithms we can compress with, in order of preference
+var CompressionAlgorithms = []string{"gzip"}
+
+//Files smaller than this aren't worth compressing
+const minCompressSize = 512
+
+//Compression settings for a connection
+//The side opening a connection offers the algorithms it supports and
+//the level it would like, the other side answers with the single
+//algorithm and level to use. A nil Compression means none.
+type Compression struct {
+	Algorithms []string
+	Level      int
+}
+
+//Parse a level as given to 'rmake compress' or the -compress flags
+func ParseCompressionLevel(s string) (int, error) {
+	switch s {
+	case "", "none", "off":
+		return CompressNone, nil
+	case "fast":
+		return CompressFast, nil
+	case "default":
+		return CompressDefault, nil
+	case "best":
+		return CompressBest, nil
+	}
+	l, err := strconv.Atoi(s)
+	if err != nil || l < CompressNone || l > CompressBest {
+		return 0, fmt.Errorf("Invalid compression level '%s'", s)
+	}
+	return l, nil
+}
+
+//Offer compression at the given level
+func NewCompressionOffer(level int) *Compression {
+	if level == CompressNone {
+		return nil
+	}
+	c := new(Compression)
+	c.Algorithms = CompressionAlgorithms
+	c.Level = level
+	return c
+}
+
+//Answer an offer, compressing no harder than maxLevel
+func (c *Compression) Negotiate(maxLevel int) *Compression {
+	if c == nil || c.Level == CompressNone || maxLevel == CompressNone {
+		return nil
+	}
+	for _, a := range c.Algorithms {
+		for _, ours := range CompressionAlgorithms {
+			if a != ours {
+				continue
+			}
+			ans := new(Compression)
+			ans.Algorithms = []string{a}
+			ans.Level = c.Level
+			if maxLevel < ans.Level {
+				ans.Level = maxLevel
+			}
+			return ans
+		}
+	}
+	return nil
+}
+
+func (c *Compression) String() string {
+	if c == nil || len(c.Algorithms) == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%s level %d", c.Algorithms[0], c.Level)
+}
+
+//Signatures of common compressed formats
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                       //gzip
+	{'P', 'K', 0x03, 0x04},             //zip, jar
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   //xz
+	{0x28, 0xb5, 0x2f, 0xfd},           //zstd
+	{'B', 'Z', 'h'},                    //bzip2
+	{0x89, 'P', 'N', 'G'},              //png
+	{0xff, 0xd8, 0xff},                 //jpeg
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, //7z
+	{0x04, 0x22, 0x4d, 0x18},           //lz4
+}
+
+//Whether data is worth trying to compress
+func compressible(data []byte) bool {
+	if len(data) < minCompressSize {
+		return false
+	}
+	for _, m := range compressedMagic {
+		if bytes.HasPrefix(data, m) {
+			return false
+		}
+	}
+	return true
+}
+
+//Compress data, returning the encoding used
+//Data that is already compressed, or doesn't get any smaller, is
+//returned as it is with an empty encoding.
+func (c *Compression) compress(data []byte) ([]byte, string) {
+	if c == nil || c.Level == CompressNone || len(c.Algorithms) == 0 || !compressible(data) {
+		return data, ""
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return data, ""
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil || buf.Len() >= len(data) {
+		return data, ""
+	}
+	return buf.Bytes(), "gzip"
+}
+
+func decompress(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("Unknown encoding '%s'", encoding)
+}
+
+//Compress the blob's contents for sending
+func (b *Blob) Compress(c *Compression) {
+	if b.Encoding != "" {
+		return
+	}
+	b.Contents, b.Encoding = c.compress(b.Contents)
+}
+
+//Restore the blob's original contents
+func (b *Blob) Decompress() error {
+	data, err := decompress(b.Contents, b.Encoding)
+	if err != nil {
+		return err
+	}
+	b.Contents = data
+	b.Encoding = ""
+	return nil
+}
+
+//Compress the file's contents for sending
+func (f *File) Compress(c *Compression) {
+	if f.Encoding != "" {
+		return
+	}
+	f.Contents, f.Encoding = c.compress(f.Contents)
+}
+
+//Restore the file's original contents
+func (f *File) Decompress() error {
+	data, err := decompress(f.Contents, f.Encoding)
+	if err != nil {
+		return err
+	}
+	f.Contents = data
+	f.Encoding = ""
+	return nil
+}
@@ -0,0 +1,50 @@
+package rmake
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressionNegotiate(t *testing.T) {
+	offer := NewCompressionOffer(CompressBest)
+	c := offer.Negotiate(CompressFast)
+	if c == nil || c.Level != CompressFast || c.Algorithms[0] != "gzip" {
+		t.Fatalf("Expected gzip level %d, got %s", CompressFast, c)
+	}
+	if offer.Negotiate(CompressNone) != nil {
+		t.Fatal("Expected no compression when the answering side wants none")
+	}
+	if NewCompressionOffer(CompressNone).Negotiate(CompressBest) != nil {
+		t.Fatal("Expected no compression when none was offered")
+	}
+	other := &Compression{Algorithms: []string{"lzma"}, Level: CompressBest}
+	if other.Negotiate(CompressBest) != nil {
+		t.Fatal("Expected no compression for an unknown algorithm")
+	}
+}
+
+func TestBlobCompress(t *testing.T) {
+	c := NewCompressionOffer(CompressDefault).Negotiate(CompressDefault)
+	data := bytes.Repeat([]byte("int main() { return 0; }\n"), 100)
+	b := NewBlob(data)
+	b.Compress(c)
+	if b.Encoding != "gzip" || len(b.Contents) >= len(data) {
+		t.Fatalf("Expected blob to be compressed, encoding '%s'", b.Encoding)
+	}
+	err := b.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Already compressed data goes as it is
+	gz := append([]byte{0x1f, 0x8b}, data...)
+	b = NewBlob(gz)
+	b.Compress(c)
+	if b.Encoding != "" || !bytes.Equal(b.Contents, gz) {
+		t.Fatal("Expected compressed data to be skipped")
+	}
+}
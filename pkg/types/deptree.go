@@ -2,6 +2,7 @@ package rmake
 
 import (
 	"fmt"
+	"strings"
 )
 
 const (
@@ -9,83 +10,208 @@ const (
 	TFile
 )
 
+//A file or job in the dependency graph of a build
+//Nodes are shared, a job or file that several others depend on has a
+//single node listed in each of their DependsOn.
 type DepTreeNode struct {
 	Result string
 	DependsOn []*DepTreeNode
 	Type int
+
+	//The job making Result, for TBuild nodes
+	Job *Job
+	//Nodes that depend on this one
+	Dependents []*DepTreeNode
 }
 
-//For use on the manager
-func MakeDepTreeBP(in *BuildPackage) (*DepTreeNode, error) {
-	jobbyout := make(map[string]*Job)
-	for _,j := range in.Jobs {
-		jobbyout[j.Output] = j
-	}
+//A set of jobs that depend on each other
+type CycleError struct {
+	//The outputs in the cycle, starting and ending with the same one
+	Cycle []string
+}
 
-	final,ok := jobbyout[in.Output]
-	if !ok {
-		return nil,fmt.Errorf("Could not find job for final output.")
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("Dependency cycle: %s", strings.Join(e.Cycle, " -> "))
+}
+
+//Resolves outputs into nodes, sharing them between everything that
+//depends on the same job or file
+type DepGraph struct {
+	jobs map[string]*Job
+	files map[string]bool
+	all []*Job
+
+	nodes map[*Job]*DepTreeNode
+	fileNodes map[string]*DepTreeNode
+	//Jobs being resolved, in order, to report cycles
+	stack []*Job
+}
+
+func NewDepGraph(jobs []*Job, files map[string]bool) *DepGraph {
+	g := new(DepGraph)
+	g.jobs = JobsByOutput(jobs)
+	g.files = files
+	g.all = jobs
+	g.nodes = make(map[*Job]*DepTreeNode)
+	g.fileNodes = make(map[string]*DepTreeNode)
+	return g
+}
+
+//Get the node for a job output or file, resolving everything it
+//depends on
+func (g *DepGraph) Resolve(output string) (*DepTreeNode, error) {
+	if j,ok := g.jobs[output]; ok {
+		return g.jobNode(j)
+	}
+	if g.files[output] {
+		return g.fileNode(output), nil
 	}
-	delete(jobbyout, in.Output)
+	return nil, fmt.Errorf("Could not find job for '%s'", output)
+}
 
-	fi := make(map[string]bool)
-	for fn,_ := range in.Files {
-		fi[fn] = true
+func (g *DepGraph) jobNode(j *Job) (*DepTreeNode, error) {
+	if n,ok := g.nodes[j]; ok {
+		return n, nil
 	}
-	root := new(DepTreeNode)
-	root.Result = in.Output
-	root.Type = TBuild
-	err := root.Build(final.Deps, jobbyout, fi)
-	if err != nil {
-		return nil, err
+	for i,sj := range g.stack {
+		if sj == j {
+			cycle := new(CycleError)
+			for _,cj := range g.stack[i:] {
+				cycle.Cycle = append(cycle.Cycle, cj.Output)
+			}
+			cycle.Cycle = append(cycle.Cycle, j.Output)
+			return nil, cycle
+		}
+	}
+
+	g.stack = append(g.stack, j)
+	defer func() { g.stack = g.stack[:len(g.stack)-1] }()
+
+	n := new(DepTreeNode)
+	n.Result = j.Output
+	n.Type = TBuild
+	n.Job = j
+	for _,d := range j.Deps {
+		var dn *DepTreeNode
+		if dj,ok := g.jobs[d]; ok {
+			var err error
+			dn, err = g.jobNode(dj)
+			if err != nil {
+				return nil, err
+			}
+		} else if g.files[d] {
+			dn = g.fileNode(d)
+		} else {
+			return nil, fmt.Errorf("Could not resolve dependency '%s' for job '%s'", d, j.Output)
+		}
+		n.link(dn)
 	}
+	//Only complete nodes are shared, so a job that needs its own
+	//output is found on the stack above
+	g.nodes[j] = n
+	return n, nil
+}
 
-	return root,nil
+func (g *DepGraph) fileNode(path string) *DepTreeNode {
+	if n,ok := g.fileNodes[path]; ok {
+		return n
+	}
+	n := new(DepTreeNode)
+	n.Result = path
+	n.Type = TFile
+	g.fileNodes[path] = n
+	return n
 }
 
+//Jobs that nothing resolved so far depends on
+func (g *DepGraph) Unused() []*Job {
+	var out []*Job
+	for _,j := range g.all {
+		if _,ok := g.nodes[j]; !ok {
+			out = append(out, j)
+		}
+	}
+	return out
+}
 
-func (t *DepTreeNode) Build(deps []string, jobs map[string]*Job, files map[string]bool) error {
-	for _,d := range deps {
-		j,ok := jobs[d]
-		if ok {
-			delete(jobs, d)
-			node := new(DepTreeNode)
-			node.Result = d
-			node.Type = TBuild
-			if err := node.Build(j.Deps, jobs, files); err != nil {
-				return err
-			}
-			t.DependsOn = append(t.DependsOn, node)
-			continue
+//Add a dependency, once, however many of its outputs are used
+func (t *DepTreeNode) link(dep *DepTreeNode) {
+	for _,d := range t.DependsOn {
+		if d == dep {
+			return
 		}
+	}
+	t.DependsOn = append(t.DependsOn, dep)
+	dep.Dependents = append(dep.Dependents, t)
+}
 
-		_,ok = files[d]
-		if ok {
-			node := new(DepTreeNode)
-			node.Result = d
-			node.Type = TFile
-			t.DependsOn = append(t.DependsOn, node)
-			continue
+//Every node below and including t, each once, dependencies first
+func (t *DepTreeNode) Nodes() []*DepTreeNode {
+	var out []*DepTreeNode
+	seen := make(map[*DepTreeNode]bool)
+	var walk func(n *DepTreeNode)
+	walk = func(n *DepTreeNode) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		for _,d := range n.DependsOn {
+			walk(d)
 		}
+		out = append(out, n)
+	}
+	walk(t)
+	return out
+}
 
-		return fmt.Errorf("Could not resolve dependency '%s' for job '%s'", d, t.Result)
+//Make the tree for building output from jobs and source files
+func MakeDepTree(jobs []*Job, output string, files map[string]bool) (*DepTreeNode, error) {
+	g := NewDepGraph(jobs, files)
+	if _,ok := g.jobs[output]; !ok {
+		return nil,fmt.Errorf("Could not find job for final output.")
 	}
-	return nil
+	return g.Resolve(output)
+}
+
+//For use on the manager
+func MakeDepTreeBP(in *BuildPackage) (*DepTreeNode, error) {
+	fi := make(map[string]bool)
+	for _,e := range in.Manifest {
+		fi[e.Path] = true
+	}
+	return MakeDepTree(in.Jobs, in.Output, fi)
+}
+
+//Index jobs by every file they produce
+func JobsByOutput(jobs []*Job) map[string]*Job {
+	byout := make(map[string]*Job)
+	for _,j := range jobs {
+		for _,o := range j.OutputFiles() {
+			byout[o] = j
+		}
+	}
+	return byout
 }
 
 func (t *DepTreeNode) Print() {
 	fmt.Printf("Final job %s depends on:\n", t.Result)
+	printed := make(map[*DepTreeNode]bool)
 	for _,dep := range t.DependsOn {
-		dep.rPrint(1)
+		dep.rPrint(1, printed)
 	}
 }
 
-func (t *DepTreeNode) rPrint(depth int) {
+func (t *DepTreeNode) rPrint(depth int, printed map[*DepTreeNode]bool) {
 	for i := 0; i < depth; i++ {
 		fmt.Print("\t");
 	}
+	if printed[t] && len(t.DependsOn) > 0 {
+		fmt.Printf("%s (see above)\n", t.Result)
+		return
+	}
+	printed[t] = true
 	fmt.Printf("%s depends on %d items:\n", t.Result, len(t.DependsOn))
 	for _,dep := range t.DependsOn {
-		dep.rPrint(depth+1)
+		dep.rPrint(depth+1, printed)
 	}
 }
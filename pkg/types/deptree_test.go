@@ -0,0 +1,83 @@
+package rmake
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDepTreeMultipleOutputs(t *testing.T) {
+	bp := new(BuildPackage)
+	bp.Output = "prog"
+	bp.Manifest = []*ManifestEntry{{Path: "msg.proto"}, {Path: "main.cc"}}
+	bp.Jobs = []*Job{
+		{Command: "protoc", Output: "msg.pb.cc", Outputs: []string{"msg.pb.h"}, Deps: []string{"msg.proto"}},
+		{Command: "g++", Output: "main.o", Deps: []string{"main.cc", "msg.pb.h"}},
+		{Command: "g++", Output: "msg.pb.o", Deps: []string{"msg.pb.cc"}},
+		{Command: "g++", Output: "prog", Deps: []string{"main.o", "msg.pb.o"}},
+	}
+	tree, err := MakeDepTreeBP(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.DependsOn) != 2 {
+		t.Fatalf("Expected prog to depend on 2 nodes, got %d", len(tree.DependsOn))
+	}
+	main := tree.DependsOn[0]
+	if len(main.DependsOn) != 2 || main.DependsOn[1].Type != TBuild {
+		t.Fatal("Expected main.o to depend on the protoc job through msg.pb.h")
+	}
+}
+
+func TestDepTreeSharedNodes(t *testing.T) {
+	files := map[string]bool{"gen.py": true, "a.c": true, "b.c": true, "lib.c": true}
+	jobs := []*Job{
+		{Command: "python", Output: "gen.h", Deps: []string{"gen.py"}},
+		{Command: "cc", Output: "a.o", Deps: []string{"a.c", "gen.h"}},
+		{Command: "cc", Output: "b.o", Deps: []string{"b.c", "gen.h"}},
+		{Command: "ar", Output: "libx.a", Deps: []string{"lib.c", "gen.h"}},
+		{Command: "cc", Output: "a", Deps: []string{"a.o", "libx.a"}},
+		{Command: "cc", Output: "b", Deps: []string{"b.o", "libx.a"}},
+		{Command: "tar", Output: "all.tar", Deps: []string{"a", "b"}},
+		{Command: "cc", Output: "extra", Deps: []string{"a.c"}},
+	}
+	g := NewDepGraph(jobs, files)
+	root, err := g.Resolve("all.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byresult := make(map[string]*DepTreeNode)
+	for _, n := range root.Nodes() {
+		if byresult[n.Result] != nil {
+			t.Fatalf("%s appears twice", n.Result)
+		}
+		byresult[n.Result] = n
+	}
+	if len(byresult) != 11 {
+		t.Fatalf("Expected 11 nodes, got %d", len(byresult))
+	}
+	if len(byresult["gen.h"].Dependents) != 3 || len(byresult["libx.a"].Dependents) != 2 {
+		t.Fatal("Expected gen.h and libx.a to be shared")
+	}
+
+	unused := g.Unused()
+	if len(unused) != 1 || unused[0].Output != "extra" {
+		t.Fatalf("Expected only 'extra' to be unused, got %v", unused)
+	}
+}
+
+func TestDepTreeCycle(t *testing.T) {
+	jobs := []*Job{
+		{Command: "cc", Output: "prog", Deps: []string{"a.o"}},
+		{Command: "cc", Output: "a.o", Deps: []string{"a.c", "gen.h"}},
+		{Command: "gen", Output: "gen.h", Deps: []string{"prog"}},
+	}
+	_, err := MakeDepTree(jobs, "prog", map[string]bool{"a.c": true})
+	cycle, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("Expected a cycle error, got %v", err)
+	}
+	if got := strings.Join(cycle.Cycle, " "); got != "prog a.o gen.h prog" {
+		t.Fatalf("Got cycle %s", got)
+	}
+}
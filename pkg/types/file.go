@@ -11,12 +11,16 @@ import (
 type FileInfo struct {
 	Path     string
 	LastTime time.Time
+	//Digest of the contents as of LastTime
+	Hash string `json:",omitempty"`
 }
 
 type File struct {
 	Path     string
 	Contents []byte
 	Mode     os.FileMode
+	//How Contents is compressed, empty for not at all
+	Encoding string
 }
 
 //Load a file relative to the given directory
@@ -54,13 +58,15 @@ func (f *File) Save(dir string) error {
 		os.Mkdir(cur, os.ModeDir|0777)
 	}
 	cur = path.Join(cur, spl[len(spl)-1])
-	fi, err := os.OpenFile(cur, os.O_CREATE|os.O_WRONLY, f.Mode)
+	fi, err := os.OpenFile(cur, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode)
 	if err != nil {
 		return err
 	}
+	defer fi.Close()
 	_, err = fi.Write(f.Contents)
 	if err != nil {
 		return err
 	}
-	return nil
+	//The file may have existed with another mode
+	return fi.Chmod(f.Mode.Perm())
 }
@@ -1,9 +1,120 @@
 package rmake
 
+import (
+	"strings"
+)
+
 type Job struct {
 	Command string
 	Args    []string
 	Deps    []string
 	Output  string
+	//Other files the command writes, like dependency files or
+	//generated headers
+	Outputs []string `json:",omitempty"`
 	ID      int
 }
+
+//Every file the job produces, its main output first
+func (j *Job) OutputFiles() []string {
+	out := []string{j.Output}
+	for _, o := range j.Outputs {
+		if o != j.Output {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+//Whether the job produces the given file
+func (j *Job) Produces(file string) bool {
+	for _, o := range j.OutputFiles() {
+		if o == file {
+			return true
+		}
+	}
+	return false
+}
+
+//Whether c can appear in a variable name
+func isVarChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+//Replace $(NAME) and ${NAME} references to the given variables
+//References to anything else are left alone, for the shell to handle.
+//$$(NAME) and $${NAME} are escapes for a literal $(NAME) and ${NAME}.
+func ExpandVars(s string, vars map[string]string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "$$(") || strings.HasPrefix(s[i:], "$${") {
+			out.WriteString(s[i+1 : i+3])
+			i += 2
+			continue
+		}
+		if s[i] != '$' || i+1 == len(s) || (s[i+1] != '(' && s[i+1] != '{') {
+			out.WriteByte(s[i])
+			continue
+		}
+		close := byte(')')
+		if s[i+1] == '{' {
+			close = '}'
+		}
+		end := i + 2
+		for end < len(s) && isVarChar(s[end]) {
+			end++
+		}
+		if end < len(s) && s[end] == close {
+			if v, ok := vars[s[i+2:end]]; ok {
+				out.WriteString(v)
+				i = end
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+//Whether s is a single reference to one of the variables
+func wholeVar(s string, vars map[string]string) bool {
+	if len(s) < 4 || s[0] != '$' {
+		return false
+	}
+	if !(s[1] == '(' && s[len(s)-1] == ')') && !(s[1] == '{' && s[len(s)-1] == '}') {
+		return false
+	}
+	_, ok := vars[s[2:len(s)-1]]
+	return ok
+}
+
+//Returns a copy of the job with variables expanded in its command
+//and arguments. An argument that is nothing but a reference becomes
+//one argument per word of the value, so CFLAGS="-O2 -g" passes two
+//flags, while references inside a larger argument are substituted
+//as they are.
+func (j *Job) Expand(vars map[string]string) *Job {
+	nj := new(Job)
+	*nj = *j
+	nj.Args = nil
+
+	var words []string
+	for _, a := range append([]string{j.Command}, j.Args...) {
+		if wholeVar(a, vars) {
+			words = append(words, strings.Fields(ExpandVars(a, vars))...)
+		} else {
+			words = append(words, ExpandVars(a, vars))
+		}
+	}
+	if len(words) == 0 {
+		//The command was a variable with nothing in it
+		nj.Command = ""
+		return nj
+	}
+	nj.Command = words[0]
+	nj.Args = words[1:]
+	return nj
+}
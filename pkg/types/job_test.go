@@ -0,0 +1,26 @@
+package rmake
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJobExpand(t *testing.T) {
+	j := new(Job)
+	j.Command = "${CXX}"
+	j.Args = []string{"$(CFLAGS)", "-DVER=$(VER)", "-c", "main.cpp", "$(UNSET)", "$$(VER)", "$${VER}$$"}
+	vars := map[string]string{
+		"CXX":    "ccache g++",
+		"CFLAGS": "-O2  -g",
+		"VER":    "1 2",
+	}
+	nj := j.Expand(vars)
+	got := nj.Command + "|" + strings.Join(nj.Args, "|")
+	expect := "ccache|g++|-O2|-g|-DVER=1 2|-c|main.cpp|$(UNSET)|$(VER)|${VER}$$"
+	if got != expect {
+		t.Fatalf("Expected '%s', got '%s'", expect, got)
+	}
+	if j.Command != "${CXX}" || len(j.Args) != 7 {
+		t.Fatal("Expand modified the original job")
+	}
+}
@@ -2,10 +2,17 @@ package rmake
 
 import (
 	"encoding/gob"
+	"strings"
 	"time"
 )
 
-const ProtocolVersion = 2
+const ProtocolVersion = 9
+
+//How often builders send a heartbeat, unless told otherwise
+const DefaultHeartbeatInterval = time.Second * 10
+
+//The shortest heartbeat interval the manager agrees to
+const MinHeartbeatInterval = time.Millisecond * 100
 
 func init() {
 	gob.Register(&BuilderRequest{})
@@ -19,6 +26,14 @@ func init() {
 	gob.Register(&BuilderAnnouncement{})
 	gob.Register(&ManagerAcknowledge{})
 	gob.Register(&Job{})
+	gob.Register(&BlobRequest{})
+	gob.Register(&BlobData{})
+	gob.Register(&FileOffer{})
+	gob.Register(&SessionReleaseMessage{})
+	gob.Register(&FileForwardMessage{})
+	gob.Register(&JobStartedMessage{})
+	gob.Register(&BuildCancelMessage{})
+	gob.Register(&Ping{})
 }
 
 // Announce a builder
@@ -29,6 +44,13 @@ type BuilderAnnouncement struct {
 	ListenerAddr string
 	// The version of the protocol we are using
 	ProtocolVersion int
+	// The compression the builder would like to use
+	Compression *Compression
+	// How often the builder would like to send heartbeats, zero to
+	// leave it to the manager
+	HeartbeatInterval time.Duration
+	// How many jobs the builder runs at once
+	Procs int
 }
 
 // Create a new builder announcement
@@ -51,6 +73,10 @@ type ManagerAcknowledge struct {
 	Success bool
 	// Message
 	Message string
+	// The compression to use on this connection
+	Compression *Compression
+	// How often the builder has to send heartbeats
+	HeartbeatInterval time.Duration
 }
 
 // Create a new manager ack
@@ -63,6 +89,19 @@ func NewManagerAcknowledge(uuid int, s bool, m string) *ManagerAcknowledge {
 	return ma
 }
 
+// Answer a builder's heartbeat interval offer
+// The builder gets what it asked for, as long as it is no longer than
+// the manager's limit and not so short it floods the manager.
+func NegotiateHeartbeat(offer, limit time.Duration) time.Duration {
+	if offer <= 0 || offer > limit {
+		return limit
+	}
+	if offer < MinHeartbeatInterval {
+		return MinHeartbeatInterval
+	}
+	return offer
+}
+
 // Create a new successful manager ack
 func NewManagerAcknowledgeSuccess(uuid int) *ManagerAcknowledge {
 	return NewManagerAcknowledge(uuid, true, "")
@@ -77,16 +116,31 @@ func NewManagerAcknowledgeFailure(message string) *ManagerAcknowledge {
 type BuilderRequest struct {
 	BuildJob *Job
 
-	Input []*File
-	Wait  []string
+	//Source files the job needs, the builder asks the manager for
+	//any contents it doesn't already have
+	Input []*ManifestEntry
+	//Outputs of other jobs the job needs, the builder is sent each of
+	//them before the job is queued
+	Wait []string
 	//The address of the node to send the output to
-	//empty string means keep it local
+	//empty string means keep it local, and wait for the manager to
+	//ask for it to be forwarded
 	ResultAddress string
+	//Outputs of the job the client asked for, to be sent back to the
+	//manager whatever ResultAddress is
+	Return []string
 	//
 	Session string
+	//The build within the session this job belongs to
+	Build int
+	//Variables to set in the job's environment and expand in its command
+	Vars map[string]string
+	//The expected time from the job starting to its build being done,
+	//builders run the jobs with the highest first
+	Priority time.Duration
 }
 
-func (br *BuilderRequest) GetFile(fi string) *File {
+func (br *BuilderRequest) GetFile(fi string) *ManifestEntry {
 	for _, f := range br.Input {
 		if f.Path == fi {
 			return f
@@ -95,6 +149,14 @@ func (br *BuilderRequest) GetFile(fi string) *File {
 	return nil
 }
 
+//Sent by a builder when it starts running a job
+//Builder -> Manager
+type JobStartedMessage struct {
+	Session string
+	Build   int
+	Output  string
+}
+
 //A response from a builder who has finished a job
 //Builder -> Manager
 type JobFinishedMessage struct {
@@ -103,6 +165,13 @@ type JobFinishedMessage struct {
 	Error   string
 	Success bool
 	Session string
+	Build   int
+	//The primary output of the job that finished
+	Output string
+	//How long the job's command ran for
+	Duration time.Duration
+	//The size of each output of the job, if it succeeded
+	OutputSizes map[string]int64
 }
 
 //A response that is sent back from the server
@@ -114,6 +183,10 @@ type BuilderResult struct {
 	Results []*File
 	//
 	Session string
+	//
+	Build int
+	//The primary output of the job the results are from
+	Output string
 }
 
 //A build package, gets sent to the manager to start a build
@@ -128,20 +201,90 @@ type BuildPackage struct {
 
 	//The file that we are expecting to be built
 	Output string
+	//Other files, or directories of outputs, to send back along with it
+	Outputs []string
+
+	//The session of a previous build to reuse, or empty for a new one
+	Session string
+
+	//Variables set with 'rmake var', given to every job
+	Vars map[string]string
 
-	//Files to be transferred
-	Files map[string]*File
+	//The compression the client would like to use
+	Compression *Compression
+
+	//Every file of the build, by content
+	//The manager replies with a BlobRequest for the contents it lacks
+	Manifest []*ManifestEntry
+}
+
+//Everything the client asked to get back, Output first
+func (p *BuildPackage) Artifacts() []string {
+	out := []string{p.Output}
+	for _, o := range p.Outputs {
+		o = strings.TrimSuffix(o, "/")
+		if o != "" && o != p.Output {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+//Whether a file is, or is inside, the given artifact
+func InArtifact(file, artifact string) bool {
+	return file == artifact || strings.HasPrefix(file, artifact+"/")
+}
+
+//Where a job of a build is at
+type JobState int
+
+const (
+	//Waiting for the jobs it depends on
+	JobWaiting JobState = iota
+	//Sent to a builder, waiting for its inputs or a free thread
+	JobQueued
+	JobRunning
+	JobDone
+	JobFailed
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobWaiting:
+		return "waiting"
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	}
+	return "unknown"
 }
 
 //A message to indicate to the client the build status
+//Sent whenever a job of the build changes state
 //Manager -> Client
 type BuildStatus struct {
-	// The status mesage
+	// The status mesage, the job's output once it is done
 	Message string
 	// The percent complete
 	PercentComplete float32
 
 	Session string
+
+	//The job this update is about, by its output
+	Job   string
+	State JobState
+	//The hostname of the builder the job was sent to
+	Builder string
+	//How long the job's command ran for, once it is done
+	Duration time.Duration
+
+	JobsDone  int
+	TotalJobs int
 }
 
 //The final message sent back from the manager after the build is done
@@ -154,6 +297,22 @@ type FinalBuildResult struct {
 	Stdout    string
 	Results   []*File
 	BuildTime time.Time
+
+	//The output and command line of the job that failed the build
+	FailedJob string
+	Command   string
+}
+
+//Tells builders to stop working on a build
+//Queued jobs of the build are dropped and running ones killed. The
+//client sends one, without a session, to cancel the build it started.
+//Client -> Manager
+//Manager -> Builder
+type BuildCancelMessage struct {
+	Session string
+	Build   int
+	//Whether to also remove the session's work directory
+	Clean bool
 }
 
 //Used for sending files to different builder nodes
@@ -165,13 +324,80 @@ type FinalBuildResult struct {
 type RequiredFileMessage struct {
 	Payload *File
 	Session string
+	Build   int
+}
+
+//Asks the builder that made some outputs to send them to the builder
+//running a job that needs them
+//Manager -> Builder
+type FileForwardMessage struct {
+	Session string
+	Build   int
+	Files   []string
+	//The listener address of the builder to send the files to
+	Address string
+}
+
+//Tells a builder a session is over and its files can be removed
+//Manager -> Builder
+type SessionReleaseMessage struct {
+	Session string
 }
 
 //Sent periodically to the manager to inform it of the builders status
+//Doubles as the builder's heartbeat, sent at the interval agreed on in
+//the handshake. Also sent whenever the builder's queue fills up or has
+//room again.
 //Builder -> Manager
 type BuilderStatusUpdate struct {
 	QueuedJobs  int
 	RunningJobs int
-	CPULoad     float32
-	MemUse      float32
+	//Whether the builder's queue is at its capacity, further jobs
+	//wait on the builder until there is room
+	QueueFull bool
+	//The fraction of CPU time and memory in use on the machine, from 0 to 1
+	CPULoad float32
+	MemUse  float32
+}
+
+//Sent by the manager to measure the latency to a builder, which sends
+//it straight back
+//Manager -> Builder
+//Builder -> Manager
+type Ping struct {
+	//When the manager sent the ping, by its own clock
+	Sent time.Time
+}
+
+//Asks for the contents of blobs the sender doesn't have
+//Manager -> Client
+//Builder -> Manager
+//Builder -> Builder
+type BlobRequest struct {
+	Hashes []string
+	//The answer to the compression offered by whoever sent the
+	//manifest, for the BlobData that follows
+	Compression *Compression
+}
+
+//The contents of requested blobs
+//Client -> Manager
+//Manager -> Builder
+//Builder -> Builder
+type BlobData struct {
+	Blobs []*Blob
+	//Requested blobs the sender doesn't have
+	Missing []string
+}
+
+//Offers a job's output to the builder that needs it
+//The receiver answers with a BlobRequest, which is empty if it already
+//has the contents.
+//Builder -> Builder
+type FileOffer struct {
+	Entry   *ManifestEntry
+	Session string
+	Build   int
+	//The compression the sender would like to use
+	Compression *Compression
 }
@@ -0,0 +1,23 @@
+package rmake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiateHeartbeat(t *testing.T) {
+	limit := time.Second * 10
+	cases := []struct {
+		offer, expect time.Duration
+	}{
+		{0, limit},
+		{time.Second * 2, time.Second * 2},
+		{time.Minute, limit},
+		{time.Millisecond, MinHeartbeatInterval},
+	}
+	for _, c := range cases {
+		if got := NegotiateHeartbeat(c.offer, limit); got != c.expect {
+			t.Fatalf("Expected an offer of %s to get %s, got %s", c.offer, c.expect, got)
+		}
+	}
+}
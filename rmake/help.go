@@ -6,10 +6,15 @@ import (
 
 func printHelpAdd() {
 	fmt.Println("rmake add: Adds files to be used in the build process.")
+	fmt.Println("\t'rmake add main.c src/' adds main.c and every file under src/,")
+	fmt.Println("\tskipping anything matched by .rmakeignore, which uses the same")
+	fmt.Println("\tpatterns as .gitignore.")
 }
 
 func printHelpBin() {
-	fmt.Println("rmake bin: set the name of the output binary to return.")
+	fmt.Println("rmake out: set the name of the output binary to return.")
+	fmt.Println("\t'rmake out prog libfoo.so include/' returns several outputs,")
+	fmt.Println("\ta directory brings back every output inside of it.")
 }
 
 func printHelpScr() {
@@ -32,6 +37,9 @@ func printHelpVar() {
 func printHelpCompress() {
 	fmt.Println("rmake compress: 'rmake compress best'")
 	fmt.Println("\tSet compression level for communications with the server.")
+	fmt.Println("\tLevels are none, fast, default, best or 0 to 9. The manager may")
+	fmt.Println("\tpick a lower level, and files that are already compressed are")
+	fmt.Println("\tsent as they are.")
 }
 
 func printHelpStatus() {
@@ -39,11 +47,53 @@ func printHelpStatus() {
 	fmt.Println("\tShows tracked, untracked, and changed files.")
 }
 
+func printHelpJob() {
+	fmt.Println("rmake job: manage the jobs run to build the output.")
+	fmt.Println("\t'rmake job add \"gcc -c main.c\" main.o main.c mylib.h'")
+	fmt.Println("\t\tAdd a job that runs the command, makes main.o and depends on")
+	fmt.Println("\t\tmain.c and mylib.h. A job that writes several files lists them")
+	fmt.Println("\t\tall as its output, like \"msg.pb.cc msg.pb.h\".")
+	fmt.Println("\t\tThe command is split into words like a shell would, so quotes")
+	fmt.Println("\t\tand backslashes work as usual.")
+	fmt.Println("\t'rmake job add --shell \"cpp defs.h | sort > defs.txt\" defs.txt defs.h'")
+	fmt.Println("\t\tRun the command with sh -c on the builder, for pipes,")
+	fmt.Println("\t\tredirection and globs.")
+	fmt.Println("\t'rmake job list'")
+	fmt.Println("\t'rmake job show main.o'")
+	fmt.Println("\t'rmake job remove main.o'")
+	fmt.Println("\t'rmake job edit main.o command [--shell] \"gcc -O2 -c main.c\"'")
+	fmt.Println("\t'rmake job edit main.o deps|add-deps|remove-deps files...'")
+	fmt.Println("\t'rmake job rename main.o obj/main.o'")
+	fmt.Println("\t\tRenaming also updates jobs depending on the output, and")
+	fmt.Println("\t\targuments that are exactly the old name.")
+	fmt.Println("\tChanges that make the jobs unbuildable, like a dependency cycle")
+	fmt.Println("\tor two jobs making the same file, are refused.")
+}
+
+func printHelpImport() {
+	fmt.Println("rmake import: 'rmake import make [Makefile]'")
+	fmt.Println("\t'rmake import compdb [compile_commands.json] [output]'")
+	fmt.Println("\t'rmake import ninja [build.ninja]'")
+	fmt.Println("\tCreate jobs from the rules of an existing build file.")
+}
+
+func printHelpGraph() {
+	fmt.Println("rmake graph: 'rmake graph [dot|json|mermaid] [options] [-o file]'")
+	fmt.Println("\tPrint the graph of jobs and the files they use, as Graphviz")
+	fmt.Println("\tDOT by default.")
+	fmt.Println("\t--changed   highlight files changed since the last build, and")
+	fmt.Println("\t            the jobs that will run again because of them")
+	fmt.Println("\t--critical  highlight the chain of jobs that took longest in")
+	fmt.Println("\t            the last build")
+	fmt.Println("\t--failed    highlight jobs that failed in the last build")
+	fmt.Println("\t--all       all of the above")
+}
+
 func printHelp(which string) {
 	switch which {
 	case "add":
 		printHelpAdd()
-	case "bin":
+	case "bin", "out":
 		printHelpBin()
 	case "server":
 		printHelpServer()
@@ -57,6 +107,12 @@ func printHelp(which string) {
 		printHelpVar()
 	case "status":
 		printHelpStatus()
+	case "import":
+		printHelpImport()
+	case "job":
+		printHelpJob()
+	case "graph":
+		printHelpGraph()
 	case "all":
 		printHelpAll()
 	default:
@@ -74,4 +130,7 @@ func printHelpAll() {
 	printHelpVar()
 	printHelpCompress()
 	printHelpStatus()
+	printHelpJob()
+	printHelpImport()
+	printHelpGraph()
 }
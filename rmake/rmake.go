@@ -10,38 +10,364 @@ import (
 	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
-func createJobs(rmc *client.RMakeConf, args []string) {
+//Take the --shell flag off the front of a job command's arguments
+func shellFlag(args []string) ([]string, bool) {
+	if len(args) > 0 && (args[0] == "--shell" || args[0] == "-s") {
+		return args[1:], true
+	}
+	return args, false
+}
+
+//Handle the 'rmake job' subcommands
+//Returns false when the configuration should not be saved, because
+//the change was refused.
+func createJobs(rmc *client.RMakeConf, args []string) bool {
+	if len(args) < 3 {
+		printHelpJob()
+		return false
+	}
+	before := make(map[string]bool)
+	for _, p := range rmc.JobProblems() {
+		before[p.Error()] = true
+	}
+
+	var err error
 	switch args[2] {
+	case "list":
+		listJobs(rmc)
+		return false
+	case "show":
+		if len(args) < 4 {
+			printHelpJob()
+			return false
+		}
+		err = showJob(rmc, args[3])
+		if err != nil {
+			fmt.Println(err)
+		}
+		return false
 	case "add":
+		rest, shell := shellFlag(args[3:])
+		if len(rest) < 2 {
+			printHelpJob()
+			return false
+		}
+		args = append(args[:3], rest...)
 		j := new(rmake.Job)
-		spl := strings.Split(args[3], " ")
-		j.Command = spl[0]
-		j.Args = spl[1:]
-		j.Output = args[4]
+		j.Command, j.Args, err = client.ParseCommand(args[3], shell)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		//Several outputs can be given, separated by spaces
+		outs := strings.Fields(args[4])
+		if len(outs) > 0 {
+			j.Output = outs[0]
+			j.Outputs = outs[1:]
+		}
 		j.Deps = args[5:]
-		for _,dep := range j.Deps {
+		err = rmc.AddJob(j)
+		if err == nil {
+			updateHeaders(rmc, j)
+		}
+	case "remove", "rm":
+		if len(args) < 4 {
+			printHelpJob()
+			return false
+		}
+		for _, o := range args[3:] {
+			if err = rmc.RemoveJob(o); err != nil {
+				break
+			}
+		}
+	case "edit":
+		if len(args) < 6 {
+			printHelpJob()
+			return false
+		}
+		err = editJob(rmc, args[3], args[4], args[5:])
+	case "rename", "mv":
+		if len(args) < 5 {
+			printHelpJob()
+			return false
+		}
+		err = rmc.RenameOutput(args[3], args[4])
+	case "help":
+		printHelpJob()
+		return false
+	default:
+		fmt.Printf("Unknown job command '%s'.\n", args[2])
+		printHelpJob()
+		return false
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	//Refuse changes that break the build, and point out anything
+	//else that looks unfinished
+	ok := true
+	for _, p := range rmc.JobProblems() {
+		if before[p.Error()] {
+			continue
+		}
+		if p.Fatal {
+			fmt.Printf("Error: %s\n", p)
+			ok = false
+		} else {
+			fmt.Printf("Warning: %s\n", p)
+		}
+	}
+	if !ok {
+		fmt.Println("Not saving the change.")
+	}
+	return ok
+}
+
+//Rescan the headers of a compile job after it changed
+func updateHeaders(rmc *client.RMakeConf, j *rmake.Job) {
+	if client.IsCompileJob(j.Expand(rmc.Vars)) {
+		err := rmc.UpdateHeaderDeps(j)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func listJobs(rmc *client.RMakeConf) {
+	for _, j := range rmc.Jobs {
+		fmt.Printf("%-24s %s\n", strings.Join(j.OutputFiles(), " "), client.CommandLine(j))
+	}
+}
+
+func showJob(rmc *client.RMakeConf, output string) error {
+	j := rmc.FindJob(output)
+	if j == nil {
+		return fmt.Errorf("No job makes '%s'", output)
+	}
+	fmt.Printf("Output:  %s\n", j.Output)
+	if len(j.Outputs) > 0 {
+		fmt.Printf("Also:    %s\n", strings.Join(j.Outputs, " "))
+	}
+	fmt.Printf("Command: %s\n", client.CommandLine(j))
+	fmt.Printf("Deps:    %s\n", strings.Join(j.Deps, " "))
+	if scan, ok := rmc.HeaderDeps[j.Output]; ok && len(scan.Deps) > 0 {
+		fmt.Printf("Scanned: %s\n", strings.Join(scan.Deps, " "))
+	}
+	var users []string
+	for _, oj := range rmc.Dependents(j) {
+		users = append(users, oj.Output)
+	}
+	if len(users) > 0 {
+		fmt.Printf("Used by: %s\n", strings.Join(users, " "))
+	}
+	return nil
+}
+
+func editJob(rmc *client.RMakeConf, output, what string, values []string) error {
+	j := rmc.FindJob(output)
+	if j == nil {
+		return fmt.Errorf("No job makes '%s'", output)
+	}
+	switch what {
+	case "command":
+		values, shell := shellFlag(values)
+		if len(values) == 0 {
+			return fmt.Errorf("A job needs a command")
+		}
+		//Several values are taken as one command line, checked the same
+		//way as the one given to job add
+		cmd, args, err := client.ParseCommand(strings.Join(values, " "), shell)
+		if err != nil {
+			return err
+		}
+		j.Command, j.Args = cmd, args
+	case "deps":
+		j.Deps = values
+		rmc.ListDeps(j, values)
+	case "add-deps":
+		rmc.ListDeps(j, values)
+		for _, v := range values {
 			found := false
-			for _,fi := range rmc.Files {
-				if dep == fi.Path {
-					found = true
-				}
+			for _, d := range j.Deps {
+				found = found || d == v
 			}
 			if !found {
-				rmc.AddFile(dep)
+				j.Deps = append(j.Deps, v)
 			}
 		}
-		rmc.Jobs = append(rmc.Jobs, j)
-	case "help":
-		switch args[3] {
-			case "add":
-				fmt.Println("usage: rmake job add command output deps...")
-				fmt.Println("example: rmake job add \"gcc main.c -c -O3\" main.o main.c mylib.h")
-				fmt.Println("The above command adds a job that compiles main.c, whose output")
-				fmt.Println("is main.o and that depends on main.c and mylib.h")
+	case "remove-deps":
+		var deps []string
+		for _, d := range j.Deps {
+			keep := true
+			for _, v := range values {
+				keep = keep && d != v
+			}
+			if keep {
+				deps = append(deps, d)
+			}
+		}
+		j.Deps = deps
+	default:
+		return fmt.Errorf("Can't edit '%s' of a job, only command, deps, add-deps and remove-deps", what)
+	}
+	rmc.TrackDeps(j)
+	updateHeaders(rmc, j)
+	return nil
+}
+
+//Find the Makefile make would use in the current directory
+func findMakefile() string {
+	for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return "Makefile"
+}
+
+//Warn about newly tracked source files that don't exist
+func warnMissing(files []string) {
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			fmt.Printf("Warning: '%s' is needed by a job but does not exist.\n", f)
 		}
 	}
 }
 
+func importJobs(rmc *client.RMakeConf, args []string) {
+	if len(args) < 3 {
+		printHelpImport()
+		return
+	}
+	switch args[2] {
+	case "make":
+		file := findMakefile()
+		if len(args) > 3 {
+			file = args[3]
+		}
+		mk, err := client.ParseMakefile(file)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		jobs, err := mk.Jobs(".")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		added := rmc.ImportJobs(jobs)
+		fmt.Printf("Imported %d jobs from %s, now tracking %d new files.\n", len(jobs), file, len(added))
+		warnMissing(added)
+		if rmc.Output == "" {
+			rmc.Output = mk.DefaultOutput(".", jobs)
+			if rmc.Output != "" {
+				fmt.Printf("Setting output to '%s'\n", rmc.Output)
+			}
+		}
+	case "compdb":
+		file := "compile_commands.json"
+		if len(args) > 3 {
+			file = args[3]
+		}
+		jobs, err := client.ImportCompDB(file, ".")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(args) > 4 {
+			rmc.Output = args[4]
+		}
+		if len(jobs) > 0 {
+			if rmc.Output != "" {
+				jobs = append(jobs, client.LinkJob(jobs, rmc.Output))
+			} else {
+				fmt.Println("No output set, not creating a link job.")
+			}
+		}
+		added := rmc.ImportJobs(jobs)
+		fmt.Printf("Imported %d jobs from %s, now tracking %d new files.\n", len(jobs), file, len(added))
+	case "ninja":
+		file := "build.ninja"
+		if len(args) > 3 {
+			file = args[3]
+		}
+		nf, err := client.ParseNinja(file)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		jobs, err := nf.Jobs(".")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		added := rmc.ImportJobs(jobs)
+		fmt.Printf("Imported %d jobs from %s, now tracking %d new files.\n", len(jobs), file, len(added))
+		warnMissing(added)
+		if rmc.Output == "" {
+			rmc.Output = nf.DefaultOutput(".", jobs)
+			if rmc.Output != "" {
+				fmt.Printf("Setting output to '%s'\n", rmc.Output)
+			}
+		}
+	default:
+		printHelpImport()
+	}
+}
+
+//Handle 'rmake graph [format] [options]'
+func graphJobs(rmc *client.RMakeConf, args []string) {
+	format := "dot"
+	outfile := ""
+	var opts client.GraphOptions
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "--changed":
+			opts.Changed = true
+		case "--critical":
+			opts.Critical = true
+		case "--failed":
+			opts.Failed = true
+		case "--all":
+			opts = client.GraphOptions{Changed: true, Critical: true, Failed: true}
+		case "-o":
+			if i+1 == len(args) {
+				printHelpGraph()
+				return
+			}
+			i++
+			outfile = args[i]
+		default:
+			if strings.HasPrefix(a, "-") {
+				fmt.Printf("Unknown option '%s'.\n", a)
+				printHelpGraph()
+				return
+			}
+			format = a
+		}
+	}
+	if opts.Failed && rmc.LastBuild == nil {
+		fmt.Fprintln(os.Stderr, "No build has been run yet, no jobs can have failed.")
+	}
+
+	out := os.Stdout
+	if outfile != "" {
+		fi, err := os.Create(outfile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer fi.Close()
+		out = fi
+	}
+	err := rmc.Graph(opts).Write(out, format)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func main() {
 	//Try and load default configuration
 	rmc, err := client.LoadRMakeConf("rmake.json")
@@ -72,35 +398,66 @@ func main() {
 	switch os.Args[1] {
 	case "add":
 		for _, v := range os.Args[2:] {
-			fmt.Printf("Adding: '%s'\n", v)
-			rmc.AddFile(v)
+			added, err := rmc.AddPath(v)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for _, p := range added {
+				fmt.Printf("Adding: '%s'\n", p)
+			}
 		}
 	case "server":
 		rmc.Server = os.Args[2]
 	case "out":
-		rmc.Output = os.Args[2]
+		if len(os.Args) < 3 {
+			printHelpBin()
+			break
+		}
+		//The first output is the one the build is organized around
+		rmc.Output = strings.TrimSuffix(os.Args[2], "/")
+		rmc.Outputs = nil
+		for _, o := range os.Args[3:] {
+			rmc.Outputs = append(rmc.Outputs, strings.TrimSuffix(o, "/"))
+		}
 	case "clean":
 		rmc.Clean()
 	case "var":
 		rmc.Vars[os.Args[2]] = os.Args[3]
 	case "check":
+		probs := rmc.JobProblems()
+		for _, p := range probs {
+			fmt.Println(p)
+		}
 		tr,err := rmc.MakeDepTree()
-		tr.Print()
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			fmt.Println("All is well!")
+			tr.Print()
+			if len(probs) == 0 {
+				fmt.Println("All is well!")
+			}
 		}
 	case "compress":
 		if len(os.Args) == 2 {
 			printHelpCompress()
+		} else if _, err := rmake.ParseCompressionLevel(os.Args[2]); err != nil {
+			fmt.Println(err)
+			printHelpCompress()
 		} else {
 			rmc.Compression = os.Args[2]
 		}
 	case "job":
-		createJobs(rmc, os.Args)
+		if !createJobs(rmc, os.Args) {
+			return
+		}
+	case "import":
+		importJobs(rmc, os.Args)
 	case "status":
 		rmc.Status()
+	case "graph":
+		graphJobs(rmc, os.Args[2:])
+		return
 	case "help":
 		if len(os.Args) == 2 {
 			printHelp("all")
@@ -4,9 +4,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/whyrusleeping/rmake/pkg/builder"
+	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
 func main() {
@@ -28,6 +30,18 @@ func main() {
 	// Avaliable processors
 	flag.IntVar(&procs, "p", 2, "Number of processors to use.")
 
+	var compress string
+	flag.StringVar(&compress, "compress", "fast",
+		"Compression level to offer (none, fast, default, best or 0-9)")
+
+	var heartbeat time.Duration
+	flag.DurationVar(&heartbeat, "heartbeat", 0,
+		"How often to send the manager a heartbeat, if it agrees (0 leaves it to the manager)")
+
+	var queue int
+	flag.IntVar(&queue, "queue", 0,
+		"How many jobs to queue before telling the manager we are full (0 for no limit)")
+
 	flag.BoolVar(&showhelp, "h", false, "Show help")
 	flag.Parse()
 
@@ -38,7 +52,16 @@ func main() {
 
 	log.Info("Running as:")
 	log.Infof("rmakebuilder -l %s -m %s -p %d\n", listname, manager, procs)
+	level, err := rmake.ParseCompressionLevel(compress)
+	if err != nil {
+		log.Critical(err)
+		log.Flush()
+		return
+	}
 	if b := builder.NewBuilder(listname, manager, procs); b != nil {
+		b.Compression = level
+		b.UpdateFrequency = heartbeat
+		b.RequestQueue.SetCapacity(queue)
 		b.DoHandshake()
 		// Start the builder
 		b.Run()
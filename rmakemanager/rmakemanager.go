@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/dustin/go-humanize"
 	"github.com/whyrusleeping/rmake/pkg/manager"
+	"github.com/whyrusleeping/rmake/pkg/types"
 )
 
 func main() {
@@ -16,11 +19,70 @@ func main() {
 	flag.StringVar(&listname,
 		"l", ":11221", "The ip and or port to listen on (shorthand)")
 
+	var timeout time.Duration
+	flag.DurationVar(&timeout,
+		"session-timeout", time.Hour*24, "How long to keep a session's files after its last build")
+
+	var compress string
+	flag.StringVar(&compress,
+		"compress", "default", "The highest compression level to agree to (none, fast, default, best or 0-9)")
+
+	var attempts int
+	flag.IntVar(&attempts,
+		"attempts", 3, "How many builders a job can be sent to, when they are lost, before its build fails")
+
+	var heartbeat time.Duration
+	flag.DurationVar(&heartbeat,
+		"heartbeat", rmake.DefaultHeartbeatInterval, "The longest interval builders may send heartbeats at")
+
+	var missed int
+	flag.IntVar(&missed,
+		"missed-beats", 3, "How many heartbeats in a row a builder can miss before its jobs are sent elsewhere")
+
+	var sched string
+	flag.StringVar(&sched,
+		"scheduler", "load", "How to pick the builder for a job (jobs or load)")
+
+	var bandwidth string
+	flag.StringVar(&bandwidth,
+		"bandwidth", "12MB", "How many bytes per second files are assumed to cross the network at, when placing jobs near their inputs")
+
 	flag.Parse()
 
+	level, err := rmake.ParseCompressionLevel(compress)
+	if err != nil {
+		log.Critical(err)
+		log.Flush()
+		return
+	}
+	scheduler, err := manager.NewScheduler(sched)
+	if err != nil {
+		log.Critical(err)
+		log.Flush()
+		return
+	}
+	bw, err := humanize.ParseBytes(bandwidth)
+	if err != nil {
+		log.Critical(err)
+		log.Flush()
+		return
+	}
+	if heartbeat < rmake.MinHeartbeatInterval {
+		log.Criticalf("The heartbeat interval can't be shorter than %s", rmake.MinHeartbeatInterval)
+		log.Flush()
+		return
+	}
+
 	log.Info("Running as:")
-	log.Infof("rmakemanager -l %s", listname)
+	log.Infof("rmakemanager -l %s -session-timeout %s -compress %s -attempts %d -heartbeat %s -missed-beats %d -scheduler %s -bandwidth %s", listname, timeout, compress, attempts, heartbeat, missed, sched, bandwidth)
 
 	manager := manager.NewManager(listname)
+	manager.SessionTimeout = timeout
+	manager.Compression = level
+	manager.MaxAttempts = attempts
+	manager.HeartbeatInterval = heartbeat
+	manager.MaxMissedBeats = missed
+	manager.Scheduler = scheduler
+	manager.Bandwidth = int64(bw)
 	manager.Start()
 }